@@ -0,0 +1,290 @@
+package ironhook
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// tells confirmation tokens apart from secrets
+const confirmationTokenPrefix = "ihc_"
+
+// "ihc_<nonce>_<HMAC of the nonce>", only the nonce is stored,
+// so tokens can be sent again on every attempt but not forged from the database
+func confirmationToken(secret, nonce string) string {
+	return confirmationTokenPrefix + nonce + "_" + hmacHex(secret, []byte("confirm."+nonce))
+}
+
+// the nonce of a well-formed token
+func confirmationNonce(token string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(token, confirmationTokenPrefix), "_")
+	if !strings.HasPrefix(token, confirmationTokenPrefix) || len(parts) != 2 || parts[0] == "" {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// the confirmation URL of the service, with the token appended
+func confirmationURL(base, token string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Starts verifying the endpoint in the background, for receivers which
+// aren't up yet. The endpoint is PendingVerification until either
+//
+// - a verification request succeeds, they're retried every
+// HOOK_VERIFICATION_RETRY_INTERVAL for HOOK_VERIFICATION_PENDING_WINDOW
+//
+// - the receiver calls back HOOK_VERIFICATION_CONFIRMATION_URL with the
+// confirmation_token it was sent, and your app passes the token
+// to service.ConfirmVerification()
+//
+// or the window passes, and it's Unverified again.
+// The endpoint needs a secret for the confirmation token.
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) VerifyAsync(endpoint WebhookEndpoint) (WebhookEndpoint, error) {
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+
+	if model_endpoint.Status.verified() {
+		s.log.Info("endpoint already verified")
+		return *endpointDbToWeb(model_endpoint), nil
+	}
+
+	if !model_endpoint.Status.canMoveTo(PendingVerification) {
+		return endpoint, ErrIllegalStatusTransition
+	}
+
+	secret, err := s.decryptSecret(model_endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+	if secret == "" {
+		return endpoint, &VerificationError{Reason: VerificationMissingSecret}
+	}
+
+	pending_until := time.Now().Add(s.verification.pendingWindow)
+	model_endpoint.ConfirmationNonce = hex.EncodeToString(randomBytes(16))
+	model_endpoint.VerificationPendingUntil = &pending_until
+	model_endpoint.VerificationAttempts = 0
+
+	s.log.Info(
+		"verifying an endpoint in the background",
+		zap.String("UUID", endpoint.UUID.String()),
+		zap.Time("PendingUntil", pending_until),
+	)
+
+	err = s.changeStatus(model_endpoint, PendingVerification, s.actor, "verification started", map[string]interface{}{
+		"confirmation_nonce":         model_endpoint.ConfirmationNonce,
+		"verification_pending_until": model_endpoint.VerificationPendingUntil,
+		"verification_attempts":      model_endpoint.VerificationAttempts,
+	})
+	if err != nil {
+		return endpoint, err
+	}
+
+	// first attempt right away, without waiting for the caller
+	select {
+	case s.pendingVerifications <- struct{}{}:
+	default:
+	}
+
+	return *endpointDbToWeb(model_endpoint), nil
+}
+
+// Verifies the endpoint whose receiver called back with the token,
+// see service.VerifyAsync()
+func (s *WebhookEndpointServiceImpl) ConfirmVerification(token string) (WebhookEndpoint, error) {
+
+	nonce, ok := confirmationNonce(token)
+	if !ok {
+		return WebhookEndpoint{}, ErrInvalidConfirmationToken
+	}
+
+	var model_endpoint WebhookEndpointDB
+	tx := withEndpointDetails(s.tenantScope(s.db)).
+		Where("confirmation_nonce = ? AND status = ?", nonce, PendingVerification).
+		First(&model_endpoint)
+	if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return WebhookEndpoint{}, ErrInvalidConfirmationToken
+	}
+	if tx.Error != nil {
+		s.log.Error("couldnt look up the confirmation token", zap.Error(tx.Error))
+		return WebhookEndpoint{}, tx.Error
+	}
+
+	secret, err := s.decryptSecret(&model_endpoint)
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	expired := model_endpoint.VerificationPendingUntil == nil || time.Now().After(*model_endpoint.VerificationPendingUntil)
+	if secret == "" || expired || !hmac.Equal([]byte(token), []byte(confirmationToken(secret, nonce))) {
+		return WebhookEndpoint{}, ErrInvalidConfirmationToken
+	}
+
+	s.log.Info("receiver confirmed an endpoint", zap.String("UUID", model_endpoint.UUID.String()))
+
+	err = s.markVerified(&model_endpoint, s.actor, "receiver confirmed the verification")
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	return *endpointDbToWeb(&model_endpoint), nil
+}
+
+// Verified, and done with pending verifications
+func (s *WebhookEndpointServiceImpl) markVerified(model_endpoint *WebhookEndpointDB, actor, reason string) error {
+
+	verified_at := time.Now()
+	err := s.changeStatus(model_endpoint, Verified, actor, reason, verifiedColumns(verified_at))
+	if err != nil {
+		return err
+	}
+	model_endpoint.setVerified(verified_at)
+	return nil
+}
+
+// what markVerified saves, besides the status
+func verifiedColumns(verified_at time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"confirmation_nonce":         "",
+		"verification_pending_until": nil,
+		"verification_attempts":      0,
+		"verified_at":                verified_at,
+		"health_failures":            0,
+	}
+}
+
+func (m *WebhookEndpointDB) setVerified(verified_at time.Time) {
+	m.ConfirmationNonce = ""
+	m.VerificationPendingUntil = nil
+	m.VerificationAttempts = 0
+	m.VerifiedAt = &verified_at
+	m.HealthFailures = 0
+}
+
+// One more attempt at every pending verification,
+// endpoints past their window go back to Unverified
+func (s *WebhookEndpointServiceImpl) retryPendingVerifications() error {
+
+	var pending []WebhookEndpointDB
+	tx := withEndpointDetails(s.db).
+		Where("status = ?", PendingVerification).
+		Order("id").
+		Find(&pending)
+	if tx.Error != nil {
+		s.log.Error("couldnt fetch pending verifications", zap.Error(tx.Error))
+		return tx.Error
+	}
+
+	for i := range pending {
+		model_endpoint := &pending[i]
+		log := s.log.With(zap.String("UUID", model_endpoint.UUID.String()))
+
+		if model_endpoint.VerificationPendingUntil == nil || time.Now().After(*model_endpoint.VerificationPendingUntil) {
+			log.Warn("gave up verifying an endpoint", zap.Int("Attempts", model_endpoint.VerificationAttempts))
+			err := s.changeStatus(model_endpoint, Unverified, SystemActor, "verification window expired", map[string]interface{}{
+				"confirmation_nonce":         "",
+				"verification_pending_until": nil,
+			})
+			if err != nil && err != ErrStatusChanged && err != ErrIllegalStatusTransition {
+				return err
+			}
+			continue
+		}
+
+		if model_endpoint.VerificationAttempts > 0 {
+			s.metrics.retried(retryVerification)
+		}
+		err := s.verifyEndpoint(model_endpoint)
+		if err == nil {
+			log.Info("successfully verified an endpoint in the background")
+			// unless it was confirmed or disabled in the meantime
+			err = s.markVerified(model_endpoint, SystemActor, "passed background verification")
+			if err != nil && err != ErrStatusChanged && err != ErrIllegalStatusTransition {
+				return err
+			}
+			continue
+		}
+
+		log.Info(
+			"background verification attempt failed",
+			zap.Int("Attempt", model_endpoint.VerificationAttempts+1),
+			zap.Error(err),
+		)
+		tx = s.db.Model(model_endpoint).UpdateColumn("verification_attempts", model_endpoint.VerificationAttempts+1)
+		if tx.Error != nil {
+			log.Error("couldnt save a verification attempt", zap.Error(tx.Error))
+			return tx.Error
+		}
+	}
+	return nil
+}
+
+// Retries pending verifications every interval,
+// and right away when VerifyAsync asks for it
+func (s *WebhookEndpointServiceImpl) startVerificationRetries(interval time.Duration) {
+
+	s.log.Info(
+		"Starting the background verification",
+		zap.Duration("Interval", interval),
+		zap.Duration("PendingWindow", s.verification.pendingWindow),
+	)
+
+	retry := func() {
+		err := s.retryPendingVerifications()
+		if err != nil {
+			s.log.Error("Failed retrying pending verifications", zap.Error(err))
+		}
+	}
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				retry()
+			case <-s.pendingVerifications:
+				retry()
+			}
+		}
+	}()
+}
+
+var ErrInvalidConfirmationToken error = errors.New(
+	`
+	cant confirm a verification with this token.
+	Recover by checking the endpoint is still pending verification,
+	or by starting over with service.VerifyAsync(endpoint)
+	`,
+)
+var ErrInvalidPendingVerification error = errors.New(
+	`
+	cant accept these background verification settings.
+	Recover by setting HOOK_VERIFICATION_RETRY_INTERVAL and HOOK_VERIFICATION_PENDING_WINDOW
+	to positive durations, and HOOK_VERIFICATION_CONFIRMATION_URL to an http/s URL or nothing
+	`,
+)
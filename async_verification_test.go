@@ -0,0 +1,199 @@
+package ironhook
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// down until told otherwise, remembers the confirmation URL it was sent
+type sleepyReceiver struct {
+	mu               sync.Mutex
+	up               bool
+	confirmation_url string
+}
+
+func (r *sleepyReceiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if confirmation := request.URL.Query().Get("confirmation_url"); confirmation != "" {
+		r.confirmation_url = confirmation
+	}
+	if !r.up {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, request.URL.Query().Get("id"))
+}
+
+func (r *sleepyReceiver) wakeUp() {
+	r.mu.Lock()
+	r.up = true
+	r.mu.Unlock()
+}
+
+func (r *sleepyReceiver) confirmationURL() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.confirmation_url
+}
+
+func waitForStatus(t *testing.T, svc WebhookEndpointService, endpoint WebhookEndpoint, status WebhookEndpointStatus) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		current, err := svc.Get(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current.Status == status {
+			return
+		}
+	}
+	t.Fatal("Expected the endpoint to reach status ", status)
+}
+
+func Test_VerifyAsyncRetries(t *testing.T) {
+
+	t.Setenv("HOOK_VERIFICATION_RETRY_INTERVAL", "20ms")
+
+	receiver := &sleepyReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	endpoint, err := svc.Create(WebhookEndpoint{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err = svc.VerifyAsync(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Status != PendingVerification {
+		t.Fatal("Expected the endpoint to be pending verification, found ", endpoint.Status)
+	}
+
+	// not verified yet
+	err = svc.Notify(endpoint, WebhookNotification{})
+	if err != ErrEndpointNotYetActivated {
+		t.Fatal("Expected ErrEndpointNotYetActivated, got ", err)
+	}
+
+	receiver.wakeUp()
+	waitForStatus(t, svc, endpoint, Verified)
+}
+
+func Test_ConfirmVerification(t *testing.T) {
+
+	t.Setenv("HOOK_VERIFICATION_RETRY_INTERVAL", "20ms")
+	t.Setenv("HOOK_VERIFICATION_CONFIRMATION_URL", "https://app.example.com/webhooks/confirm")
+
+	receiver := &sleepyReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	endpoint, err := svc.Create(WebhookEndpoint{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.VerifyAsync(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var confirmation string
+	for deadline := time.Now().Add(5 * time.Second); confirmation == "" && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		confirmation = receiver.confirmationURL()
+	}
+	u, err := url.Parse(confirmation)
+	if err != nil || u.Host != "app.example.com" {
+		t.Fatal("Expected a confirmation URL, found ", confirmation)
+	}
+	token := u.Query().Get("token")
+
+	// a token of our own making
+	forged := token[:len(token)-1] + "0"
+	if forged == token {
+		forged = token[:len(token)-1] + "1"
+	}
+	_, err = svc.ConfirmVerification(forged)
+	if err != ErrInvalidConfirmationToken {
+		t.Fatal("Expected ErrInvalidConfirmationToken, got ", err)
+	}
+
+	confirmed, err := svc.ConfirmVerification(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmed.UUID != endpoint.UUID || confirmed.Status != Verified {
+		t.Fatal("Expected the endpoint to be verified, found ", confirmed)
+	}
+
+	// single use
+	_, err = svc.ConfirmVerification(token)
+	if err != ErrInvalidConfirmationToken {
+		t.Fatal("Expected the token to be used up, got ", err)
+	}
+}
+
+func Test_VerifyAsyncGivesUp(t *testing.T) {
+
+	t.Setenv("HOOK_VERIFICATION_RETRY_INTERVAL", "20ms")
+	t.Setenv("HOOK_VERIFICATION_PENDING_WINDOW", "100ms")
+
+	receiver := &sleepyReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint, err := svc.Create(WebhookEndpoint{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.VerifyAsync(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, svc, endpoint, Unverified)
+
+	var db_endpoint WebhookEndpointDB
+	svc.db.First(&db_endpoint, "uuid = ?", endpoint.UUID)
+	if db_endpoint.VerificationAttempts == 0 || db_endpoint.ConfirmationNonce != "" {
+		t.Fatal("Expected failed attempts and no confirmation left, found ", db_endpoint.VerificationAttempts, db_endpoint.ConfirmationNonce)
+	}
+
+	// endpoints without a secret cant be confirmed
+	svc.db.Model(&db_endpoint).UpdateColumn("signing_secret", "")
+	_, err = svc.VerifyAsync(endpoint)
+	var verification_err *VerificationError
+	if !errors.As(err, &verification_err) || verification_err.Reason != VerificationMissingSecret {
+		t.Fatal("Expected a missing_secret VerificationError, got ", err)
+	}
+
+	t.Setenv("HOOK_VERIFICATION_PENDING_WINDOW", "0")
+	_, err = NewWebhookService(nil)
+	if err != ErrInvalidPendingVerification {
+		t.Fatal("Expected ErrInvalidPendingVerification, got ", err)
+	}
+}
@@ -0,0 +1,393 @@
+package ironhook
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+)
+
+// How ironhook authenticates its requests to an endpoint
+type AuthType string
+
+const (
+	AuthNone   AuthType = ""
+	AuthBasic  AuthType = "basic"
+	AuthBearer AuthType = "bearer"
+	// ironhook fetches access tokens from the endpoint owner's token URL
+	AuthOAuth2ClientCredentials AuthType = "oauth2_client_credentials"
+)
+
+// Credentials sent with both verification and notification requests,
+// see service.SetAuth(). Only the fields of the chosen Type are used.
+type EndpointAuth struct {
+	Type AuthType `json:"type"`
+
+	// AuthBasic
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// AuthBearer
+	Token string `json:"token,omitempty"`
+
+	// AuthOAuth2ClientCredentials
+	TokenURL     string   `json:"token_url,omitempty"`
+	ClientID     string   `json:"client_id,omitempty"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// associated data of the encrypted auth config
+const endpointAuthColumn = "webhook_endpoint_dbs.auth_config"
+
+// tokens are refreshed a bit before they expire
+const tokenExpiryMargin = 30 * time.Second
+
+func (a EndpointAuth) validate() error {
+	switch a.Type {
+	case AuthNone:
+		return nil
+	case AuthBasic:
+		if a.Username == "" {
+			return ErrInvalidEndpointAuth
+		}
+	case AuthBearer:
+		if a.Token == "" {
+			return ErrInvalidEndpointAuth
+		}
+	case AuthOAuth2ClientCredentials:
+		if a.ClientID == "" || a.ClientSecret == "" {
+			return ErrInvalidEndpointAuth
+		}
+		if _, err := prepareEndpointForOperations(a.TokenURL); err != nil {
+			return ErrInvalidEndpointAuth
+		}
+	default:
+		return ErrInvalidEndpointAuth
+	}
+	return nil
+}
+
+// Replaces the credentials ironhook authenticates to the endpoint with,
+// EndpointAuth{} removes them. They're encrypted at rest when a key provider
+// is configured and never handed back, endpoints only tell the AuthType.
+//
+// The Authorization header takes precedence over a custom one, see service.SetHeaders()
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) SetAuth(endpoint WebhookEndpoint, auth EndpointAuth) (WebhookEndpoint, error) {
+
+	if err := auth.validate(); err != nil {
+		return endpoint, err
+	}
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+
+	err = s.encryptAuth(model_endpoint, auth)
+	if err != nil {
+		return endpoint, err
+	}
+
+	s.log.Info(
+		"updating the endpoint authentication",
+		zap.String("UUID", endpoint.UUID.String()),
+		zap.String("AuthType", string(auth.Type)),
+	)
+
+	tx := s.db.Model(model_endpoint).UpdateColumns(map[string]interface{}{
+		"auth_type":         model_endpoint.AuthType,
+		"auth_config":       model_endpoint.AuthConfig,
+		"encryption_key_id": model_endpoint.EncryptionKeyID,
+	})
+	if tx.Error != nil {
+		s.log.Error("couldnt save the endpoint authentication", zap.Error(tx.Error))
+		return endpoint, tx.Error
+	}
+
+	// the old credentials may have fetched it
+	s.tokens.forget(model_endpoint.UUID)
+
+	return *endpointDbToWeb(model_endpoint), nil
+}
+
+// sets the auth columns of the endpoint
+func (s *WebhookEndpointServiceImpl) encryptAuth(model_endpoint *WebhookEndpointDB, auth EndpointAuth) error {
+
+	model_endpoint.AuthType = auth.Type
+	model_endpoint.AuthConfig = ""
+	model_endpoint.EncryptionKeyID = ""
+	if auth.Type == AuthNone {
+		return nil
+	}
+
+	config, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+	encrypted, key_id, err := s.cipher.encrypt(string(config), binding{endpointAuthColumn, model_endpoint.UUID.String()})
+	if err != nil {
+		s.log.Error("couldnt encrypt the endpoint authentication", zap.Error(err))
+		return err
+	}
+	model_endpoint.AuthConfig = encrypted
+	model_endpoint.EncryptionKeyID = key_id
+	return nil
+}
+
+func (s *WebhookEndpointServiceImpl) decryptAuth(model_endpoint *WebhookEndpointDB) (EndpointAuth, error) {
+
+	if model_endpoint.AuthType == AuthNone || model_endpoint.AuthConfig == "" {
+		return EndpointAuth{}, nil
+	}
+
+	config, err := s.cipher.decrypt(model_endpoint.AuthConfig, model_endpoint.EncryptionKeyID, binding{endpointAuthColumn, model_endpoint.UUID.String()})
+	if err != nil {
+		s.log.Error(
+			"couldnt decrypt the endpoint authentication",
+			zap.String("UUID", model_endpoint.UUID.String()),
+			zap.Error(err),
+		)
+		return EndpointAuth{}, err
+	}
+
+	var auth EndpointAuth
+	err = json.Unmarshal([]byte(config), &auth)
+	return auth, err
+}
+
+// part of service.ReEncrypt()
+func (s *WebhookEndpointServiceImpl) reEncryptEndpointAuth(current string) (int64, error) {
+
+	var total int64
+	var after uint
+	for {
+		var batch []WebhookEndpointDB
+		tx := s.db.Unscoped().
+			Where("id > ? AND encryption_key_id <> ? AND auth_config <> ''", after, current).
+			Order("id").
+			Limit(rowBatchSize).
+			Find(&batch)
+		if tx.Error != nil {
+			s.log.Error("couldnt fetch endpoints for re-encryption", zap.Error(tx.Error))
+			return total, tx.Error
+		}
+
+		for i := range batch {
+			auth, err := s.decryptAuth(&batch[i])
+			if err != nil {
+				return total, err
+			}
+			err = s.encryptAuth(&batch[i], auth)
+			if err != nil {
+				return total, err
+			}
+			tx = s.db.Unscoped().
+				Model(&batch[i]).
+				UpdateColumns(map[string]interface{}{
+					"auth_config":       batch[i].AuthConfig,
+					"encryption_key_id": batch[i].EncryptionKeyID,
+				})
+			if tx.Error != nil {
+				s.log.Error("couldnt save a re-encrypted endpoint", zap.Error(tx.Error))
+				return total, tx.Error
+			}
+			total++
+		}
+
+		if len(batch) < rowBatchSize {
+			break
+		}
+		after = batch[len(batch)-1].ID
+	}
+	return total, nil
+}
+
+// sets the Authorization header on an outgoing request
+func (s *WebhookEndpointServiceImpl) authorize(client *http.Client, request *http.Request, model_endpoint *WebhookEndpointDB) error {
+
+	auth, err := s.decryptAuth(model_endpoint)
+	if err != nil {
+		return err
+	}
+
+	switch auth.Type {
+	case AuthBasic:
+		request.SetBasicAuth(auth.Username, auth.Password)
+	case AuthBearer:
+		request.Header.Set("Authorization", "Bearer "+auth.Token)
+	case AuthOAuth2ClientCredentials:
+		token, err := s.accessToken(client, model_endpoint.UUID, auth)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// Builds the request with build, adds the endpoint's custom headers and
+// credentials, then sends it with the endpoint's TLS settings, if any.
+// An OAuth2 access token the endpoint rejects is fetched anew
+// and the request retried once.
+func (s *WebhookEndpointServiceImpl) sendToEndpoint(base *http.Client, model_endpoint *WebhookEndpointDB, build func() (*http.Request, error)) (*http.Response, error) {
+
+	// the token URL is reached with the same TLS settings
+	client, err := s.clientForEndpoint(base, model_endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	send := func() (*http.Response, error) {
+		request, err := build()
+		if err != nil {
+			return nil, err
+		}
+		err = s.applyHeaders(request, model_endpoint.Headers)
+		if err != nil {
+			return nil, err
+		}
+		err = s.authorize(client, request, model_endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return client.Do(request)
+	}
+
+	response, err := send()
+	if err != nil || response.StatusCode != http.StatusUnauthorized || model_endpoint.AuthType != AuthOAuth2ClientCredentials {
+		return response, err
+	}
+
+	s.log.Info(
+		"endpoint rejected the access token, fetching a new one",
+		zap.String("UUID", model_endpoint.UUID.String()),
+	)
+	_, _ = io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	s.tokens.forget(model_endpoint.UUID)
+	s.metrics.retried(retryAccessToken)
+
+	return send()
+}
+
+// A cached token, or a new one from the token URL
+func (s *WebhookEndpointServiceImpl) accessToken(client *http.Client, endpoint_uuid uuid.UUID, auth EndpointAuth) (string, error) {
+
+	if token, ok := s.tokens.get(endpoint_uuid); ok {
+		return token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(auth.Scopes) > 0 {
+		form.Set("scope", strings.Join(auth.Scopes, " "))
+	}
+	request, err := http.NewRequest("POST", auth.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(auth.ClientID), url.QueryEscape(auth.ClientSecret))
+
+	response, err := client.Do(request)
+	if err != nil {
+		s.log.Error("couldnt reach the token URL", zap.String("UUID", endpoint_uuid.String()), zap.Error(err))
+		return "", err
+	}
+	defer response.Body.Close()
+
+	var token_response struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&token_response)
+	if response.StatusCode != http.StatusOK || err != nil || token_response.AccessToken == "" {
+		s.log.Warn(
+			"token URL didnt issue an access token",
+			zap.String("UUID", endpoint_uuid.String()),
+			zap.Int("StatusCode", response.StatusCode),
+		)
+		return "", ErrFailedFetchingAccessToken
+	}
+	if token_response.TokenType != "" && !strings.EqualFold(token_response.TokenType, "bearer") {
+		return "", ErrFailedFetchingAccessToken
+	}
+
+	// tokens without an expiry are used until the endpoint rejects them
+	var expires_at time.Time
+	if token_response.ExpiresIn > 0 {
+		expires_at = time.Now().Add(time.Duration(token_response.ExpiresIn)*time.Second - tokenExpiryMargin)
+	}
+	s.tokens.put(endpoint_uuid, token_response.AccessToken, expires_at)
+
+	return token_response.AccessToken, nil
+}
+
+// OAuth2 access tokens by endpoint, shared by the tenant views
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[uuid.UUID]cachedToken
+}
+
+type cachedToken struct {
+	value string
+	// zero for no expiry
+	expiresAt time.Time
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{tokens: map[uuid.UUID]cachedToken{}}
+}
+
+func (c *tokenCache) get(endpoint_uuid uuid.UUID) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	token, ok := c.tokens[endpoint_uuid]
+	if !ok {
+		return "", false
+	}
+	if !token.expiresAt.IsZero() && time.Now().After(token.expiresAt) {
+		delete(c.tokens, endpoint_uuid)
+		return "", false
+	}
+	return token.value, true
+}
+
+func (c *tokenCache) put(endpoint_uuid uuid.UUID, value string, expires_at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[endpoint_uuid] = cachedToken{value: value, expiresAt: expires_at}
+}
+
+func (c *tokenCache) forget(endpoint_uuid uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tokens, endpoint_uuid)
+}
+
+var ErrInvalidEndpointAuth error = errors.New(
+	`
+	cant accept this endpoint authentication.
+	Recover by retrying with a username for basic, a token for bearer
+	or a token URL, client ID and client secret for oauth2_client_credentials
+	`,
+)
+var ErrFailedFetchingAccessToken error = errors.New(
+	`
+	the token URL didnt issue a bearer access token.
+	Recover by checking the client credentials and the token URL with the endpoint owner
+	`,
+)
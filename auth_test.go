@@ -0,0 +1,210 @@
+package ironhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// issues numbered access tokens on /token and only accepts the latest one
+type oauth2Receiver struct {
+	mu             sync.Mutex
+	issued         int
+	expires_in     int
+	authorizations []string
+}
+
+func (o *oauth2Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		client_id, client_secret, ok := r.BasicAuth()
+		if !ok || client_id != "ironhook" || client_secret != "s3cret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		o.issued++
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token-%d", o.issued),
+			"token_type":   "Bearer",
+			"expires_in":   o.expires_in,
+		})
+		return
+	}
+
+	o.authorizations = append(o.authorizations, r.Header.Get("Authorization"))
+	if r.Header.Get("Authorization") != fmt.Sprintf("Bearer token-%d", o.issued) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if strings.Contains(r.URL.Path, "/verification") {
+		fmt.Fprint(w, r.URL.Query().Get("id"))
+	}
+}
+
+// revokes the current token, the next request has to fetch a new one
+func (o *oauth2Receiver) revoke() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.issued++
+}
+
+func Test_EndpointAuthValidation(t *testing.T) {
+
+	cases := []struct {
+		auth EndpointAuth
+		want error
+	}{
+		{EndpointAuth{}, nil},
+		{EndpointAuth{Type: AuthBasic, Username: "jane"}, nil},
+		{EndpointAuth{Type: AuthBasic}, ErrInvalidEndpointAuth},
+		{EndpointAuth{Type: AuthBearer}, ErrInvalidEndpointAuth},
+		{EndpointAuth{Type: AuthOAuth2ClientCredentials, TokenURL: "https://example.com/token", ClientID: "id", ClientSecret: "secret"}, nil},
+		{EndpointAuth{Type: AuthOAuth2ClientCredentials, TokenURL: "example.com/token", ClientID: "id", ClientSecret: "secret"}, ErrInvalidEndpointAuth},
+		{EndpointAuth{Type: "digest"}, ErrInvalidEndpointAuth},
+	}
+	for _, c := range cases {
+		if err := c.auth.validate(); err != c.want {
+			t.Fatalf("%+v: have %v want %v", c.auth, err, c.want)
+		}
+	}
+}
+
+func Test_BasicAndBearerAuth(t *testing.T) {
+
+	var mu sync.Mutex
+	var authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		mu.Unlock()
+		fmt.Fprint(w, r.URL.Query().Get("id"))
+	}))
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(server.Client(), WithKeyProvider(NewLocalKMS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint, err := svc.Create(WebhookEndpoint{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err = svc.SetAuth(endpoint, EndpointAuth{Type: AuthBasic, Username: "jane", Password: "doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.AuthType != AuthBasic {
+		t.Fatal("Expected the auth type to be listed, found ", endpoint.AuthType)
+	}
+
+	var db_endpoint WebhookEndpointDB
+	svc.db.First(&db_endpoint, "uuid = ?", endpoint.UUID)
+	if db_endpoint.EncryptionKeyID == "" || strings.Contains(db_endpoint.AuthConfig, "doe") {
+		t.Fatal("Expected the credentials to be encrypted, found ", db_endpoint.AuthConfig)
+	}
+
+	endpoint, err = svc.Verify(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = svc.SetAuth(endpoint, EndpointAuth{Type: AuthBearer, Token: "opaque"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(authorizations) != 2 || !strings.HasPrefix(authorizations[0], "Basic ") || authorizations[1] != "Bearer opaque" {
+		t.Fatal("Expected basic then bearer authorization, found ", authorizations)
+	}
+}
+
+func Test_OAuth2ClientCredentials(t *testing.T) {
+
+	receiver := &oauth2Receiver{expires_in: 3600}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint, err := svc.Create(WebhookEndpoint{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err = svc.SetAuth(endpoint, EndpointAuth{
+		Type:         AuthOAuth2ClientCredentials,
+		TokenURL:     server.URL + "/token",
+		ClientID:     "ironhook",
+		ClientSecret: "s3cret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint, err = svc.Verify(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiver.issued != 1 {
+		t.Fatal("Expected the token to be cached, issued ", receiver.issued)
+	}
+
+	// rejected token, fetched anew and retried
+	receiver.revoke()
+	err = svc.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiver.issued != 3 {
+		t.Fatal("Expected a new token after a 401, issued ", receiver.issued)
+	}
+
+	// expired token
+	svc.tokens.put(endpoint.UUID, "token-3", time.Now().Add(-time.Second))
+	err = svc.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiver.issued != 4 {
+		t.Fatal("Expected a new token after expiry, issued ", receiver.issued)
+	}
+
+	// wrong client credentials
+	_, err = svc.SetAuth(endpoint, EndpointAuth{
+		Type:         AuthOAuth2ClientCredentials,
+		TokenURL:     server.URL + "/token",
+		ClientID:     "ironhook",
+		ClientSecret: "wrong",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4())})
+	if err != ErrFailedFetchingAccessToken {
+		t.Fatal("Expected ErrFailedFetchingAccessToken, got ", err)
+	}
+}
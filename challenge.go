@@ -0,0 +1,65 @@
+package ironhook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+)
+
+// A nonce sent to an endpoint, kept until its answer comes back
+// so every nonce is only accepted once
+type WebhookVerificationNonceDB struct {
+	ID           uint      `gorm:"primarykey"`
+	EndpointUUID uuid.UUID `gorm:"type:uuid;not null"`
+	// SHA-256 of the nonce, the nonce itself only goes to the endpoint
+	NonceHash string `gorm:"not null"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+func hashNonce(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// Stores a new nonce for the endpoint, dropping the expired ones
+func (s *WebhookEndpointServiceImpl) issueNonce(endpoint_uuid uuid.UUID) (string, error) {
+
+	now := time.Now()
+	tx := s.db.Where("expires_at <= ?", now).Delete(&WebhookVerificationNonceDB{})
+	if tx.Error != nil {
+		s.log.Error("couldnt delete expired verification nonces", zap.Error(tx.Error))
+		return "", tx.Error
+	}
+
+	nonce := hex.EncodeToString(randomBytes(32))
+	tx = s.db.Create(&WebhookVerificationNonceDB{
+		EndpointUUID: endpoint_uuid,
+		NonceHash:    hashNonce(nonce),
+		ExpiresAt:    now.Add(s.verification.nonceTTL),
+	})
+	if tx.Error != nil {
+		s.log.Error("couldnt save a verification nonce", zap.Error(tx.Error))
+		return "", tx.Error
+	}
+	return nonce, nil
+}
+
+// Deletes the nonce, a nonce which is already gone was used or expired
+func (s *WebhookEndpointServiceImpl) consumeNonce(endpoint_uuid uuid.UUID, nonce string) error {
+
+	tx := s.db.
+		Where("endpoint_uuid = ? AND nonce_hash = ? AND expires_at > ?", endpoint_uuid, hashNonce(nonce), time.Now()).
+		Delete(&WebhookVerificationNonceDB{})
+	if tx.Error != nil {
+		s.log.Error("couldnt delete a verification nonce", zap.Error(tx.Error))
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return &VerificationError{Reason: VerificationNonceExpired}
+	}
+	return nil
+}
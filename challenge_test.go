@@ -0,0 +1,206 @@
+package ironhook
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// answers challenges with the secret it's given, or echoes the UUID
+type challengeReceiver struct {
+	secret string
+	status int
+}
+
+func (c *challengeReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.status != 0 {
+		w.WriteHeader(c.status)
+		return
+	}
+	nonce := r.URL.Query().Get("nonce")
+	if VerifySignature(c.secret, r.Header, []byte(nonce), time.Minute) != nil {
+		fmt.Fprint(w, r.URL.Query().Get("id"))
+		return
+	}
+	fmt.Fprint(w, ChallengeResponse(c.secret, nonce))
+}
+
+func Test_ChallengeVerificationFlow(t *testing.T) {
+
+	t.Setenv("HOOK_VERIFICATION_MODE", "challenge")
+
+	receiver := &challengeReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(server.Client(), WithKeyProvider(NewLocalKMS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint, err := svc.Create(WebhookEndpoint{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Secret == "" {
+		t.Fatal("Expected Create to hand back the endpoint secret")
+	}
+	fetched, err := svc.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.Secret != "" {
+		t.Fatal("Expected the secret to be handed back only once")
+	}
+
+	// echoing the UUID isn't enough anymore
+	_, err = svc.Verify(endpoint)
+	var verification_err *VerificationError
+	if !errors.As(err, &verification_err) || verification_err.Reason != VerificationWrongResponse {
+		t.Fatal("Expected a wrong_response VerificationError, got ", err)
+	}
+	if !errors.Is(err, ErrFailedEndpointVerification) {
+		t.Fatal("Expected the error to be an ErrFailedEndpointVerification")
+	}
+
+	receiver.status = http.StatusServiceUnavailable
+	_, err = svc.Verify(endpoint)
+	if !errors.As(err, &verification_err) ||
+		verification_err.Reason != VerificationUnexpectedStatus ||
+		verification_err.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("Expected an unexpected_status VerificationError, got ", err)
+	}
+
+	receiver.status = 0
+	receiver.secret = endpoint.Secret
+	endpoint, err = svc.Verify(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Status != Verified {
+		t.Fatal("Expected the endpoint to be verified")
+	}
+
+	// answered nonces are gone, the unanswered one expires
+	var count int64
+	svc.db.Model(&WebhookVerificationNonceDB{}).Count(&count)
+	if count != 1 {
+		t.Fatal("Expected only the unanswered nonce to be left, found ", count)
+	}
+}
+
+func Test_ChallengeNoncesAreUsedOnce(t *testing.T) {
+
+	generic_svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint_uuid := uuid.Must(uuid.NewV4())
+	nonce, err := svc.issueNonce(endpoint_uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stored WebhookVerificationNonceDB
+	svc.db.First(&stored)
+	if stored.NonceHash == nonce {
+		t.Fatal("Expected only the nonce hash to be stored")
+	}
+
+	if err := svc.consumeNonce(uuid.Must(uuid.NewV4()), nonce); !errors.Is(err, ErrFailedEndpointVerification) {
+		t.Fatal("Expected the nonce to belong to its endpoint only, got ", err)
+	}
+	if err := svc.consumeNonce(endpoint_uuid, nonce); err != nil {
+		t.Fatal(err)
+	}
+	err = svc.consumeNonce(endpoint_uuid, nonce)
+	var verification_err *VerificationError
+	if !errors.As(err, &verification_err) || verification_err.Reason != VerificationNonceExpired {
+		t.Fatal("Expected a replayed nonce to be refused, got ", err)
+	}
+
+	// expired
+	svc.verification.nonceTTL = -time.Second
+	nonce, err = svc.issueNonce(endpoint_uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.consumeNonce(endpoint_uuid, nonce); !errors.As(err, &verification_err) {
+		t.Fatal("Expected an expired nonce to be refused, got ", err)
+	}
+}
+
+func Test_ChallengeWithoutSecret(t *testing.T) {
+
+	t.Setenv("HOOK_VERIFICATION_MODE", "challenge")
+
+	receiver := &challengeReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	// created before endpoints had secrets
+	endpoint_uuid := uuid.Must(uuid.NewV4())
+	tx := svc.db.Create(&WebhookEndpointDB{UUID: endpoint_uuid, URL: server.URL})
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	endpoint := WebhookEndpoint{UUID: endpoint_uuid}
+
+	_, err = svc.Verify(endpoint)
+	var verification_err *VerificationError
+	if !errors.As(err, &verification_err) || verification_err.Reason != VerificationMissingSecret {
+		t.Fatal("Expected a missing_secret VerificationError, got ", err)
+	}
+
+	endpoint, err = svc.RotateSecret(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.secret = endpoint.Secret
+	_, err = svc.Verify(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_VerifySignature(t *testing.T) {
+
+	request := httptest.NewRequest("GET", "/verification", nil)
+	signRequest(request, "ihsec_test", []byte("nonce"), time.Now().Add(-time.Minute))
+
+	if err := VerifySignature("ihsec_test", request.Header, []byte("nonce"), 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySignature("ihsec_other", request.Header, []byte("nonce"), 5*time.Minute); err != ErrInvalidSignature {
+		t.Fatal("Expected another secret to be refused, got ", err)
+	}
+	if err := VerifySignature("ihsec_test", request.Header, []byte("other"), 5*time.Minute); err != ErrInvalidSignature {
+		t.Fatal("Expected another payload to be refused, got ", err)
+	}
+	if err := VerifySignature("ihsec_test", request.Header, []byte("nonce"), time.Second); err != ErrInvalidSignature {
+		t.Fatal("Expected an old signature to be refused, got ", err)
+	}
+
+	t.Setenv("HOOK_VERIFICATION_MODE", "telepathy")
+	_, err := NewWebhookService(nil)
+	if err != ErrUnsupportedVerificationMode {
+		t.Fatal("Expected ErrUnsupportedVerificationMode, got ", err)
+	}
+}
@@ -12,6 +12,61 @@ func initConfig() {
 	// database
 	viper.SetDefault("db_engine", "sqlite")
 	viper.SetDefault("db_dsn", ":memory:")
+	viper.SetDefault("db_auto_migrate", true)
+	//
+	// notifications persistence: full, metadata or none
+	viper.SetDefault("notification_persistence", "full")
+	//
+	// appended to endpoint URLs, "/" for the URLs as they are
+	viper.SetDefault("notification_path", "/notification")
+	//
+	// encryption at rest, disabled without a key
+	viper.SetDefault("encryption_key", "")
+	viper.SetDefault("encryption_key_id", "default")
+	viper.SetDefault("encryption_previous_keys", "")
+	viper.SetDefault("encryption_key_file", "")
+	//
+	// notifications retention, zero keeps them forever
+	viper.SetDefault("retention_max_age", "0")
+	viper.SetDefault("retention_failed_max_age", "0")
+	viper.SetDefault("retention_max_rows_per_endpoint", 0)
+	viper.SetDefault("retention_interval", "1h")
+	viper.SetDefault("retention_batch_size", 1000)
+	//
+	// endpoints per tenant, zero for no limit
+	viper.SetDefault("tenant_max_endpoints", 0)
+	//
+	// endpoint certificates expiring within the warning are logged
+	viper.SetDefault("tls_expiry_warning", "720h")
+	viper.SetDefault("tls_expiry_check_interval", "24h")
+	//
+	// verification: echo, challenge or challenge-echo, redirects: follow, same-host or none
+	viper.SetDefault("verification_mode", "echo")
+	viper.SetDefault("verification_path", "/verification")
+	viper.SetDefault("verification_method", "GET")
+	viper.SetDefault("verification_response_field", "")
+	viper.SetDefault("verification_timeout", "3s")
+	viper.SetDefault("verification_redirects", "follow")
+	viper.SetDefault("verification_nonce_ttl", "5m")
+	//
+	// background verification, see VerifyAsync
+	viper.SetDefault("verification_retry_interval", "5m")
+	viper.SetDefault("verification_pending_window", "24h")
+	viper.SetDefault("verification_confirmation_url", "")
+	//
+	// health checks, off by default, zero interval disables them along with re-verification
+	viper.SetDefault("health_check_interval", "0")
+	viper.SetDefault("health_failure_threshold", 3)
+	viper.SetDefault("reverify_interval", "720h")
+	//
+	// how often paused endpoints are checked for the end of their pause
+	viper.SetDefault("pause_check_interval", "1m")
+	//
+	// egress policy, internal addresses are blocked unless allowed
+	viper.SetDefault("egress_allow_loopback", false)
+	viper.SetDefault("egress_allow_private", false)
+	viper.SetDefault("egress_allow_hosts", "")
+	viper.SetDefault("egress_deny_hosts", "")
 	//
 	// logger
 	viper.SetDefault("log_level", "info")
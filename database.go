@@ -26,10 +26,25 @@ func databaseConnection(engine, dsn string) (*gorm.DB, error) {
 		return nil, ErrUnsupportedDatabaseEngine
 	}
 
-	return gorm.Open(
+	db, err := gorm.Open(
 		drivers[engine](dsn),
 		&gorm.Config{},
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	if engine == "sqlite" {
+		// every connection to :memory: opens a separate, empty database
+		// and file databases dont handle concurrent writers well either
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(1)
+	}
+
+	return db, nil
 }
 
 var ErrUnsupportedDatabaseEngine error = errors.New(
@@ -0,0 +1,331 @@
+package ironhook
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Decides which hosts and addresses the service may connect to,
+// so endpoint URLs can't be used to reach internal services.
+//
+// Addresses are checked when connecting, after DNS resolution,
+// so a host can't resolve to a public address when registered
+// and to an internal one when notified.
+type egressPolicy struct {
+	// for local development and tests
+	allowLoopback bool
+	allowPrivate  bool
+	// only these hosts, if any
+	allowHosts []string
+	denyHosts  []string
+
+	resolver *net.Resolver
+}
+
+// always blocked, on top of the loopback, private and link-local ranges
+var blockedNetworks = mustParseNetworks(
+	"0.0.0.0/8",          // this network
+	"100.64.0.0/10",      // carrier-grade NAT
+	"192.0.0.0/24",       // IETF protocol assignments
+	"198.18.0.0/15",      // benchmarking
+	"240.0.0.0/4",        // reserved
+	"255.255.255.255/32", // broadcast
+	"64:ff9b::/96",       // NAT64, may translate to internal IPv4
+	"2001:db8::/32",      // documentation
+)
+
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+func egressPolicyFromConfig() egressPolicy {
+	return egressPolicy{
+		allowLoopback: viper.GetBool("egress_allow_loopback"),
+		allowPrivate:  viper.GetBool("egress_allow_private"),
+		allowHosts:    splitHostList(viper.GetString("egress_allow_hosts")),
+		denyHosts:     splitHostList(viper.GetString("egress_deny_hosts")),
+
+		resolver: net.DefaultResolver,
+	}
+}
+
+// "example.com, *.example.org"
+func splitHostList(list string) []string {
+	var hosts []string
+	for _, host := range strings.Split(list, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// "*.example.com" matches the subdomains of example.com, anything else only itself
+func hostMatches(host string, patterns []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (p egressPolicy) checkHost(host string) error {
+	if hostMatches(host, p.denyHosts) {
+		return ErrEgressDenied
+	}
+	if len(p.allowHosts) > 0 && !hostMatches(host, p.allowHosts) {
+		return ErrEgressDenied
+	}
+	return nil
+}
+
+func (p egressPolicy) checkIP(ip net.IP) error {
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	switch {
+	case ip.IsLoopback():
+		if !p.allowLoopback {
+			return ErrEgressDenied
+		}
+		return nil
+	// cloud metadata endpoints live in the link-local range
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast(), ip.IsInterfaceLocalMulticast():
+		return ErrEgressDenied
+	case ip.IsUnspecified(), ip.IsMulticast():
+		return ErrEgressDenied
+	case ip.IsPrivate():
+		if !p.allowPrivate {
+			return ErrEgressDenied
+		}
+		return nil
+	}
+
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return ErrEgressDenied
+		}
+	}
+	return nil
+}
+
+// Catches what can be caught before connecting: denied hosts and blocked
+// IP literals. Host names are resolved and checked when connecting.
+func (p egressPolicy) checkURLHost(host string) error {
+
+	if err := p.checkHost(host); err != nil {
+		return err
+	}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return p.checkIP(ip)
+	}
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return p.checkIP(net.IPv4(127, 0, 0, 1))
+	}
+	return nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Resolves the host and checks every address it resolves to,
+// one internal address is enough to refuse the host
+func (p egressPolicy) resolveAllowed(ctx context.Context, host string) ([]net.IP, error) {
+
+	if err := p.checkHost(host); err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := p.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		if err := p.checkIP(ip); err != nil {
+			return nil, err
+		}
+	}
+	return ips, nil
+}
+
+// Resolves the host, checks every address it resolves to,
+// then connects to the checked addresses only.
+// Proxies are connected to as they are, see guardTransport.
+func (p egressPolicy) guardDial(dial dialFunc, proxies *proxyAddrs) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+
+		if proxies.has(addr) {
+			return dial(ctx, network, addr)
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := p.resolveAllowed(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var dial_err error
+		for _, ip := range ips {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			dial_err = err
+		}
+		if dial_err == nil {
+			dial_err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+		}
+		return nil, dial_err
+	}
+}
+
+// Addresses of the proxies a transport went through. They're set up
+// by the operator, not the endpoints, so they may well be internal.
+type proxyAddrs struct {
+	mu    sync.Mutex
+	addrs map[string]bool
+}
+
+func (a *proxyAddrs) add(proxy_url *url.URL) {
+	port := proxy_url.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443", "socks5": "1080"}[proxy_url.Scheme]
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.addrs[net.JoinHostPort(proxy_url.Hostname(), port)] = true
+}
+
+func (a *proxyAddrs) has(addr string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.addrs[addr]
+}
+
+// A copy of the transport connecting through the policy, with every
+// dialer guarded. Behind a proxy, which resolves and connects on its own,
+// the endpoint host is resolved and checked before the request is sent
+// to the proxy.
+func (p egressPolicy) guardTransport(template *http.Transport) *http.Transport {
+
+	transport := template.Clone()
+	proxies := &proxyAddrs{addrs: map[string]bool{}}
+
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = p.guardDial(dial, proxies)
+
+	if transport.DialTLSContext != nil {
+		transport.DialTLSContext = p.guardDial(transport.DialTLSContext, proxies)
+	}
+	if transport.DialTLS != nil {
+		dial_tls := transport.DialTLS
+		guarded := p.guardDial(func(_ context.Context, network, addr string) (net.Conn, error) {
+			return dial_tls(network, addr)
+		}, proxies)
+		transport.DialTLS = func(network, addr string) (net.Conn, error) {
+			return guarded(context.Background(), network, addr)
+		}
+	}
+
+	if transport.Proxy != nil {
+		proxy := transport.Proxy
+		transport.Proxy = func(request *http.Request) (*url.URL, error) {
+			proxy_url, err := proxy(request)
+			if err != nil || proxy_url == nil {
+				return proxy_url, err
+			}
+			_, err = p.resolveAllowed(request.Context(), request.URL.Hostname())
+			if err != nil {
+				return nil, err
+			}
+			proxies.add(proxy_url)
+			return proxy_url, nil
+		}
+	}
+
+	return transport
+}
+
+// A copy of the client connecting through the policy.
+//
+// A custom RoundTripper connects on its own, so it's wrapped instead and
+// the request host is resolved and checked before the request reaches it.
+// It may resolve the host again and get a different answer.
+func (p egressPolicy) guardClient(client *http.Client, log *zap.Logger) *http.Client {
+
+	guarded := *client
+	switch transport := client.Transport.(type) {
+	case nil:
+		guarded.Transport = p.guardTransport(http.DefaultTransport.(*http.Transport))
+	case *http.Transport:
+		guarded.Transport = p.guardTransport(transport)
+	default:
+		log.Warn("Custom HTTP transport, the egress policy checks endpoint hosts before the transport connects to them")
+		guarded.Transport = guardedRoundTripper{policy: p, next: transport}
+	}
+	return &guarded
+}
+
+// Checks the request host before handing the request to a custom RoundTripper
+type guardedRoundTripper struct {
+	policy egressPolicy
+	next   http.RoundTripper
+}
+
+func (g guardedRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	_, err := g.policy.resolveAllowed(request.Context(), request.URL.Hostname())
+	if err != nil {
+		if request.Body != nil {
+			request.Body.Close()
+		}
+		return nil, err
+	}
+	return g.next.RoundTrip(request)
+}
+
+var ErrEgressDenied error = errors.New(
+	`
+	the egress policy doesnt allow connecting to this host.
+	Recover by using a public endpoint URL, or for local development
+	by setting HOOK_EGRESS_ALLOW_LOOPBACK or HOOK_EGRESS_ALLOW_PRIVATE
+	`,
+)
@@ -0,0 +1,176 @@
+package ironhook
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+)
+
+func Test_egressPolicyCheckIP(t *testing.T) {
+
+	strict := egressPolicy{}
+	local := egressPolicy{allowLoopback: true, allowPrivate: true}
+
+	cases := []struct {
+		ip         string
+		strict_err error
+		local_err  error
+		why        string
+	}{
+		{"93.184.216.34", nil, nil, "public"},
+		{"2606:2800:220:1::", nil, nil, "public IPv6"},
+		{"127.0.0.1", ErrEgressDenied, nil, "loopback"},
+		{"::1", ErrEgressDenied, nil, "IPv6 loopback"},
+		{"::ffff:127.0.0.1", ErrEgressDenied, nil, "IPv4-mapped loopback"},
+		{"10.1.2.3", ErrEgressDenied, nil, "private"},
+		{"172.16.0.1", ErrEgressDenied, nil, "private"},
+		{"172.32.0.1", nil, nil, "public, just outside 172.16/12"},
+		{"192.168.1.1", ErrEgressDenied, nil, "private"},
+		{"fd00::1", ErrEgressDenied, nil, "unique local"},
+		{"169.254.169.254", ErrEgressDenied, ErrEgressDenied, "cloud metadata"},
+		{"fe80::1", ErrEgressDenied, ErrEgressDenied, "IPv6 link-local"},
+		{"0.0.0.0", ErrEgressDenied, ErrEgressDenied, "unspecified"},
+		{"100.64.0.1", ErrEgressDenied, ErrEgressDenied, "carrier-grade NAT"},
+		{"224.0.0.1", ErrEgressDenied, ErrEgressDenied, "multicast"},
+	}
+
+	for _, c := range cases {
+		ip := net.ParseIP(c.ip)
+		if err := strict.checkIP(ip); err != c.strict_err {
+			t.Fatalf("%s (%s) with the strict policy: have %v want %v", c.ip, c.why, err, c.strict_err)
+		}
+		if err := local.checkIP(ip); err != c.local_err {
+			t.Fatalf("%s (%s) with the local policy: have %v want %v", c.ip, c.why, err, c.local_err)
+		}
+	}
+}
+
+func Test_egressPolicyHostLists(t *testing.T) {
+
+	policy := egressPolicy{
+		allowHosts: splitHostList("hooks.example.com, *.customers.example.org"),
+		denyHosts:  splitHostList("evil.customers.example.org"),
+	}
+
+	cases := []struct {
+		host string
+		want error
+	}{
+		{"hooks.example.com", nil},
+		{"HOOKS.example.com.", nil},
+		{"acme.customers.example.org", nil},
+		{"evil.customers.example.org", ErrEgressDenied},
+		{"customers.example.org", ErrEgressDenied},
+		{"example.com", ErrEgressDenied},
+	}
+	for _, c := range cases {
+		if err := policy.checkHost(c.host); err != c.want {
+			t.Fatalf("%s: have %v want %v", c.host, err, c.want)
+		}
+	}
+}
+
+func Test_EgressPolicyFlow(t *testing.T) {
+
+	t.Setenv("HOOK_EGRESS_ALLOW_LOOPBACK", "false")
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	for _, url := range []string{
+		"http://169.254.169.254/latest/meta-data",
+		"http://localhost:6379",
+		"http://[::1]:8080",
+		server.URL,
+	} {
+		_, err = svc.Create(WebhookEndpoint{URL: url})
+		if err != ErrEgressDenied {
+			t.Fatalf("%s: expected ErrEgressDenied, got %v", url, err)
+		}
+	}
+
+	// host names are only resolved when connecting, so are registered URLs
+	// which resolved to something else back then
+	endpoint_uuid := uuid.Must(uuid.NewV4())
+	tx := svc.db.Create(&WebhookEndpointDB{UUID: endpoint_uuid, URL: server.URL, Status: Verified})
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+
+	err = svc.Notify(WebhookEndpoint{UUID: endpoint_uuid}, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4())})
+	if !errors.Is(err, ErrEgressDenied) {
+		t.Fatal("Expected the connection to be refused with ErrEgressDenied, got ", err)
+	}
+
+	_, err = svc.UpdateURL(WebhookEndpoint{UUID: endpoint_uuid, URL: "http://10.0.0.1/hooks"})
+	if err != ErrEgressDenied {
+		t.Fatal("Expected ErrEgressDenied updating the URL, got ", err)
+	}
+}
+
+func Test_GuardClientTransports(t *testing.T) {
+
+	policy := egressPolicy{resolver: net.DefaultResolver}
+	log := zap.NewNop()
+
+	// custom transports only get the requests to allowed hosts
+	custom_requests := 0
+	client := policy.guardClient(&http.Client{Transport: roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		custom_requests++
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: request}, nil
+	})}, log)
+	_, err := client.Get("http://169.254.169.254/latest/meta-data")
+	if !errors.Is(err, ErrEgressDenied) || custom_requests != 0 {
+		t.Fatal("Expected the internal target to be refused before the custom transport, got ", err)
+	}
+	_, err = client.Get("http://93.184.216.34/hooks")
+	if err != nil || custom_requests != 1 {
+		t.Fatal("Expected a public target to go through the custom transport, got ", err)
+	}
+
+	// custom TLS dialers are guarded like any other
+	tls_dials := 0
+	client = policy.guardClient(&http.Client{Transport: &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			tls_dials++
+			return nil, errors.New("unreachable")
+		},
+	}}, log)
+	_, err = client.Get("https://127.0.0.1/hooks")
+	if !errors.Is(err, ErrEgressDenied) || tls_dials != 0 {
+		t.Fatal("Expected the TLS dialer to be guarded, got ", err)
+	}
+
+	// behind a proxy the target is checked before reaching the proxy,
+	// the proxy itself may be internal
+	proxy_url, _ := url.Parse("http://10.0.0.1:3128")
+	proxy_dials := []string{}
+	client = policy.guardClient(&http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxy_url),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			proxy_dials = append(proxy_dials, addr)
+			return nil, errors.New("unreachable")
+		},
+	}}, log)
+	_, err = client.Get("http://169.254.169.254/latest/meta-data")
+	if !errors.Is(err, ErrEgressDenied) || len(proxy_dials) != 0 {
+		t.Fatal("Expected the internal target to be refused before the proxy, got ", err)
+	}
+	_, err = client.Get("http://93.184.216.34/hooks")
+	if errors.Is(err, ErrEgressDenied) || len(proxy_dials) != 1 || proxy_dials[0] != "10.0.0.1:3128" {
+		t.Fatal("Expected a public target to go through the proxy, got ", err, proxy_dials)
+	}
+}
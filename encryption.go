@@ -0,0 +1,459 @@
+package ironhook
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// Holds master keys and uses them to wrap and unwrap the data keys
+// sensitive values are encrypted with, much like a KMS would.
+//
+// Keep the keys of older IDs around for as long as there are rows
+// encrypted with them, see service.ReEncrypt()
+type KeyProvider interface {
+	// ID of the master key new data keys are wrapped with
+	CurrentKeyID() string
+	// Encrypts a data key with the current master key
+	WrapKey(data_key []byte) (key_id string, wrapped []byte, err error)
+	// Decrypts a data key with the master key of the given ID
+	UnwrapKey(key_id string, wrapped []byte) ([]byte, error)
+}
+
+// A set of AES-256 master keys, one of them current
+type keyring struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// Creates a KeyProvider from AES-256 master keys, each 32 bytes long.
+//
+// Data keys are wrapped with the key of current_id, all the others
+// are only used to unwrap data keys of older rows.
+func NewStaticKeyProvider(current_id string, keys map[string][]byte) (KeyProvider, error) {
+
+	if _, ok := keys[current_id]; !ok || current_id == "" {
+		return nil, ErrInvalidEncryptionKey
+	}
+
+	ring := &keyring{
+		current: current_id,
+		keys:    map[string][]byte{},
+	}
+	for id, key := range keys {
+		if len(key) != 32 || id == "" || strings.Contains(id, ":") {
+			return nil, ErrInvalidEncryptionKey
+		}
+		ring.keys[id] = key
+	}
+
+	return ring, nil
+}
+
+// Creates a KeyProvider from a file with one "<key id>:<base64 key>" per line.
+//
+// The first key is the current one. Empty lines and lines starting
+// with # are skipped.
+func NewKeyFileProvider(path string) (KeyProvider, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var current string
+	keys := map[string][]byte{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, key, err := parseKeyEntry(line)
+		if err != nil {
+			return nil, err
+		}
+		if current == "" {
+			current = id
+		}
+		keys[id] = key
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+
+	return NewStaticKeyProvider(current, keys)
+}
+
+// parses "<key id>:<base64 key>"
+func parseKeyEntry(entry string) (string, []byte, error) {
+
+	parts := strings.SplitN(entry, ":", 2)
+	if len(parts) != 2 {
+		return "", nil, ErrInvalidEncryptionKey
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return "", nil, ErrInvalidEncryptionKey
+	}
+
+	return strings.TrimSpace(parts[0]), key, nil
+}
+
+func (k *keyring) CurrentKeyID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+func (k *keyring) WrapKey(data_key []byte) (string, []byte, error) {
+
+	k.mu.RLock()
+	id, master := k.current, k.keys[k.current]
+	k.mu.RUnlock()
+
+	wrapped, err := sealAESGCM(master, data_key, []byte(id))
+	if err != nil {
+		return "", nil, err
+	}
+	return id, wrapped, nil
+}
+
+func (k *keyring) UnwrapKey(key_id string, wrapped []byte) ([]byte, error) {
+
+	k.mu.RLock()
+	master, ok := k.keys[key_id]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownEncryptionKey
+	}
+
+	return openAESGCM(master, wrapped, []byte(key_id))
+}
+
+// An in-process stand-in for a KMS, for development and tests.
+//
+// Master keys are generated on the fly and only live in memory,
+// so anything encrypted with them is lost with the process.
+type LocalKMS struct {
+	keyring
+	generation int
+}
+
+func NewLocalKMS() *LocalKMS {
+	kms := &LocalKMS{
+		keyring: keyring{
+			keys: map[string][]byte{},
+		},
+	}
+	kms.Rotate()
+	return kms
+}
+
+// Generates a new current master key, older keys keep working for unwrapping.
+// Returns the ID of the new key.
+func (k *LocalKMS) Rotate() string {
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.generation++
+	id := fmt.Sprintf("local-%d", k.generation)
+	k.keys[id] = randomBytes(32)
+	k.current = id
+
+	return id
+}
+
+// Reads the key provider from HOOK_ENCRYPTION_* settings,
+// returns nil if encryption isn't configured
+func keyProviderFromConfig() (KeyProvider, error) {
+
+	if viper.GetString("encryption_key") != "" {
+
+		key, err := base64.StdEncoding.DecodeString(viper.GetString("encryption_key"))
+		if err != nil {
+			return nil, ErrInvalidEncryptionKey
+		}
+		current := viper.GetString("encryption_key_id")
+		keys := map[string][]byte{current: key}
+
+		// "<key id>:<base64 key>,<key id>:<base64 key>"
+		for _, entry := range strings.Split(viper.GetString("encryption_previous_keys"), ",") {
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+			id, key, err := parseKeyEntry(entry)
+			if err != nil {
+				return nil, err
+			}
+			keys[id] = key
+		}
+
+		return NewStaticKeyProvider(current, keys)
+	}
+
+	if viper.GetString("encryption_key_file") != "" {
+		return NewKeyFileProvider(viper.GetString("encryption_key_file"))
+	}
+
+	return nil, nil
+}
+
+// Envelope encryption of single values, stored as
+//
+// ih2:<key id>:<base64 wrapped data key>:<base64 nonce and ciphertext>
+//
+// The associated data ties a value to the column and the row it's stored in.
+type fieldCipher struct {
+	keys KeyProvider
+}
+
+const envelopePrefix = "ih2:"
+
+// Where a value is stored, so it can't be copied to another column or row
+// and still decrypt. The row is the endpoint UUID, and more where
+// an endpoint has several rows.
+type binding struct {
+	column string
+	row    string
+}
+
+func (b binding) associatedData() []byte {
+	return []byte(b.column + "/" + b.row)
+}
+
+func (c fieldCipher) enabled() bool {
+	return c.keys != nil
+}
+
+// Returns the value unchanged, and an empty key ID, if encryption is disabled
+func (c fieldCipher) encrypt(plaintext string, bound_to binding) (string, string, error) {
+
+	if !c.enabled() || plaintext == "" {
+		return plaintext, "", nil
+	}
+
+	data_key := randomBytes(32)
+	ciphertext, err := sealAESGCM(data_key, []byte(plaintext), bound_to.associatedData())
+	if err != nil {
+		return "", "", err
+	}
+
+	key_id, wrapped, err := c.keys.WrapKey(data_key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return envelopePrefix + strings.Join(
+		[]string{
+			key_id,
+			base64.StdEncoding.EncodeToString(wrapped),
+			base64.StdEncoding.EncodeToString(ciphertext),
+		},
+		":",
+	), key_id, nil
+}
+
+// Values stored in plaintext, with an empty key ID, are returned as they are
+func (c fieldCipher) decrypt(value string, key_id string, bound_to binding) (string, error) {
+
+	if key_id == "" {
+		return value, nil
+	}
+	if !c.enabled() {
+		return "", ErrEncryptionNotConfigured
+	}
+
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return "", ErrCorruptedCiphertext
+	}
+	parts := strings.Split(strings.TrimPrefix(value, envelopePrefix), ":")
+	if len(parts) != 3 || parts[0] != key_id {
+		return "", ErrCorruptedCiphertext
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrCorruptedCiphertext
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrCorruptedCiphertext
+	}
+
+	data_key, err := c.keys.UnwrapKey(parts[0], wrapped)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := openAESGCM(data_key, ciphertext, bound_to.associatedData())
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Encrypts every sensitive value which isn't yet encrypted with the current
+// master key, be it a plaintext value or one encrypted with an older key.
+// Returns the number of re-encrypted rows.
+//
+// Run it after rotating keys, then retire the old keys once it's done.
+func (s *WebhookEndpointServiceImpl) ReEncrypt() (int64, error) {
+
+	if err := s.allTenantsOnly(); err != nil {
+		return 0, err
+	}
+
+	if !s.cipher.enabled() {
+		return 0, ErrEncryptionNotConfigured
+	}
+	current := s.cipher.keys.CurrentKeyID()
+
+	var total int64
+	var after uint
+	for {
+		var batch []WebhookNotificationDB
+		tx := s.db.Unscoped().
+			Where("id > ? AND encryption_key_id <> ? AND body <> ''", after, current).
+			Order("id").
+			Limit(rowBatchSize).
+			Find(&batch)
+		if tx.Error != nil {
+			s.log.Error("couldnt fetch notifications for re-encryption", zap.Error(tx.Error))
+			return total, tx.Error
+		}
+
+		for _, db_notification := range batch {
+			err := s.decryptNotification(&db_notification)
+			if err != nil {
+				return total, err
+			}
+			err = s.encryptNotificationBody(s.db, &db_notification, db_notification.Body)
+			if err != nil {
+				return total, err
+			}
+			total++
+		}
+
+		if len(batch) < rowBatchSize {
+			break
+		}
+		after = batch[len(batch)-1].ID
+	}
+
+	headers, err := s.reEncryptHeaders(current)
+	total += headers
+	if err != nil {
+		return total, err
+	}
+
+	endpoints, err := s.reEncryptEndpointAuth(current)
+	total += endpoints
+	if err != nil {
+		return total, err
+	}
+
+	endpoints, err = s.reEncryptEndpointTLS(current)
+	total += endpoints
+	if err != nil {
+		return total, err
+	}
+
+	endpoints, err = s.reEncryptEndpointSecrets(current)
+	total += endpoints
+	if err != nil {
+		return total, err
+	}
+
+	s.log.Info(
+		"Re-encrypted sensitive values",
+		zap.String("KeyID", current),
+		zap.Int64("Rows", total),
+	)
+	return total, nil
+}
+
+// nonce followed by the ciphertext
+func sealAESGCM(key, plaintext, associated_data []byte) ([]byte, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := randomBytes(gcm.NonceSize())
+	return gcm.Seal(nonce, nonce, plaintext, associated_data), nil
+}
+
+func openAESGCM(key, sealed, associated_data []byte) ([]byte, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrCorruptedCiphertext
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], associated_data)
+	if err != nil {
+		return nil, ErrCorruptedCiphertext
+	}
+	return plaintext, nil
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+var ErrInvalidEncryptionKey error = errors.New(
+	`
+	cant use the provided encryption keys.
+	Recover by retrying with base64 encoded, 32 bytes long AES-256 keys
+	with non-empty IDs, one of them current
+	`,
+)
+var ErrUnknownEncryptionKey error = errors.New(
+	`
+	the value was encrypted with a key the key provider doesnt have.
+	Recover by adding the key to your previous keys
+	`,
+)
+var ErrEncryptionNotConfigured error = errors.New(
+	`
+	found encrypted values in the database but no encryption keys are configured.
+	Recover by configuring HOOK_ENCRYPTION_KEY, HOOK_ENCRYPTION_KEY_FILE
+	or a KeyProvider
+	`,
+)
+var ErrCorruptedCiphertext error = errors.New(
+	"cant decrypt a value, it's either corrupted or was encrypted for a different column or row",
+)
@@ -0,0 +1,239 @@
+package ironhook
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofrs/uuid"
+)
+
+func Test_fieldCipher(t *testing.T) {
+
+	c := fieldCipher{keys: NewLocalKMS()}
+	bound_to := binding{column: "table.column", row: "row-1"}
+
+	encrypted, key_id, err := c.encrypt("secret", bound_to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encrypted, envelopePrefix) || strings.Contains(encrypted, "secret") {
+		t.Fatal("Expected an encrypted envelope, found ", encrypted)
+	}
+
+	decrypted, err := c.decrypt(encrypted, key_id, bound_to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "secret" {
+		t.Fatal("Expected the plaintext back, found ", decrypted)
+	}
+
+	// values cant be moved between columns or rows
+	for _, other := range []binding{
+		{column: "table.another_column", row: "row-1"},
+		{column: "table.column", row: "row-2"},
+	} {
+		_, err = c.decrypt(encrypted, key_id, other)
+		if err != ErrCorruptedCiphertext {
+			t.Fatal("Expected ErrCorruptedCiphertext, got ", err)
+		}
+	}
+
+	// without keys, values are stored as they are
+	plaintext, key_id, err := fieldCipher{}.encrypt("secret", bound_to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "secret" || key_id != "" {
+		t.Fatal("Expected the plaintext without a key ID, found ", plaintext, key_id)
+	}
+
+	_, err = fieldCipher{}.decrypt(encrypted, "local-1", bound_to)
+	if err != ErrEncryptionNotConfigured {
+		t.Fatal("Expected ErrEncryptionNotConfigured, got ", err)
+	}
+}
+
+// copying a value to another endpoint's row
+func Test_EncryptionBoundToRows(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	kms := NewLocalKMS()
+	generic_svc, err := NewWebhookService(server.Client(), WithKeyProvider(kms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	victim := newVerifiedEndpointForTests(t, svc, server.URL)
+	attacker := newVerifiedEndpointForTests(t, svc, server.URL)
+
+	var victim_db WebhookEndpointDB
+	svc.db.Where("uuid = ?", victim.UUID).First(&victim_db)
+	tx := svc.db.Model(&WebhookEndpointDB{}).
+		Where("uuid = ?", attacker.UUID).
+		UpdateColumns(map[string]interface{}{
+			"signing_secret": victim_db.SigningSecret,
+			"signing_key_id": victim_db.SigningKeyID,
+		})
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	var attacker_db WebhookEndpointDB
+	svc.db.Where("uuid = ?", attacker.UUID).First(&attacker_db)
+	_, err = svc.decryptSecret(&attacker_db)
+	if err != ErrCorruptedCiphertext {
+		t.Fatal("Expected a copied secret not to decrypt, got ", err)
+	}
+
+	// notifications are bound to their IDs, copies get new ones
+	err = svc.Notify(victim, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4()), Body: "sensitive body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored WebhookNotificationDB
+	svc.db.Last(&stored)
+	stored.ID = 0
+	svc.db.Create(&stored)
+	err = svc.decryptNotification(&stored)
+	if err != ErrCorruptedCiphertext {
+		t.Fatal("Expected a copied body not to decrypt, got ", err)
+	}
+	svc.db.Delete(&stored)
+}
+
+func Test_NewKeyFileProvider(t *testing.T) {
+
+	current := base64.StdEncoding.EncodeToString(randomBytes(32))
+	previous := base64.StdEncoding.EncodeToString(randomBytes(32))
+
+	path := filepath.Join(t.TempDir(), "keys")
+	err := os.WriteFile(path, []byte("# rotated in October\n2026-10:"+current+"\n\n2026-04:"+previous+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := NewKeyFileProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.CurrentKeyID() != "2026-10" {
+		t.Fatal("Expected the first key to be current, found ", provider.CurrentKeyID())
+	}
+
+	err = os.WriteFile(path, []byte("short:"+base64.StdEncoding.EncodeToString([]byte("too short"))), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewKeyFileProvider(path)
+	if err != ErrInvalidEncryptionKey {
+		t.Fatal("Expected ErrInvalidEncryptionKey, got ", err)
+	}
+}
+
+// Notify (plaintext) -> enable encryption -> ReEncrypt -> Rotate -> ReEncrypt
+func Test_EncryptionAtRestFlow(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	kms := NewLocalKMS()
+	generic_svc, err := NewWebhookService(server.Client(), WithKeyProvider(kms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint := newVerifiedEndpointForTests(t, svc, server.URL)
+
+	// a notification saved before encryption was enabled
+	svc.cipher.keys = nil
+	err = svc.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4()), Body: "plaintext body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.cipher.keys = kms
+
+	err = svc.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4()), Body: "sensitive body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stored WebhookNotificationDB
+	tx := svc.db.Last(&stored)
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	if strings.Contains(stored.Body, "sensitive") || stored.EncryptionKeyID != "local-1" {
+		t.Fatal("Expected the body to be encrypted with local-1, found ", stored.Body, stored.EncryptionKeyID)
+	}
+
+	last, err := svc.LastNotificationSent(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Body != "sensitive body" {
+		t.Fatal("Expected a decrypted body, found ", last.Body)
+	}
+
+	// only the plaintext one needs encrypting
+	n, err := svc.ReEncrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatal("Expected 1 re-encrypted row, found ", n)
+	}
+
+	// both notifications and the endpoint secret
+	kms.Rotate()
+	n, err = svc.ReEncrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatal("Expected 3 re-encrypted rows, found ", n)
+	}
+
+	page, err := svc.ListNotifications(NotificationQuery{EndpointUUID: endpoint.UUID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Notifications[0].Body != "plaintext body" || page.Notifications[1].Body != "sensitive body" {
+		t.Fatal("Expected decrypted bodies, found ", page.Notifications)
+	}
+
+	var count int64
+	svc.db.Model(&WebhookNotificationDB{}).Where("encryption_key_id = ?", "local-2").Count(&count)
+	if count != 2 {
+		t.Fatal("Expected both rows to use the new key, found ", count)
+	}
+}
+
+func Test_EncryptionKeyFromConfig(t *testing.T) {
+
+	t.Setenv("HOOK_ENCRYPTION_KEY", "not base64")
+	_, err := NewWebhookService(nil)
+	if err != ErrInvalidEncryptionKey {
+		t.Fatal("Expected ErrInvalidEncryptionKey, got ", err)
+	}
+
+	t.Setenv("HOOK_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(randomBytes(32)))
+	t.Setenv("HOOK_ENCRYPTION_KEY_ID", "2026-10")
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	if svc.(*WebhookEndpointServiceImpl).cipher.keys.CurrentKeyID() != "2026-10" {
+		t.Fatal("Expected the configured key to be current")
+	}
+}
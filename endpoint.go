@@ -1,6 +1,9 @@
 package ironhook
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/gofrs/uuid"
 	"gorm.io/gorm"
 )
@@ -12,27 +15,156 @@ const (
 	Suspended
 	Verified
 	Healthy
+	// being verified in the background, see service.VerifyAsync()
+	PendingVerification
+	// out of service, see service.Disable()
+	Disabled
 )
 
+var statusNames = map[WebhookEndpointStatus]string{
+	Unverified:          "unverified",
+	Suspended:           "suspended",
+	Verified:            "verified",
+	Healthy:             "healthy",
+	PendingVerification: "pending_verification",
+	Disabled:            "disabled",
+}
+
+func (s WebhookEndpointStatus) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// whether the status is one of the known ones
+func (s WebhookEndpointStatus) valid() bool {
+	_, ok := statusNames[s]
+	return ok
+}
+
+// whether the endpoint can receive notifications
+func (s WebhookEndpointStatus) verified() bool {
+	return s == Verified || s == Healthy
+}
+
 type WebhookEndpoint struct {
 	UUID   uuid.UUID             `json:"uuid"`
 	URL    string                `json:"url"`
 	Status WebhookEndpointStatus `json:"status"`
+	// Overrides the service-wide notifications persistence
+	PersistenceMode PersistenceMode `json:"persistence_mode,omitempty"`
+	// Customer account the endpoint belongs to, see service.ForTenant()
+	TenantID string `json:"tenant_id,omitempty"`
+	// Topics the endpoint receives through service.NotifyOwner()
+	TopicFilter TopicFilter `json:"topic_filter"`
+	// Human-readable context for dashboards, ironhook doesn't use them
+	Description string            `json:"description,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	// Any JSON document, stored as it is
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+	// Names of the custom headers, see service.SetHeaders()
+	HeaderNames []string `json:"header_names,omitempty"`
+	// How ironhook authenticates to the endpoint, see service.SetAuth()
+	AuthType AuthType `json:"auth_type,omitempty"`
+	// Whether the endpoint has its own TLS settings, see service.SetTLS()
+	TLSConfigured bool `json:"tls_configured,omitempty"`
+	// Signs ironhook's requests, only set by Create and service.RotateSecret()
+	Secret string `json:"secret,omitempty"`
+	// Overrides the service-wide verification protocol
+	Verification VerificationProtocol `json:"verification"`
+	// Overrides HOOK_NOTIFICATION_PATH, like /events/{topic},
+	// "/" sends notifications to the URL as it is
+	NotificationPath string `json:"notification_path,omitempty"`
+	// When the endpoint last passed verification
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	// When the health checks last looked at the endpoint, and what they found
+	LastCheckedAt *time.Time  `json:"last_checked_at,omitempty"`
+	LastCheck     HealthCheck `json:"last_check,omitempty"`
+	// Set while deliveries are paused, PausedUntil is nil
+	// until service.Resume(), see service.Pause()
+	PausedAt    *time.Time `json:"paused_at,omitempty"`
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
 }
 
 type WebhookEndpointDB struct {
 	gorm.Model
-	UUID   uuid.UUID             `gorm:"type:uuid"`
-	URL    string                `gorm:"not null"`
-	Status WebhookEndpointStatus `gorm:"not null"`
+	UUID            uuid.UUID             `gorm:"type:uuid"`
+	URL             string                `gorm:"not null"`
+	Status          WebhookEndpointStatus `gorm:"not null"`
+	PersistenceMode PersistenceMode       `gorm:"not null"`
+	// master key the endpoint's secrets are encrypted with, empty for plaintext
+	EncryptionKeyID string `gorm:"not null"`
+	TenantID        string `gorm:"not null"`
+	// JSON arrays of topic patterns
+	IncludeTopics string
+	ExcludeTopics string
+	Description   string
+	Metadata      string
+	AuthType      AuthType `gorm:"not null"`
+	// encrypted JSON of EndpointAuth
+	AuthConfig string
+	// encrypted JSON of EndpointTLS
+	TLSConfig          string
+	TLSEncryptionKeyID string `gorm:"not null"`
+	// encrypted, see service.RotateSecret()
+	SigningSecret string
+	SigningKeyID  string `gorm:"not null"`
+	// JSON of VerificationProtocol
+	VerificationConfig string
+	NotificationPath   string `gorm:"not null"`
+	// see service.VerifyAsync()
+	ConfirmationNonce        string `gorm:"not null"`
+	VerificationPendingUntil *time.Time
+	VerificationAttempts     int `gorm:"not null"`
+	// see health.go
+	VerifiedAt     *time.Time
+	LastCheckedAt  *time.Time
+	LastCheck      HealthCheck `gorm:"not null"`
+	HealthFailures int         `gorm:"not null"`
+	// see service.Pause()
+	PausedAt    *time.Time
+	PausedUntil *time.Time
+	// while a Resume sends the pending notifications, see unpause
+	FlushClaimedUntil *time.Time
+
+	Labels  []WebhookEndpointLabelDB  `gorm:"foreignKey:EndpointUUID;references:UUID"`
+	Headers []WebhookEndpointHeaderDB `gorm:"foreignKey:EndpointUUID;references:UUID"`
 }
 
 func endpointDbToWeb(dbe *WebhookEndpointDB) *WebhookEndpoint {
-	return &WebhookEndpoint{
-		UUID:   dbe.UUID,
-		URL:    dbe.URL,
-		Status: dbe.Status,
+	web_endpoint := &WebhookEndpoint{
+		UUID:            dbe.UUID,
+		URL:             dbe.URL,
+		Status:          dbe.Status,
+		PersistenceMode: dbe.PersistenceMode,
+		TenantID:        dbe.TenantID,
+		TopicFilter: TopicFilter{
+			Include: decodeTopics(dbe.IncludeTopics),
+			Exclude: decodeTopics(dbe.ExcludeTopics),
+		},
+		Description:      dbe.Description,
+		Labels:           labelsDbToMap(dbe.Labels),
+		HeaderNames:      headerNames(dbe.Headers),
+		AuthType:         dbe.AuthType,
+		TLSConfigured:    dbe.TLSConfig != "",
+		Verification:     decodeVerificationProtocol(dbe.VerificationConfig),
+		NotificationPath: dbe.NotificationPath,
+		VerifiedAt:       dbe.VerifiedAt,
+		LastCheckedAt:    dbe.LastCheckedAt,
+		LastCheck:        dbe.LastCheck,
+		PausedAt:         dbe.PausedAt,
+		PausedUntil:      dbe.PausedUntil,
 	}
+	if dbe.Metadata != "" {
+		web_endpoint.Metadata = json.RawMessage(dbe.Metadata)
+	}
+	return web_endpoint
+}
+
+// loads the rows endpointDbToWeb needs along with the endpoints
+func withEndpointDetails(tx *gorm.DB) *gorm.DB {
+	return tx.Preload("Labels").Preload("Headers")
 }
 
 func endpointsDbToWeb(dbes *[]WebhookEndpointDB) *[]WebhookEndpoint {
@@ -0,0 +1,631 @@
+package ironhook
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Version of the export format written by service.Export(),
+// service.Import() reads only this one
+const exportFormatVersion = 2
+
+// What service.Import() does with records which already exist
+type ImportConflictStrategy int
+
+const (
+	// Keep the existing record, ignore the imported one
+	ImportSkip ImportConflictStrategy = iota
+	// Replace the existing record with the imported one
+	ImportOverwrite
+	// Abort the import, nothing is imported
+	ImportFail
+)
+
+type ImportSummary struct {
+	Endpoints     int `json:"endpoints"`
+	Notifications int `json:"notifications"`
+	Skipped       int `json:"skipped"`
+	Overwritten   int `json:"overwritten"`
+}
+
+// A single line of the JSON Lines export stream.
+// The first line is a header, followed by endpoints, then notifications.
+type exportLine struct {
+	Kind         string                `json:"kind"`
+	Version      int                   `json:"version,omitempty"`
+	ExportedAt   *time.Time            `json:"exported_at,omitempty"`
+	Endpoint     *exportedEndpoint     `json:"endpoint,omitempty"`
+	Notification *exportedNotification `json:"notification,omitempty"`
+}
+
+const (
+	exportKindHeader       = "header"
+	exportKindEndpoint     = "endpoint"
+	exportKindNotification = "notification"
+)
+
+type exportedEndpoint struct {
+	UUID                     uuid.UUID             `json:"uuid"`
+	URL                      string                `json:"url"`
+	Status                   WebhookEndpointStatus `json:"status"`
+	PersistenceMode          PersistenceMode       `json:"persistence_mode"`
+	TenantID                 string                `json:"tenant_id"`
+	TopicFilter              TopicFilter           `json:"topic_filter"`
+	Description              string                `json:"description"`
+	Labels                   map[string]string     `json:"labels,omitempty"`
+	Metadata                 json.RawMessage       `json:"metadata,omitempty"`
+	Headers                  map[string]string     `json:"headers,omitempty"`
+	Auth                     *EndpointAuth         `json:"auth,omitempty"`
+	TLS                      *EndpointTLS          `json:"tls,omitempty"`
+	Secret                   string                `json:"secret,omitempty"`
+	Verification             VerificationProtocol  `json:"verification"`
+	NotificationPath         string                `json:"notification_path,omitempty"`
+	VerifiedAt               *time.Time            `json:"verified_at,omitempty"`
+	CreatedAt                time.Time             `json:"created_at"`
+	UpdatedAt                time.Time             `json:"updated_at"`
+	DeletedAt                *time.Time            `json:"deleted_at,omitempty"`
+	StatusHistory            []StatusChange        `json:"status_history,omitempty"`
+	PausedAt                 *time.Time            `json:"paused_at,omitempty"`
+	PausedUntil              *time.Time            `json:"paused_until,omitempty"`
+	LastCheckedAt            *time.Time            `json:"last_checked_at,omitempty"`
+	LastCheck                HealthCheck           `json:"last_check,omitempty"`
+	HealthFailures           int                   `json:"health_failures,omitempty"`
+	ConfirmationNonce        string                `json:"confirmation_nonce,omitempty"`
+	VerificationPendingUntil *time.Time            `json:"verification_pending_until,omitempty"`
+	VerificationAttempts     int                   `json:"verification_attempts,omitempty"`
+}
+
+type exportedNotification struct {
+	EndpointUUID    uuid.UUID       `json:"endpoint_uuid"`
+	EventUUID       uuid.UUID       `json:"event_uuid"`
+	Topic           string          `json:"topic"`
+	Body            string          `json:"body"`
+	DeliveryStatus  DeliveryStatus  `json:"delivery_status"`
+	ResponseCode    int             `json:"response_code"`
+	BodyHash        string          `json:"body_hash"`
+	PersistenceMode PersistenceMode `json:"persistence_mode"`
+	TenantID        string          `json:"tenant_id"`
+	CreatedAt       time.Time       `json:"created_at"`
+}
+
+func endpointDbToExport(dbe *WebhookEndpointDB) *exportedEndpoint {
+	exported := &exportedEndpoint{
+		UUID:            dbe.UUID,
+		URL:             dbe.URL,
+		Status:          dbe.Status,
+		PersistenceMode: dbe.PersistenceMode,
+		TenantID:        dbe.TenantID,
+		TopicFilter: TopicFilter{
+			Include: decodeTopics(dbe.IncludeTopics),
+			Exclude: decodeTopics(dbe.ExcludeTopics),
+		},
+		Description:      dbe.Description,
+		Labels:           labelsDbToMap(dbe.Labels),
+		Verification:     decodeVerificationProtocol(dbe.VerificationConfig),
+		NotificationPath: dbe.NotificationPath,
+		VerifiedAt:       dbe.VerifiedAt,
+		CreatedAt:        dbe.CreatedAt,
+		UpdatedAt:        dbe.UpdatedAt,
+
+		PausedAt:                 dbe.PausedAt,
+		PausedUntil:              dbe.PausedUntil,
+		LastCheckedAt:            dbe.LastCheckedAt,
+		LastCheck:                dbe.LastCheck,
+		HealthFailures:           dbe.HealthFailures,
+		ConfirmationNonce:        dbe.ConfirmationNonce,
+		VerificationPendingUntil: dbe.VerificationPendingUntil,
+		VerificationAttempts:     dbe.VerificationAttempts,
+	}
+	if dbe.Metadata != "" {
+		exported.Metadata = json.RawMessage(dbe.Metadata)
+	}
+	if dbe.DeletedAt.Valid {
+		exported.DeletedAt = &dbe.DeletedAt.Time
+	}
+	return exported
+}
+
+func endpointExportToDb(e *exportedEndpoint, dbe *WebhookEndpointDB) {
+	dbe.UUID = e.UUID
+	dbe.URL = e.URL
+	dbe.Status = e.Status
+	dbe.PersistenceMode = e.PersistenceMode
+	dbe.TenantID = e.TenantID
+	dbe.IncludeTopics = encodeTopics(e.TopicFilter.Include)
+	dbe.ExcludeTopics = encodeTopics(e.TopicFilter.Exclude)
+	dbe.Description = e.Description
+	dbe.Metadata = string(e.Metadata)
+	dbe.VerificationConfig = encodeVerificationProtocol(e.Verification)
+	dbe.NotificationPath = e.NotificationPath
+	dbe.VerifiedAt = e.VerifiedAt
+	dbe.CreatedAt = e.CreatedAt
+	dbe.UpdatedAt = e.UpdatedAt
+	dbe.PausedAt = e.PausedAt
+	dbe.PausedUntil = e.PausedUntil
+	dbe.LastCheckedAt = e.LastCheckedAt
+	dbe.LastCheck = e.LastCheck
+	dbe.HealthFailures = e.HealthFailures
+	dbe.ConfirmationNonce = e.ConfirmationNonce
+	dbe.VerificationPendingUntil = e.VerificationPendingUntil
+	dbe.VerificationAttempts = e.VerificationAttempts
+	dbe.DeletedAt = gorm.DeletedAt{}
+	if e.DeletedAt != nil {
+		dbe.DeletedAt = gorm.DeletedAt{Time: *e.DeletedAt, Valid: true}
+	}
+}
+
+func notificationDbToExport(dbn *WebhookNotificationDB) *exportedNotification {
+	return &exportedNotification{
+		EndpointUUID:    dbn.EndpointUUID,
+		EventUUID:       dbn.EventUUID,
+		Topic:           dbn.Topic,
+		Body:            dbn.Body,
+		DeliveryStatus:  dbn.DeliveryStatus,
+		ResponseCode:    dbn.ResponseCode,
+		BodyHash:        dbn.BodyHash,
+		PersistenceMode: dbn.PersistenceMode,
+		TenantID:        dbn.TenantID,
+		CreatedAt:       dbn.CreatedAt,
+	}
+}
+
+func notificationExportToDb(n *exportedNotification, dbn *WebhookNotificationDB) {
+	dbn.EndpointUUID = n.EndpointUUID
+	dbn.EventUUID = n.EventUUID
+	dbn.Topic = n.Topic
+	dbn.Body = n.Body
+	dbn.DeliveryStatus = n.DeliveryStatus
+	dbn.ResponseCode = n.ResponseCode
+	dbn.BodyHash = n.BodyHash
+	dbn.PersistenceMode = n.PersistenceMode
+	dbn.TenantID = n.TenantID
+	dbn.CreatedAt = n.CreatedAt
+}
+
+// Writes all the endpoints, including deleted ones, and the notifications
+// history to w as a versioned JSON Lines stream, see service.Import()
+//
+// Encrypted values are exported decrypted, so they can be imported
+// under different keys. Treat the export as sensitive.
+func (s *WebhookEndpointServiceImpl) Export(w io.Writer) error {
+
+	if err := s.allTenantsOnly(); err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+
+	now := time.Now()
+	err := encoder.Encode(exportLine{
+		Kind:       exportKindHeader,
+		Version:    exportFormatVersion,
+		ExportedAt: &now,
+	})
+	if err != nil {
+		return err
+	}
+
+	var endpoints, notifications int
+
+	var db_endpoints []WebhookEndpointDB
+	tx := withEndpointDetails(s.db.Unscoped()).FindInBatches(&db_endpoints, rowBatchSize, func(_ *gorm.DB, _ int) error {
+		for i := range db_endpoints {
+			exported := endpointDbToExport(&db_endpoints[i])
+			headers, err := s.headersFromDb(db_endpoints[i].Headers)
+			if err != nil {
+				return err
+			}
+			exported.Headers = headers
+			auth, err := s.decryptAuth(&db_endpoints[i])
+			if err != nil {
+				return err
+			}
+			if auth.Type != AuthNone {
+				exported.Auth = &auth
+			}
+			tls_settings, err := s.decryptTLS(&db_endpoints[i])
+			if err != nil {
+				return err
+			}
+			if !tls_settings.empty() {
+				exported.TLS = &tls_settings
+			}
+			exported.Secret, err = s.decryptSecret(&db_endpoints[i])
+			if err != nil {
+				return err
+			}
+			exported.StatusHistory, err = s.statusHistoryOf(s.db, db_endpoints[i].UUID)
+			if err != nil {
+				return err
+			}
+			err = encoder.Encode(exportLine{
+				Kind:     exportKindEndpoint,
+				Endpoint: exported,
+			})
+			if err != nil {
+				return err
+			}
+			endpoints++
+		}
+		return nil
+	})
+	if tx.Error != nil {
+		s.log.Error("couldnt export endpoints", zap.Error(tx.Error))
+		return tx.Error
+	}
+
+	var db_notifications []WebhookNotificationDB
+	tx = s.db.FindInBatches(&db_notifications, rowBatchSize, func(_ *gorm.DB, _ int) error {
+		for i := range db_notifications {
+			err := s.decryptNotification(&db_notifications[i])
+			if err != nil {
+				return err
+			}
+			err = encoder.Encode(exportLine{
+				Kind:         exportKindNotification,
+				Notification: notificationDbToExport(&db_notifications[i]),
+			})
+			if err != nil {
+				return err
+			}
+			notifications++
+		}
+		return nil
+	})
+	if tx.Error != nil {
+		s.log.Error("couldnt export notifications", zap.Error(tx.Error))
+		return tx.Error
+	}
+
+	s.log.Info(
+		"Exported webhooks state",
+		zap.Int("Endpoints", endpoints),
+		zap.Int("Notifications", notifications),
+	)
+	return out.Flush()
+}
+
+// Reads a stream written by service.Export() and saves its endpoints
+// and notifications, all in a single transaction.
+//
+// Endpoints conflict when their UUIDs match, notifications when they share
+// the endpoint and the event: the first notification of an event in the
+// stream conflicts with the first one already in the database, the second
+// with the second and so on. The strategy decides what happens to
+// conflicting records.
+func (s *WebhookEndpointServiceImpl) Import(r io.Reader, strategy ImportConflictStrategy) (ImportSummary, error) {
+
+	if err := s.allTenantsOnly(); err != nil {
+		return ImportSummary{}, err
+	}
+
+	var summary ImportSummary
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+
+		decoder := json.NewDecoder(r)
+		header_seen := false
+
+		// notifications conflict with the ones there before the import
+		notifications, err := newImportedNotifications(tx)
+		if err != nil {
+			return err
+		}
+
+		for {
+			var line exportLine
+			err := decoder.Decode(&line)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return ErrUnsupportedExportFormat
+			}
+
+			if !header_seen {
+				if line.Kind != exportKindHeader || line.Version != exportFormatVersion {
+					return ErrUnsupportedExportFormat
+				}
+				header_seen = true
+				continue
+			}
+
+			switch {
+			case line.Kind == exportKindEndpoint && line.Endpoint != nil:
+				err = s.importEndpoint(tx, line.Endpoint, strategy, &summary)
+			case line.Kind == exportKindNotification && line.Notification != nil:
+				err = s.importNotification(tx, line.Notification, notifications, strategy, &summary)
+			default:
+				err = ErrUnsupportedExportFormat
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if !header_seen {
+			return ErrUnsupportedExportFormat
+		}
+		return nil
+	})
+	if err != nil {
+		s.log.Error("Failed importing webhooks state", zap.Error(err))
+		return ImportSummary{}, err
+	}
+
+	s.log.Info(
+		"Imported webhooks state",
+		zap.Int("Endpoints", summary.Endpoints),
+		zap.Int("Notifications", summary.Notifications),
+		zap.Int("Skipped", summary.Skipped),
+		zap.Int("Overwritten", summary.Overwritten),
+	)
+	return summary, nil
+}
+
+func (s *WebhookEndpointServiceImpl) importEndpoint(tx *gorm.DB, e *exportedEndpoint, strategy ImportConflictStrategy, summary *ImportSummary) error {
+
+	if e.UUID == uuid.Nil {
+		return ErrEmptyEndpointUUID
+	}
+	if e.URL == "" {
+		return ErrEmptyEndpointURL
+	}
+	if err := s.checkEgress(e.URL); err != nil {
+		return err
+	}
+	if !e.Status.valid() {
+		return ErrUnknownEndpointStatus
+	}
+	for _, change := range e.StatusHistory {
+		if !change.From.valid() || !change.To.valid() {
+			return ErrUnknownEndpointStatus
+		}
+	}
+	if !e.PersistenceMode.valid() {
+		return ErrUnsupportedPersistenceMode
+	}
+	if !e.TopicFilter.valid() {
+		return ErrInvalidTopicPattern
+	}
+	if err := validateLabels(e.Labels); err != nil {
+		return err
+	}
+	if err := validateMetadata(e.Metadata); err != nil {
+		return err
+	}
+	if err := validateHeaders(e.Headers); err != nil {
+		return err
+	}
+	if err := e.Verification.validate(); err != nil {
+		return err
+	}
+	if err := validateNotificationPath(e.NotificationPath); err != nil {
+		return err
+	}
+	db_headers, err := s.headersToDb(e.UUID, e.Headers)
+	if err != nil {
+		return err
+	}
+	var auth EndpointAuth
+	if e.Auth != nil {
+		auth = *e.Auth
+	}
+	if err := auth.validate(); err != nil {
+		return err
+	}
+	var tls_settings EndpointTLS
+	if e.TLS != nil {
+		tls_settings = *e.TLS
+	}
+	if err := tls_settings.validate(); err != nil {
+		return err
+	}
+
+	var existing []WebhookEndpointDB
+	err = tx.Unscoped().Where("uuid = ?", e.UUID).Limit(1).Find(&existing).Error
+	if err != nil {
+		return err
+	}
+
+	if len(existing) == 0 {
+		var db_endpoint WebhookEndpointDB
+		endpointExportToDb(e, &db_endpoint)
+		err = s.encryptAuth(&db_endpoint, auth)
+		if err != nil {
+			return err
+		}
+		err = s.encryptTLS(&db_endpoint, tls_settings)
+		if err != nil {
+			return err
+		}
+		err = s.encryptSecret(&db_endpoint, e.Secret)
+		if err != nil {
+			return err
+		}
+		db_endpoint.Labels = labelsToDb(e.UUID, e.Labels)
+		db_endpoint.Headers = db_headers
+		summary.Endpoints++
+		err = tx.Create(&db_endpoint).Error
+		if err != nil {
+			return err
+		}
+		return importStatusHistory(tx, e)
+	}
+
+	switch strategy {
+	case ImportSkip:
+		summary.Skipped++
+		return nil
+	case ImportOverwrite:
+		endpointExportToDb(e, &existing[0])
+		err = s.encryptAuth(&existing[0], auth)
+		if err != nil {
+			return err
+		}
+		err = s.encryptTLS(&existing[0], tls_settings)
+		if err != nil {
+			return err
+		}
+		err = s.encryptSecret(&existing[0], e.Secret)
+		if err != nil {
+			return err
+		}
+		summary.Endpoints++
+		summary.Overwritten++
+		err := tx.Unscoped().Save(&existing[0]).Error
+		if err != nil {
+			return err
+		}
+		err = replaceLabels(tx, e.UUID, e.Labels)
+		if err != nil {
+			return err
+		}
+		err = replaceHeaders(tx, e.UUID, db_headers)
+		if err != nil {
+			return err
+		}
+		err = tx.Where("endpoint_uuid = ?", e.UUID).Delete(&WebhookEndpointStatusChangeDB{}).Error
+		if err != nil {
+			return err
+		}
+		return importStatusHistory(tx, e)
+	default:
+		return fmt.Errorf("endpoint %s: %w", e.UUID, ErrImportConflict)
+	}
+}
+
+func importStatusHistory(tx *gorm.DB, e *exportedEndpoint) error {
+	for _, change := range e.StatusHistory {
+		err := tx.Create(&WebhookEndpointStatusChangeDB{
+			EndpointUUID: e.UUID,
+			FromStatus:   change.From,
+			ToStatus:     change.To,
+			Actor:        change.Actor,
+			Reason:       change.Reason,
+			CreatedAt:    change.ChangedAt,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tells the notifications already in the database from the ones the import
+// adds, and how many of each event the import has seen for an endpoint
+type importedNotifications struct {
+	// highest ID before the import
+	before uint
+	seen   map[[2]uuid.UUID]int
+	// endpoints known to exist, in the stream or in the database
+	endpoints map[uuid.UUID]bool
+}
+
+func newImportedNotifications(tx *gorm.DB) (*importedNotifications, error) {
+	var last []WebhookNotificationDB
+	err := tx.Unscoped().Select("id").Order("id desc").Limit(1).Find(&last).Error
+	if err != nil {
+		return nil, err
+	}
+	imported := &importedNotifications{
+		seen:      map[[2]uuid.UUID]int{},
+		endpoints: map[uuid.UUID]bool{},
+	}
+	if len(last) > 0 {
+		imported.before = last[0].ID
+	}
+	return imported, nil
+}
+
+func (s *WebhookEndpointServiceImpl) importNotification(tx *gorm.DB, n *exportedNotification, imported *importedNotifications, strategy ImportConflictStrategy, summary *ImportSummary) error {
+
+	if !n.PersistenceMode.valid() {
+		return ErrUnsupportedPersistenceMode
+	}
+
+	// endpoints come first in the stream, so by now they're all in the database
+	if !imported.endpoints[n.EndpointUUID] {
+		var count int64
+		err := tx.Unscoped().Model(&WebhookEndpointDB{}).Where("uuid = ?", n.EndpointUUID).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("notification %s for endpoint %s: %w", n.EventUUID, n.EndpointUUID, ErrImportUnknownEndpoint)
+		}
+		imported.endpoints[n.EndpointUUID] = true
+	}
+
+	// the n-th notification of the event conflicts with the n-th one there,
+	// timestamps don't survive every database the same way
+	key := [2]uuid.UUID{n.EndpointUUID, n.EventUUID}
+	occurrence := imported.seen[key]
+	imported.seen[key]++
+
+	var existing []WebhookNotificationDB
+	err := tx.
+		Where("endpoint_uuid = ? AND event_uuid = ? AND id <= ?", n.EndpointUUID, n.EventUUID, imported.before).
+		Order("id").
+		Offset(occurrence).
+		Limit(1).
+		Find(&existing).Error
+	if err != nil {
+		return err
+	}
+
+	var db_notification WebhookNotificationDB
+	if len(existing) > 0 {
+		switch strategy {
+		case ImportSkip:
+			summary.Skipped++
+			return nil
+		case ImportOverwrite:
+			db_notification = existing[0]
+			summary.Overwritten++
+		default:
+			return fmt.Errorf("notification %s for endpoint %s: %w", n.EventUUID, n.EndpointUUID, ErrImportConflict)
+		}
+	}
+
+	notificationExportToDb(n, &db_notification)
+
+	summary.Notifications++
+	return s.saveNotificationRow(tx, &db_notification)
+}
+
+var ErrUnsupportedExportFormat error = errors.New(
+	`
+	cant read the import stream.
+	Recover by retrying with a stream written by service.Export()
+	of the same version of ironhook
+	`,
+)
+var ErrUnknownEndpointStatus error = errors.New(
+	`
+	the imported endpoint has an unknown status, nothing was imported.
+	Recover by retrying with a stream written by service.Export()
+	`,
+)
+var ErrImportUnknownEndpoint error = errors.New(
+	`
+	the imported notification belongs to an endpoint which is neither
+	in the stream nor in the database, nothing was imported.
+	Recover by importing the stream the endpoint was exported with
+	`,
+)
+var ErrImportConflict error = errors.New(
+	`
+	the imported record already exists, nothing was imported.
+	Recover by retrying with ImportSkip or ImportOverwrite
+	`,
+)
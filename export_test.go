@@ -0,0 +1,291 @@
+package ironhook
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gofrs/uuid"
+)
+
+// Create -> Notify -> Delete -> Export -> Import into a fresh service
+func Test_ExportImportFlow(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	source, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	kept := newVerifiedEndpointForTests(t, source, server.URL)
+	deleted := newVerifiedEndpointForTests(t, source, server.URL+"/old")
+	for i := 0; i < 3; i++ {
+		err = source.Notify(kept, WebhookNotification{
+			EventUUID: uuid.Must(uuid.NewV4()),
+			Topic:     "batch.completed",
+			Body:      "batch " + string(rune('a'+i)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = source.Delete(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	err = source.Export(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(stream.String(), "\n"); lines != 6 {
+		t.Fatal("Expected a header, 2 endpoints and 3 notifications, found lines: ", lines)
+	}
+	exported := stream.String()
+
+	// the destination encrypts bodies with its own keys
+	destination, err := NewWebhookService(server.Client(), WithKeyProvider(NewLocalKMS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destination.Close()
+
+	summary, err := destination.Import(strings.NewReader(exported), ImportFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Endpoints != 2 || summary.Notifications != 3 {
+		t.Fatal("Expected 2 endpoints and 3 notifications, found ", summary)
+	}
+
+	imported, err := destination.Get(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.URL != kept.URL || imported.Status != Verified {
+		t.Fatal("Expected ", kept, " found ", imported)
+	}
+	_, err = destination.Get(deleted)
+	if err != ErrRecordNotFound {
+		t.Fatal("Expected the deleted endpoint to stay deleted, got ", err)
+	}
+
+	last, err := destination.LastNotificationSent(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Body != "batch c" {
+		t.Fatal("Expected the last notification to be imported, found ", last)
+	}
+
+	// conflicts
+	_, err = destination.Import(strings.NewReader(exported), ImportFail)
+	if !errors.Is(err, ErrImportConflict) {
+		t.Fatal("Expected ErrImportConflict, got ", err)
+	}
+
+	summary, err = destination.Import(strings.NewReader(exported), ImportSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Skipped != 5 || summary.Endpoints != 0 {
+		t.Fatal("Expected everything to be skipped, found ", summary)
+	}
+
+	summary, err = destination.Import(strings.NewReader(exported), ImportOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Overwritten != 5 {
+		t.Fatal("Expected everything to be overwritten, found ", summary)
+	}
+
+	page, err := destination.ListNotifications(NotificationQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.TotalCount != 3 {
+		t.Fatal("Expected no duplicated notifications, found ", page.TotalCount)
+	}
+}
+
+func Test_ImportUnsupportedFormat(t *testing.T) {
+
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	for _, stream := range []string{
+		``,
+		`{"kind":"endpoint","endpoint":{"uuid":"6551e000-947a-40a4-948d-18d01e3660d4","url":"http://localhost"}}`,
+		`{"kind":"header","version":99}`,
+		`{"kind":"header","version":1}`,
+		`{"kind":"header","version":1}` + "\n" + `{"kind":"user"}`,
+		`not json`,
+	} {
+		_, err = svc.Import(strings.NewReader(stream), ImportFail)
+		if err != ErrUnsupportedExportFormat {
+			t.Fatal("Expected ErrUnsupportedExportFormat for ", stream, " got ", err)
+		}
+	}
+}
+
+func Test_ImportRejectsInvalidRecords(t *testing.T) {
+
+	t.Setenv("HOOK_EGRESS_DENY_HOSTS", "internal.example")
+
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	header := `{"kind":"header","version":2}` + "\n"
+	endpoint := `{"kind":"endpoint","endpoint":{"uuid":"6551e000-947a-40a4-948d-18d01e3660d4","url":"%s","status":%d}}` + "\n"
+	notification := `{"kind":"notification","notification":{"endpoint_uuid":"%s","event_uuid":"2c1f5a0e-3f5b-4b8e-9c3e-6d1f0f2a9b11","body":"hi"}}` + "\n"
+
+	for _, tc := range []struct {
+		stream   string
+		expected error
+	}{
+		{header + fmt.Sprintf(endpoint, "http://localhost", 42), ErrUnknownEndpointStatus},
+		{header + fmt.Sprintf(endpoint, "http://internal.example", int(Verified)), ErrEgressDenied},
+		{header + fmt.Sprintf(notification, "6551e000-947a-40a4-948d-18d01e3660d4"), ErrImportUnknownEndpoint},
+	} {
+		_, err = svc.Import(strings.NewReader(tc.stream), ImportFail)
+		if !errors.Is(err, tc.expected) {
+			t.Fatal("Expected ", tc.expected, " for ", tc.stream, " got ", err)
+		}
+	}
+
+	// nothing was imported
+	endpoints, err := svc.ListEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*endpoints) != 0 {
+		t.Fatal("Expected no imported endpoints, found ", len(*endpoints))
+	}
+
+	// a notification of an endpoint earlier in the stream is fine
+	stream := header +
+		fmt.Sprintf(endpoint, "http://localhost", int(Verified)) +
+		fmt.Sprintf(notification, "6551e000-947a-40a4-948d-18d01e3660d4")
+	summary, err := svc.Import(strings.NewReader(stream), ImportFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Endpoints != 1 || summary.Notifications != 1 {
+		t.Fatal("Expected an endpoint and a notification, got ", summary)
+	}
+}
+
+// paused endpoints keep their pause, history and pending notifications
+func Test_ExportImportPausedEndpoint(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	source, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	endpoint := newVerifiedEndpointForTests(t, source, server.URL)
+	_, err = source.Suspend(endpoint, "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err = source.Resume(endpoint, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same event sent twice, before and during the pause
+	event := WebhookNotification{EventUUID: uuid.Must(uuid.NewV4()), Body: "again"}
+	err = source.Notify(endpoint, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = source.Pause(endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = source.Notify(endpoint, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	err = source.Export(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := stream.String()
+
+	destination, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destination.Close()
+
+	summary, err := destination.Import(strings.NewReader(exported), ImportFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Notifications != 2 {
+		t.Fatal("Expected both notifications of the event, found ", summary)
+	}
+
+	imported, err := destination.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.PausedAt == nil || imported.VerifiedAt == nil {
+		t.Fatal("Expected the pause and the verification to be imported, found ", imported)
+	}
+	history, err := destination.StatusHistory(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[1].Reason != "maintenance" {
+		t.Fatal("Expected the status history to be imported, found ", history)
+	}
+	if countPendingForTests(t, destination, endpoint) != 1 {
+		t.Fatal("Expected the pending notification to be imported")
+	}
+
+	// the pending notification goes out once resumed
+	_, err = destination.Resume(endpoint, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countPendingForTests(t, destination, endpoint) != 0 {
+		t.Fatal("Expected the pending notification to be sent")
+	}
+
+	// both conflict with their own copy, whatever their timestamps
+	summary, err = destination.Import(strings.NewReader(exported), ImportSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Skipped != 3 || summary.Notifications != 0 {
+		t.Fatal("Expected everything to be skipped, found ", summary)
+	}
+	history, err = destination.StatusHistory(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Fatal("Expected the status history not to be duplicated, found ", history)
+	}
+}
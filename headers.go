@@ -0,0 +1,258 @@
+package ironhook
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A custom header sent to the endpoint, like an API gateway key
+type WebhookEndpointHeaderDB struct {
+	ID           uint      `gorm:"primarykey"`
+	EndpointUUID uuid.UUID `gorm:"type:uuid;not null"`
+	Name         string    `gorm:"not null"`
+	Value        string    `gorm:"not null"`
+	// master key the value is encrypted with, empty for plaintext
+	EncryptionKeyID string `gorm:"not null"`
+}
+
+// associated data of encrypted header values
+const endpointHeaderValueColumn = "webhook_endpoint_header_dbs.value"
+
+// values are bound to the endpoint and the header name
+func headerBinding(endpoint_uuid uuid.UUID, name string) binding {
+	return binding{column: endpointHeaderValueColumn, row: endpoint_uuid.String() + "/" + name}
+}
+
+// ironhook sets these itself, or the transport does
+var reservedHeaders = map[string]bool{
+	"Content-Type":      true,
+	"Content-Length":    true,
+	"Host":              true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+}
+
+// room for the signatures and other headers ironhook adds
+const reservedHeaderPrefix = "X-Ironhook-"
+
+func validateHeaders(headers map[string]string) error {
+
+	seen := map[string]bool{}
+	for name, value := range headers {
+		canonical := http.CanonicalHeaderKey(name)
+		if reservedHeaders[canonical] || strings.HasPrefix(canonical, reservedHeaderPrefix) {
+			return ErrReservedHeader
+		}
+		if !validHeaderName(name) || strings.ContainsAny(value, "\r\n\x00") || seen[canonical] {
+			return ErrInvalidHeader
+		}
+		seen[canonical] = true
+	}
+	return nil
+}
+
+// RFC 7230 token characters
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// sorted names, values aren't handed back as they may be secrets
+func headerNames(db_headers []WebhookEndpointHeaderDB) []string {
+	if len(db_headers) == 0 {
+		return nil
+	}
+	names := make([]string, len(db_headers))
+	for i, header := range db_headers {
+		names[i] = header.Name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Replaces the custom headers sent to the endpoint with both verification
+// and notification requests, an empty map removes them all.
+//
+// Header values are encrypted at rest when a key provider is configured.
+// Reserved headers, like Content-Type or anything starting with X-Ironhook-,
+// can't be overridden.
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) SetHeaders(endpoint WebhookEndpoint, headers map[string]string) (WebhookEndpoint, error) {
+
+	if err := validateHeaders(headers); err != nil {
+		return endpoint, err
+	}
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+
+	db_headers, err := s.headersToDb(model_endpoint.UUID, headers)
+	if err != nil {
+		return endpoint, err
+	}
+
+	s.log.Info(
+		"updating the custom headers",
+		zap.String("UUID", endpoint.UUID.String()),
+		zap.Strings("Headers", headerNames(db_headers)),
+	)
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		return replaceHeaders(tx, model_endpoint.UUID, db_headers)
+	})
+	if err != nil {
+		s.log.Error("couldnt save the custom headers", zap.Error(err))
+		return endpoint, err
+	}
+
+	model_endpoint.Headers = db_headers
+	return *endpointDbToWeb(model_endpoint), nil
+}
+
+// encrypts the values, names are canonicalized
+func (s *WebhookEndpointServiceImpl) headersToDb(endpoint_uuid uuid.UUID, headers map[string]string) ([]WebhookEndpointHeaderDB, error) {
+
+	db_headers := make([]WebhookEndpointHeaderDB, 0, len(headers))
+	for name, value := range headers {
+		name = http.CanonicalHeaderKey(name)
+		encrypted_value, key_id, err := s.cipher.encrypt(value, headerBinding(endpoint_uuid, name))
+		if err != nil {
+			s.log.Error("couldnt encrypt a header value", zap.Error(err))
+			return nil, err
+		}
+		db_headers = append(db_headers, WebhookEndpointHeaderDB{
+			EndpointUUID:    endpoint_uuid,
+			Name:            name,
+			Value:           encrypted_value,
+			EncryptionKeyID: key_id,
+		})
+	}
+	sort.Slice(db_headers, func(i, j int) bool { return db_headers[i].Name < db_headers[j].Name })
+	return db_headers, nil
+}
+
+// decrypted values by header name
+func (s *WebhookEndpointServiceImpl) headersFromDb(db_headers []WebhookEndpointHeaderDB) (map[string]string, error) {
+
+	if len(db_headers) == 0 {
+		return nil, nil
+	}
+	headers := make(map[string]string, len(db_headers))
+	for _, header := range db_headers {
+		value, err := s.cipher.decrypt(header.Value, header.EncryptionKeyID, headerBinding(header.EndpointUUID, header.Name))
+		if err != nil {
+			s.log.Error("couldnt decrypt a header value", zap.String("Header", header.Name), zap.Error(err))
+			return nil, err
+		}
+		headers[header.Name] = value
+	}
+	return headers, nil
+}
+
+// sets the endpoint's custom headers on an outgoing request
+func (s *WebhookEndpointServiceImpl) applyHeaders(request *http.Request, db_headers []WebhookEndpointHeaderDB) error {
+
+	headers, err := s.headersFromDb(db_headers)
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	return nil
+}
+
+// part of service.ReEncrypt()
+func (s *WebhookEndpointServiceImpl) reEncryptHeaders(current string) (int64, error) {
+
+	var total int64
+	var after uint
+	for {
+		var batch []WebhookEndpointHeaderDB
+		tx := s.db.
+			Where("id > ? AND encryption_key_id <> ?", after, current).
+			Order("id").
+			Limit(rowBatchSize).
+			Find(&batch)
+		if tx.Error != nil {
+			s.log.Error("couldnt fetch headers for re-encryption", zap.Error(tx.Error))
+			return total, tx.Error
+		}
+
+		for _, db_header := range batch {
+			bound_to := headerBinding(db_header.EndpointUUID, db_header.Name)
+			value, err := s.cipher.decrypt(db_header.Value, db_header.EncryptionKeyID, bound_to)
+			if err != nil {
+				return total, err
+			}
+			value, key_id, err := s.cipher.encrypt(value, bound_to)
+			if err != nil {
+				return total, err
+			}
+			tx = s.db.
+				Model(&db_header).
+				UpdateColumns(map[string]interface{}{
+					"value":             value,
+					"encryption_key_id": key_id,
+				})
+			if tx.Error != nil {
+				s.log.Error("couldnt save a re-encrypted header", zap.Error(tx.Error))
+				return total, tx.Error
+			}
+			total++
+		}
+
+		if len(batch) < rowBatchSize {
+			break
+		}
+		after = batch[len(batch)-1].ID
+	}
+	return total, nil
+}
+
+func replaceHeaders(tx *gorm.DB, endpoint_uuid uuid.UUID, db_headers []WebhookEndpointHeaderDB) error {
+
+	err := tx.Where("endpoint_uuid = ?", endpoint_uuid).Delete(&WebhookEndpointHeaderDB{}).Error
+	if err != nil {
+		return err
+	}
+	if len(db_headers) == 0 {
+		return nil
+	}
+	return tx.Omit(clause.Associations).Create(&db_headers).Error
+}
+
+var ErrReservedHeader error = errors.New(
+	`
+	cant override a header ironhook sets itself.
+	Recover by retrying without Content-Type, Content-Length, Host,
+	Transfer-Encoding, Connection and X-Ironhook- headers
+	`,
+)
+var ErrInvalidHeader error = errors.New(
+	`
+	cant accept this header.
+	Recover by retrying with a valid header name, no duplicates
+	and a value without line breaks
+	`,
+)
@@ -0,0 +1,124 @@
+package ironhook
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofrs/uuid"
+)
+
+func Test_validateHeaders(t *testing.T) {
+
+	cases := []struct {
+		headers map[string]string
+		want    error
+	}{
+		{nil, nil},
+		{map[string]string{"X-Api-Key": "secret", "x-tenant": "acme"}, nil},
+		{map[string]string{"content-type": "text/plain"}, ErrReservedHeader},
+		{map[string]string{"Host": "example.com"}, ErrReservedHeader},
+		{map[string]string{"X-Ironhook-Signature": "forged"}, ErrReservedHeader},
+		{map[string]string{"X Api Key": "secret"}, ErrInvalidHeader},
+		{map[string]string{"X-Api-Key": "secret\r\nX-Other: injected"}, ErrInvalidHeader},
+		{map[string]string{"X-Api-Key": "a", "x-api-key": "b"}, ErrInvalidHeader},
+	}
+
+	for _, c := range cases {
+		if err := validateHeaders(c.headers); err != c.want {
+			t.Fatalf("%v: have %v want %v", c.headers, err, c.want)
+		}
+	}
+}
+
+// records the X-Api-Key header of every request it receives
+type headerRecorder struct {
+	mu       sync.Mutex
+	api_keys []string
+}
+
+func (h *headerRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.api_keys = append(h.api_keys, r.Header.Get("X-Api-Key"))
+	h.mu.Unlock()
+
+	if strings.Contains(r.URL.Path, "/verification") {
+		fmt.Fprint(w, r.URL.Query().Get("id"))
+	}
+}
+
+func Test_CustomHeadersFlow(t *testing.T) {
+
+	recorder := &headerRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(server.Client(), WithKeyProvider(NewLocalKMS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint, err := svc.Create(WebhookEndpoint{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.SetHeaders(endpoint, map[string]string{"Content-Type": "text/plain"})
+	if err != ErrReservedHeader {
+		t.Fatal("Expected ErrReservedHeader, got ", err)
+	}
+	endpoint, err = svc.SetHeaders(endpoint, map[string]string{"x-api-key": "gateway-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoint.HeaderNames) != 1 || endpoint.HeaderNames[0] != "X-Api-Key" {
+		t.Fatal("Expected the header names to be listed, found ", endpoint.HeaderNames)
+	}
+
+	// encrypted at rest
+	var db_header WebhookEndpointHeaderDB
+	tx := svc.db.First(&db_header, "endpoint_uuid = ?", endpoint.UUID)
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	if db_header.EncryptionKeyID == "" || strings.Contains(db_header.Value, "gateway-secret") {
+		t.Fatal("Expected the header value to be encrypted, found ", db_header.Value)
+	}
+
+	endpoint, err = svc.Verify(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.api_keys) != 2 || recorder.api_keys[0] != "gateway-secret" || recorder.api_keys[1] != "gateway-secret" {
+		t.Fatal("Expected both requests to carry the header, found ", recorder.api_keys)
+	}
+
+	fetched, err := svc.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched.HeaderNames) != 1 {
+		t.Fatal("Expected the header to be listed, found ", fetched.HeaderNames)
+	}
+
+	_, err = svc.SetHeaders(endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder.api_keys[2] != "" {
+		t.Fatal("Expected the header to be removed, found ", recorder.api_keys[2])
+	}
+}
@@ -0,0 +1,212 @@
+package ironhook
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// What the health checks last found about an endpoint
+type HealthCheck string
+
+const (
+	// answered the probe
+	CheckHealthy HealthCheck = "healthy"
+	// didn't answer the probe, or answered with a 5xx
+	CheckUnhealthy HealthCheck = "unhealthy"
+	// passed verification again
+	CheckReverified HealthCheck = "reverified"
+	// failed verification again, the endpoint is Suspended
+	CheckVerificationFailed HealthCheck = "verification_failed"
+)
+
+// Statuses the health checks move endpoints between:
+//
+// - Verified endpoints answering the probe become Healthy
+//
+// - Healthy endpoints missing a probe are Verified again,
+// and Suspended after HOOK_HEALTH_FAILURE_THRESHOLD misses in a row
+//
+// - endpoints verified longer than HOOK_REVERIFY_INTERVAL ago are verified again,
+// and Suspended if they fail, the domain may have changed hands
+//
+// - Suspended endpoints are verified again on every check, and Verified once they pass
+type healthSettings struct {
+	interval         time.Duration
+	failureThreshold int
+	reverifyInterval time.Duration
+}
+
+// HOOK_HEALTH_* and HOOK_REVERIFY_INTERVAL settings
+func healthSettingsFromConfig() (healthSettings, error) {
+
+	settings := healthSettings{
+		interval:         viper.GetDuration("health_check_interval"),
+		failureThreshold: viper.GetInt("health_failure_threshold"),
+		reverifyInterval: viper.GetDuration("reverify_interval"),
+	}
+	if settings.interval < 0 || settings.failureThreshold < 0 || settings.reverifyInterval < 0 {
+		return settings, ErrInvalidHealthCheck
+	}
+	return settings, nil
+}
+
+// whether the verification is older than HOOK_REVERIFY_INTERVAL
+func (h healthSettings) reverificationDue(model_endpoint *WebhookEndpointDB, now time.Time) bool {
+	if h.reverifyInterval == 0 {
+		return false
+	}
+	// verified before the health checks kept track
+	if model_endpoint.VerifiedAt == nil {
+		return true
+	}
+	return now.Sub(*model_endpoint.VerifiedAt) >= h.reverifyInterval
+}
+
+// A HEAD request to the endpoint URL, anything but a 5xx
+// means there's a receiver at the other end
+func (s *WebhookEndpointServiceImpl) probeEndpoint(model_endpoint *WebhookEndpointDB) error {
+
+	response, err := s.sendToEndpoint(s.verificationClient(), model_endpoint, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, model_endpoint.URL, nil)
+	})
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, maxVerificationResponse))
+	response.Body.Close()
+
+	if response.StatusCode >= 500 {
+		return &VerificationError{Reason: VerificationUnexpectedStatus, StatusCode: response.StatusCode}
+	}
+	return nil
+}
+
+// Probes or re-verifies one endpoint and saves the outcome
+func (s *WebhookEndpointServiceImpl) checkEndpoint(model_endpoint *WebhookEndpointDB, now time.Time) error {
+
+	log := s.log.With(zap.String("UUID", model_endpoint.UUID.String()))
+	columns := map[string]interface{}{"last_checked_at": now}
+
+	if model_endpoint.Status == Suspended || s.health.reverificationDue(model_endpoint, now) {
+		err := s.verifyEndpoint(model_endpoint)
+		if err != nil {
+			log.Warn("endpoint failed re-verification, suspending it", zap.Error(err))
+			columns["last_check"] = CheckVerificationFailed
+			return s.changeCheckedStatus(model_endpoint, Suspended, "failed re-verification", columns)
+		}
+		log.Info("endpoint passed re-verification")
+		columns = verifiedColumns(now)
+		columns["last_checked_at"] = now
+		columns["last_check"] = CheckReverified
+		// healthy endpoints stay healthy
+		to := Verified
+		if model_endpoint.Status == Healthy {
+			to = Healthy
+		}
+		err = s.changeCheckedStatus(model_endpoint, to, "passed re-verification", columns)
+		if err != nil {
+			return err
+		}
+		model_endpoint.setVerified(now)
+		return nil
+	}
+
+	err := s.probeEndpoint(model_endpoint)
+	if err == nil {
+		columns["last_check"] = CheckHealthy
+		columns["health_failures"] = 0
+		return s.changeCheckedStatus(model_endpoint, Healthy, "passed a health check", columns)
+	}
+
+	failures := model_endpoint.HealthFailures + 1
+	columns["last_check"] = CheckUnhealthy
+	columns["health_failures"] = failures
+	if s.health.failureThreshold > 0 && failures >= s.health.failureThreshold {
+		log.Warn("endpoint keeps failing health checks, suspending it", zap.Int("Failures", failures), zap.Error(err))
+		return s.changeCheckedStatus(model_endpoint, Suspended, "failed too many health checks", columns)
+	}
+	log.Info("endpoint failed a health check", zap.Int("Failures", failures), zap.Error(err))
+	return s.changeCheckedStatus(model_endpoint, Verified, "failed a health check", columns)
+}
+
+// Saves the outcome of a check, unless someone else changed the endpoint
+// while it was checked. Endpoints suspended in the meantime are left alone,
+// even if they were suspended already, see service.Suspend().
+func (s *WebhookEndpointServiceImpl) changeCheckedStatus(model_endpoint *WebhookEndpointDB, to WebhookEndpointStatus, reason string, columns map[string]interface{}) error {
+	unchanged := func(db *gorm.DB) *gorm.DB {
+		return db.Where("last_check = ?", model_endpoint.LastCheck)
+	}
+	return s.guardedStatusChange(model_endpoint, unchanged, to, SystemActor, reason, columns)
+}
+
+// One round of health checks over the verified endpoints, and the ones
+// the health checks suspended. Endpoints suspended otherwise, and paused
+// ones, are left alone.
+func (s *WebhookEndpointServiceImpl) checkEndpointHealth() error {
+
+	now := time.Now()
+	var after uint
+	for {
+		var batch []WebhookEndpointDB
+		tx := s.db.
+			Where("id > ? AND paused_at IS NULL", after).
+			Where(
+				s.db.Where("status IN ?", []WebhookEndpointStatus{Verified, Healthy}).
+					Or("status = ? AND last_check IN ?", Suspended, []HealthCheck{CheckUnhealthy, CheckVerificationFailed}),
+			).
+			Order("id").
+			Limit(rowBatchSize).
+			Find(&batch)
+		if tx.Error != nil {
+			s.log.Error("couldnt fetch endpoints for health checks", zap.Error(tx.Error))
+			return tx.Error
+		}
+
+		for i := range batch {
+			err := s.checkEndpoint(&batch[i], now)
+			if err == ErrStatusChanged || err == ErrIllegalStatusTransition {
+				// changed while it was checked, the next round will see
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(batch) < rowBatchSize {
+			return nil
+		}
+		after = batch[len(batch)-1].ID
+	}
+}
+
+func (s *WebhookEndpointServiceImpl) startHealthChecks(interval time.Duration) {
+
+	s.log.Info(
+		"Starting the endpoint health checks",
+		zap.Duration("Interval", interval),
+		zap.Int("FailureThreshold", s.health.failureThreshold),
+		zap.Duration("ReverifyInterval", s.health.reverifyInterval),
+	)
+
+	s.runPeriodically(interval, func() {
+		err := s.checkEndpointHealth()
+		if err != nil {
+			s.log.Error("Failed checking endpoint health", zap.Error(err))
+		}
+	})
+}
+
+var ErrInvalidHealthCheck error = errors.New(
+	`
+	cant accept these health check settings.
+	Recover by setting HOOK_HEALTH_CHECK_INTERVAL, HOOK_HEALTH_FAILURE_THRESHOLD
+	and HOOK_REVERIFY_INTERVAL to zero or more
+	`,
+)
@@ -0,0 +1,222 @@
+package ironhook
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// answers verification and probes while up, 503s otherwise,
+// or someone else's answer once the domain has changed hands
+type flakyReceiver struct {
+	mu       sync.Mutex
+	down     bool
+	new_host bool
+}
+
+func (r *flakyReceiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case r.down:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case r.new_host:
+		fmt.Fprint(w, "domain for sale")
+	default:
+		fmt.Fprint(w, request.URL.Query().Get("id"))
+	}
+}
+
+func (r *flakyReceiver) set(down, new_host bool) {
+	r.mu.Lock()
+	r.down, r.new_host = down, new_host
+	r.mu.Unlock()
+}
+
+func checkHealthForTests(t *testing.T, svc *WebhookEndpointServiceImpl, endpoint WebhookEndpoint, status WebhookEndpointStatus, check HealthCheck) WebhookEndpoint {
+	err := svc.checkEndpointHealth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := svc.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Status != status || current.LastCheck != check || current.LastCheckedAt == nil {
+		t.Fatal("Expected ", status, " and ", check, " found ", current.Status, " and ", current.LastCheck)
+	}
+	return current
+}
+
+func Test_HealthChecks(t *testing.T) {
+
+	t.Setenv("HOOK_HEALTH_CHECK_INTERVAL", "0")
+	t.Setenv("HOOK_HEALTH_FAILURE_THRESHOLD", "2")
+
+	receiver := &flakyReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint := newVerifiedEndpointForTests(t, svc, server.URL)
+	endpoint, err = svc.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.VerifiedAt == nil {
+		t.Fatal("Expected the verification time to be recorded")
+	}
+
+	checkHealthForTests(t, svc, endpoint, Healthy, CheckHealthy)
+
+	// down for a while
+	receiver.set(true, false)
+	checkHealthForTests(t, svc, endpoint, Verified, CheckUnhealthy)
+	checkHealthForTests(t, svc, endpoint, Suspended, CheckUnhealthy)
+
+	err = svc.Notify(endpoint, WebhookNotification{})
+	if err != ErrEndpointNotYetActivated {
+		t.Fatal("Expected suspended endpoints to be refused, got ", err)
+	}
+
+	// suspended endpoints have to pass verification to come back
+	checkHealthForTests(t, svc, endpoint, Suspended, CheckVerificationFailed)
+	receiver.set(false, false)
+	checkHealthForTests(t, svc, endpoint, Verified, CheckReverified)
+	checkHealthForTests(t, svc, endpoint, Healthy, CheckHealthy)
+}
+
+func Test_Reverification(t *testing.T) {
+
+	t.Setenv("HOOK_HEALTH_CHECK_INTERVAL", "0")
+	t.Setenv("HOOK_REVERIFY_INTERVAL", "24h")
+
+	receiver := &flakyReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint := newVerifiedEndpointForTests(t, svc, server.URL)
+	checkHealthForTests(t, svc, endpoint, Healthy, CheckHealthy)
+
+	// a day later, someone else answers
+	receiver.set(false, true)
+	checkHealthForTests(t, svc, endpoint, Healthy, CheckHealthy)
+	svc.db.Model(&WebhookEndpointDB{}).
+		Where("uuid = ?", endpoint.UUID).
+		UpdateColumn("verified_at", time.Now().Add(-25*time.Hour))
+	checkHealthForTests(t, svc, endpoint, Suspended, CheckVerificationFailed)
+
+	// suspended by someone other than the health checks
+	receiver.set(false, false)
+	other := newVerifiedEndpointForTests(t, svc, server.URL+"/other")
+	_, err = svc.Suspend(other, "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHealthForTests(t, svc, endpoint, Verified, CheckReverified)
+	other, err = svc.Get(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Status != Suspended || other.LastCheckedAt != nil {
+		t.Fatal("Expected the health checks to leave the endpoint alone, found ", other.Status, other.LastCheck)
+	}
+
+	// healthy endpoints passing re-verification stay healthy
+	checkHealthForTests(t, svc, endpoint, Healthy, CheckHealthy)
+	svc.db.Model(&WebhookEndpointDB{}).
+		Where("uuid = ?", endpoint.UUID).
+		UpdateColumn("verified_at", time.Now().Add(-25*time.Hour))
+	checkHealthForTests(t, svc, endpoint, Healthy, CheckReverified)
+	history, err := svc.StatusHistory(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := history[len(history)-1]; last.From != Verified || last.To != Healthy {
+		t.Fatal("Expected the endpoint not to be downgraded, found ", last)
+	}
+
+	// suspended by the health checks, then by someone else
+	receiver.set(true, false)
+	svc.db.Model(&WebhookEndpointDB{}).
+		Where("uuid = ?", endpoint.UUID).
+		UpdateColumn("verified_at", time.Now().Add(-25*time.Hour))
+	checkHealthForTests(t, svc, endpoint, Suspended, CheckVerificationFailed)
+	receiver.set(false, false)
+	_, err = svc.Suspend(endpoint, "domain dispute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.checkEndpointHealth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err = svc.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Status != Suspended || endpoint.LastCheck != "" {
+		t.Fatal("Expected the health checks to leave the endpoint alone, found ", endpoint.Status, endpoint.LastCheck)
+	}
+
+	t.Setenv("HOOK_HEALTH_FAILURE_THRESHOLD", "-1")
+	_, err = NewWebhookService(nil)
+	if err != ErrInvalidHealthCheck {
+		t.Fatal("Expected ErrInvalidHealthCheck, got ", err)
+	}
+}
+
+func Test_HealthCheckRace(t *testing.T) {
+
+	t.Setenv("HOOK_HEALTH_CHECK_INTERVAL", "0")
+
+	receiver := &flakyReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint := newVerifiedEndpointForTests(t, svc, server.URL)
+
+	// loaded for a check, then disabled while the probe was on its way
+	model_endpoint, err := svc.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.Disable(endpoint, "abuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.checkEndpoint(model_endpoint, time.Now())
+	if err != ErrStatusChanged {
+		t.Fatal("Expected ErrStatusChanged, got ", err)
+	}
+	endpoint, err = svc.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Status != Disabled || endpoint.LastCheckedAt != nil {
+		t.Fatal("Expected the endpoint to stay disabled, found ", endpoint.Status, endpoint.LastCheck)
+	}
+}
@@ -0,0 +1,97 @@
+package ironhook
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+)
+
+// labels are kept apart from the endpoint so they can be filtered on
+type WebhookEndpointLabelDB struct {
+	ID           uint      `gorm:"primarykey"`
+	EndpointUUID uuid.UUID `gorm:"type:uuid;not null"`
+	LabelKey     string    `gorm:"not null"`
+	LabelValue   string    `gorm:"not null"`
+}
+
+// same limit as the varchar columns
+const maxLabelLength = 255
+
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if key == "" || len(key) > maxLabelLength || len(value) > maxLabelLength {
+			return ErrInvalidLabel
+		}
+	}
+	return nil
+}
+
+func validateMetadata(metadata json.RawMessage) error {
+	if len(metadata) > 0 && !json.Valid(metadata) {
+		return ErrInvalidMetadata
+	}
+	return nil
+}
+
+// sorted by key, so the rows come out in a stable order
+func labelsToDb(endpoint_uuid uuid.UUID, labels map[string]string) []WebhookEndpointLabelDB {
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	db_labels := make([]WebhookEndpointLabelDB, len(keys))
+	for i, key := range keys {
+		db_labels[i] = WebhookEndpointLabelDB{
+			EndpointUUID: endpoint_uuid,
+			LabelKey:     key,
+			LabelValue:   labels[key],
+		}
+	}
+	return db_labels
+}
+
+func labelsDbToMap(db_labels []WebhookEndpointLabelDB) map[string]string {
+	if len(db_labels) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(db_labels))
+	for _, label := range db_labels {
+		labels[label.LabelKey] = label.LabelValue
+	}
+	return labels
+}
+
+// swaps all the labels of the endpoint for the given ones
+func replaceLabels(tx *gorm.DB, endpoint_uuid uuid.UUID, labels map[string]string) error {
+
+	err := tx.Where("endpoint_uuid = ?", endpoint_uuid).Delete(&WebhookEndpointLabelDB{}).Error
+	if err != nil {
+		return err
+	}
+
+	db_labels := labelsToDb(endpoint_uuid, labels)
+	if len(db_labels) == 0 {
+		return nil
+	}
+	return tx.Create(&db_labels).Error
+}
+
+var ErrInvalidLabel error = errors.New(
+	`
+	cant accept this label.
+	Recover by retrying with non-empty label keys, keys and values
+	up to 255 characters long
+	`,
+)
+var ErrInvalidMetadata error = errors.New(
+	`
+	cant accept the endpoint metadata, it isnt valid JSON.
+	Recover by retrying with a JSON document or without metadata
+	`,
+)
@@ -0,0 +1,175 @@
+package ironhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func Test_EndpointMetadataUpdateFlow(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	mock_http_client := server.Client()
+	defer server.Close()
+
+	svc, err := NewWebhookService(mock_http_client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	_, err = svc.Create(WebhookEndpoint{URL: server.URL, Metadata: json.RawMessage(`{"broken`)})
+	if err != ErrInvalidMetadata {
+		t.Fatal("Expected ErrInvalidMetadata, got ", err)
+	}
+	_, err = svc.Create(WebhookEndpoint{URL: server.URL, Labels: map[string]string{"": "prod"}})
+	if err != ErrInvalidLabel {
+		t.Fatal("Expected ErrInvalidLabel, got ", err)
+	}
+
+	endpoint, err := svc.Create(WebhookEndpoint{
+		URL:         server.URL,
+		Description: "Production orders",
+		Labels:      map[string]string{"env": "prod", "team": "orders"},
+		Metadata:    json.RawMessage(`{"owner":"jane"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err = svc.Verify(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetched, err := svc.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.Description != "Production orders" || fetched.Labels["team"] != "orders" || string(fetched.Metadata) != `{"owner":"jane"}` {
+		t.Fatal("Expected the metadata to be saved, found ", fetched)
+	}
+
+	// same URL, stays verified
+	fetched.Labels = map[string]string{"env": "staging"}
+	fetched.Description = "Staging orders"
+	fetched.Metadata = nil
+	updated, err := svc.Update(fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Status != Verified {
+		t.Fatal("Expected the endpoint to stay verified, found ", updated.Status)
+	}
+	fetched, err = svc.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched.Labels) != 1 || fetched.Labels["env"] != "staging" || fetched.Metadata != nil {
+		t.Fatal("Expected the labels and metadata to be replaced, found ", fetched)
+	}
+
+	fetched.URL = server.URL + "/elsewhere"
+	updated, err = svc.Update(fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Status != Unverified {
+		t.Fatal("Expected a new URL to need verification, found ", updated.Status)
+	}
+}
+
+func Test_ListEndpointsByLabels(t *testing.T) {
+
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	for _, labels := range []map[string]string{
+		{"env": "prod", "team": "orders"},
+		{"env": "prod", "team": "billing"},
+		{"env": "staging", "team": "orders"},
+		nil,
+	} {
+		_, err := svc.Create(WebhookEndpoint{URL: "https://example.com", Labels: labels, Description: "Team " + labels["team"]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		query EndpointQuery
+		want  int64
+	}{
+		{EndpointQuery{Labels: map[string]string{"env": "prod"}}, 2},
+		{EndpointQuery{Labels: map[string]string{"env": "prod", "team": "orders"}}, 1},
+		{EndpointQuery{Labels: map[string]string{"env": "dev"}}, 0},
+		{EndpointQuery{DescriptionContains: "BILL"}, 1},
+		{EndpointQuery{}, 4},
+	}
+	for _, c := range cases {
+		page, err := svc.ListEndpointsWithQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.TotalCount != c.want || int64(len(page.Endpoints)) != c.want {
+			t.Fatalf("%+v: have %d endpoints want %d", c.query, page.TotalCount, c.want)
+		}
+		for _, endpoint := range page.Endpoints {
+			for key, value := range c.query.Labels {
+				if endpoint.Labels[key] != value {
+					t.Fatal("Expected the listed endpoint to carry its labels, found ", endpoint.Labels)
+				}
+			}
+		}
+	}
+}
+
+func Test_ExportImportLabels(t *testing.T) {
+
+	source, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	endpoint, err := source.Create(WebhookEndpoint{
+		URL:      "https://example.com",
+		Labels:   map[string]string{"env": "prod"},
+		Metadata: json.RawMessage(`{"tier":1}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	err = source.Export(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	_, err = target.Import(bytes.NewReader(stream.Bytes()), ImportOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// overwriting keeps a single set of labels
+	_, err = target.Import(bytes.NewReader(stream.Bytes()), ImportOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := target.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported.Labels) != 1 || imported.Labels["env"] != "prod" || string(imported.Metadata) != `{"tier":1}` {
+		t.Fatal("Expected the labels and metadata to be imported, found ", imported)
+	}
+}
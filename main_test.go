@@ -0,0 +1,14 @@
+package ironhook
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+
+	// the mock receivers listen on 127.0.0.1
+	os.Setenv("HOOK_EGRESS_ALLOW_LOOPBACK", "true")
+
+	os.Exit(m.Run())
+}
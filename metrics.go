@@ -0,0 +1,200 @@
+package ironhook
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Collects the service metrics, see service.MetricsHandler() and WithMetrics().
+//
+// Counters and histograms are updated as things happen, endpoints by status
+// and the pending notifications are counted in the database on every scrape.
+type serviceMetrics struct {
+	notifications        *prometheus.CounterVec
+	notificationDuration *prometheus.HistogramVec
+	retries              *prometheus.CounterVec
+	verifications        *prometheus.CounterVec
+	verificationDuration prometheus.Histogram
+
+	endpoints *prometheus.Desc
+	pending   *prometheus.Desc
+
+	db  *gorm.DB
+	log *zap.Logger
+
+	// the service's own, for MetricsHandler
+	registry *prometheus.Registry
+	// the caller's, see WithMetrics
+	registerer prometheus.Registerer
+}
+
+// kinds of ironhook_retries_total
+const (
+	// the endpoint rejected the OAuth2 access token, sent again with a new one
+	retryAccessToken = "access_token"
+	// background verification, see VerifyAsync
+	retryVerification = "verification"
+)
+
+func newServiceMetrics(db *gorm.DB, log *zap.Logger) *serviceMetrics {
+	m := &serviceMetrics{
+		notifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ironhook",
+			Name:      "notifications_total",
+			Help:      "Notifications sent, by endpoint, response status code (0 when unreachable) and outcome.",
+		}, []string{"endpoint", "status_code", "outcome"}),
+		notificationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "ironhook",
+			Name:      "notification_duration_seconds",
+			Help:      "How long sending a notification took, by outcome.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"outcome"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ironhook",
+			Name:      "retries_total",
+			Help:      "Requests sent again, by kind: access_token or verification.",
+		}, []string{"kind"}),
+		verifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ironhook",
+			Name:      "verifications_total",
+			Help:      "Endpoint verifications, by outcome: verified or the reason of the failure.",
+		}, []string{"outcome"}),
+		verificationDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "ironhook",
+			Name:      "verification_duration_seconds",
+			Help:      "How long verifying an endpoint took.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		endpoints: prometheus.NewDesc(
+			"ironhook_endpoints",
+			"Endpoints, by status.",
+			[]string{"status"}, nil,
+		),
+		pending: prometheus.NewDesc(
+			"ironhook_pending_notifications",
+			"Notifications waiting for paused endpoints.",
+			nil, nil,
+		),
+		db:       db,
+		log:      log,
+		registry: prometheus.NewRegistry(),
+	}
+	m.registry.MustRegister(m)
+	return m
+}
+
+func (m *serviceMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.notifications.Describe(ch)
+	m.notificationDuration.Describe(ch)
+	m.retries.Describe(ch)
+	m.verifications.Describe(ch)
+	m.verificationDuration.Describe(ch)
+	ch <- m.endpoints
+	ch <- m.pending
+}
+
+func (m *serviceMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.notifications.Collect(ch)
+	m.notificationDuration.Collect(ch)
+	m.retries.Collect(ch)
+	m.verifications.Collect(ch)
+	m.verificationDuration.Collect(ch)
+
+	var by_status []struct {
+		Status WebhookEndpointStatus
+		Total  int64
+	}
+	tx := m.db.Model(&WebhookEndpointDB{}).Select("status, COUNT(*) AS total").Group("status").Scan(&by_status)
+	if tx.Error != nil {
+		m.log.Error("couldnt count endpoints for metrics", zap.Error(tx.Error))
+		ch <- prometheus.NewInvalidMetric(m.endpoints, tx.Error)
+	} else {
+		totals := map[WebhookEndpointStatus]int64{}
+		for _, row := range by_status {
+			totals[row.Status] = row.Total
+		}
+		// every status, so they don't disappear when they reach zero
+		for status := range statusNames {
+			ch <- prometheus.MustNewConstMetric(m.endpoints, prometheus.GaugeValue, float64(totals[status]), status.String())
+		}
+	}
+
+	var pending int64
+	tx = m.db.Model(&WebhookNotificationDB{}).Where("delivery_status = ?", DeliveryPending).Count(&pending)
+	if tx.Error != nil {
+		m.log.Error("couldnt count pending notifications for metrics", zap.Error(tx.Error))
+		ch <- prometheus.NewInvalidMetric(m.pending, tx.Error)
+	} else {
+		ch <- prometheus.MustNewConstMetric(m.pending, prometheus.GaugeValue, float64(pending))
+	}
+}
+
+func (m *serviceMetrics) observeNotification(model_endpoint *WebhookEndpointDB, response_code int, err error, elapsed time.Duration) {
+	outcome := "delivered"
+	if err != nil {
+		outcome = "failed"
+	}
+	m.notifications.WithLabelValues(model_endpoint.UUID.String(), strconv.Itoa(response_code), outcome).Inc()
+	m.notificationDuration.WithLabelValues(outcome).Observe(elapsed.Seconds())
+}
+
+func (m *serviceMetrics) observeVerification(err error, elapsed time.Duration) {
+	outcome := "verified"
+	var verification_err *VerificationError
+	if errors.As(err, &verification_err) {
+		outcome = string(verification_err.Reason)
+	} else if err != nil {
+		outcome = "error"
+	}
+	m.verifications.WithLabelValues(outcome).Inc()
+	m.verificationDuration.Observe(elapsed.Seconds())
+}
+
+func (m *serviceMetrics) retried(kind string) {
+	m.retries.WithLabelValues(kind).Inc()
+}
+
+// registers the metrics on the caller's registerer, if there's one
+func (m *serviceMetrics) register() error {
+	if m.registerer == nil {
+		return nil
+	}
+	err := m.registerer.Register(m)
+	if err != nil {
+		m.log.Error("couldnt register the service metrics", zap.Error(err))
+		return ErrMetricsRegistration
+	}
+	return nil
+}
+
+// so another service can register later on, the database is gone anyway
+func (m *serviceMetrics) unregister() {
+	if m.registerer != nil {
+		m.registerer.Unregister(m)
+	}
+}
+
+// Serves the service metrics in the Prometheus format, mount it
+// wherever your app serves its own:
+//
+// http.Handle("/metrics", service.MetricsHandler())
+//
+// Use WithMetrics() instead to add them to a registry of your own.
+func (s *WebhookEndpointServiceImpl) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})
+}
+
+var ErrMetricsRegistration error = errors.New(
+	`
+	cant register the service metrics with the registerer.
+	Recover by closing the service registered before,
+	or by passing a registerer of its own to every service
+	`,
+)
@@ -0,0 +1,127 @@
+package ironhook
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func scrapeMetricsForTests(t *testing.T, svc WebhookEndpointService) string {
+	recorder := httptest.NewRecorder()
+	svc.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func Test_Metrics(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	registry := prometheus.NewRegistry()
+	svc, err := NewWebhookService(nil, WithMetrics(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := newVerifiedEndpointForTests(t, svc, server.URL)
+	failing := newVerifiedEndpointForTests(t, svc, server.URL+"/failing")
+	_, err = svc.Create(WebhookEndpoint{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.Notify(endpoint, WebhookNotification{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Notify(failing, WebhookNotification{})
+	if err != ErrFailedNotifyingTheEndpoint {
+		t.Fatal("Expected ErrFailedNotifyingTheEndpoint, got ", err)
+	}
+	_, err = svc.Pause(endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Notify(endpoint, WebhookNotification{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scraped := scrapeMetricsForTests(t, svc)
+	for _, expected := range []string{
+		`ironhook_notifications_total{endpoint="` + endpoint.UUID.String() + `",outcome="delivered",status_code="200"} 1`,
+		`ironhook_notifications_total{endpoint="` + failing.UUID.String() + `",outcome="failed",status_code="500"} 1`,
+		`ironhook_notification_duration_seconds_count{outcome="delivered"} 1`,
+		`ironhook_verifications_total{outcome="verified"} 2`,
+		`ironhook_verification_duration_seconds_count 2`,
+		`ironhook_endpoints{status="verified"} 2`,
+		`ironhook_endpoints{status="unverified"} 1`,
+		`ironhook_endpoints{status="disabled"} 0`,
+		`ironhook_pending_notifications 1`,
+	} {
+		if !strings.Contains(scraped, expected) {
+			t.Fatal("Expected the metrics to contain ", expected, " found\n", scraped)
+		}
+	}
+
+	// the caller's registry gets the same metrics
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) == 0 {
+		t.Fatal("Expected the metrics in the caller's registry")
+	}
+
+	// one service per registry at a time
+	_, err = NewWebhookService(nil, WithMetrics(registry))
+	if err != ErrMetricsRegistration {
+		t.Fatal("Expected ErrMetricsRegistration, got ", err)
+	}
+	err = svc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := NewWebhookService(nil, WithMetrics(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Close()
+}
+
+func Test_VerificationMetrics(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	endpoint, err := svc.Create(WebhookEndpoint{URL: server.URL + "/nowhere"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err = svc.SetVerificationProtocol(endpoint, VerificationProtocol{Path: "/nothing-here"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.Verify(endpoint)
+	if err == nil {
+		t.Fatal("Expected the verification to fail")
+	}
+
+	scraped := scrapeMetricsForTests(t, svc)
+	if !strings.Contains(scraped, `ironhook_verifications_total{outcome="unexpected_status"} 1`) {
+		t.Fatal("Expected a failed verification in the metrics, found\n", scraped)
+	}
+}
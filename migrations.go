@@ -0,0 +1,857 @@
+package ironhook
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// A single, versioned step of the database schema.
+//
+// Up and Down return the statements for a given engine, so every step
+// is written once and rendered for each of the supported databases.
+type schemaMigration struct {
+	Version     int
+	Description string
+	Up          func(d sqlDialect) []string
+	Down        func(d sqlDialect) []string
+	// Optional query for rows the migration can't cope with, run before Up.
+	// Any row it returns stops the migration with Violation, the first
+	// column of the rows is listed in the error.
+	Precheck  func(d sqlDialect) string
+	Violation error
+}
+
+// Keeps track of applied migrations
+type SchemaMigrationDB struct {
+	Version     int    `gorm:"primaryKey;autoIncrement:false"`
+	Description string `gorm:"not null"`
+	AppliedAt   time.Time
+}
+
+func (SchemaMigrationDB) TableName() string {
+	return migrationsTable
+}
+
+const migrationsTable = "ironhook_schema_migrations"
+
+// Ordered list of all the schema migrations.
+// Never edit a released migration, append a new one instead.
+var schemaMigrations = []schemaMigration{
+	{
+		Version:     1,
+		Description: "create endpoints and notifications tables",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.createTable("webhook_endpoint_dbs",
+					"id "+d.primaryKey,
+					"created_at "+d.timestamp,
+					"updated_at "+d.timestamp,
+					"deleted_at "+d.timestamp,
+					"uuid "+d.uuid,
+					"url "+d.text+" NOT NULL",
+					"status "+d.integer+" NOT NULL",
+				),
+				d.createIndex("idx_webhook_endpoint_dbs_deleted_at", "webhook_endpoint_dbs", false, "deleted_at"),
+				d.createTable("webhook_notification_dbs",
+					"id "+d.primaryKey,
+					"created_at "+d.timestamp,
+					"updated_at "+d.timestamp,
+					"deleted_at "+d.timestamp,
+					"event_uuid "+d.uuid,
+					"topic "+d.text+" NOT NULL",
+					"body "+d.text+" NOT NULL",
+					"endpoint_uuid "+d.uuid,
+				),
+				d.createIndex("idx_webhook_notification_dbs_deleted_at", "webhook_notification_dbs", false, "deleted_at"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropTable("webhook_notification_dbs"),
+				d.dropTable("webhook_endpoint_dbs"),
+			}
+		},
+	},
+	{
+		Version:     2,
+		Description: "index endpoint and notification lookups",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.createIndex("idx_webhook_endpoint_dbs_uuid", "webhook_endpoint_dbs", true, "uuid"),
+				d.createIndex("idx_webhook_notification_dbs_endpoint_id", "webhook_notification_dbs", false, "endpoint_uuid", "id"),
+				d.createIndex("idx_webhook_notification_dbs_endpoint_created", "webhook_notification_dbs", false, "endpoint_uuid", "created_at"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropIndex("idx_webhook_notification_dbs_endpoint_created", "webhook_notification_dbs"),
+				d.dropIndex("idx_webhook_notification_dbs_endpoint_id", "webhook_notification_dbs"),
+				d.dropIndex("idx_webhook_endpoint_dbs_uuid", "webhook_endpoint_dbs"),
+			}
+		},
+		// Create didn't check for taken UUIDs before the unique index
+		Precheck: func(d sqlDialect) string {
+			return "SELECT uuid FROM webhook_endpoint_dbs WHERE uuid IS NOT NULL GROUP BY uuid HAVING COUNT(*) > 1"
+		},
+		Violation: ErrDuplicateEndpointUUIDs,
+	},
+	{
+		Version:     3,
+		Description: "record notification delivery outcomes",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_notification_dbs", "delivery_status "+d.integer+" DEFAULT 0 NOT NULL"),
+				d.addColumn("webhook_notification_dbs", "response_code "+d.integer+" DEFAULT 0 NOT NULL"),
+				d.createIndex("idx_webhook_notification_dbs_event", "webhook_notification_dbs", false, "event_uuid"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropIndex("idx_webhook_notification_dbs_event", "webhook_notification_dbs"),
+				d.dropColumn("webhook_notification_dbs", "response_code"),
+				d.dropColumn("webhook_notification_dbs", "delivery_status"),
+			}
+		},
+	},
+	{
+		Version:     4,
+		Description: "configurable notifications persistence",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "persistence_mode "+d.varchar+" DEFAULT '' NOT NULL"),
+				// rows saved until now hold the whole notification
+				d.addColumn("webhook_notification_dbs", "persistence_mode "+d.varchar+" DEFAULT 'full' NOT NULL"),
+				d.addColumn("webhook_notification_dbs", "body_hash "+d.varchar+" DEFAULT '' NOT NULL"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropColumn("webhook_notification_dbs", "body_hash"),
+				d.dropColumn("webhook_notification_dbs", "persistence_mode"),
+				d.dropColumn("webhook_endpoint_dbs", "persistence_mode"),
+			}
+		},
+	},
+	{
+		Version:     5,
+		Description: "encryption at rest",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "encryption_key_id "+d.varchar+" DEFAULT '' NOT NULL"),
+				d.addColumn("webhook_notification_dbs", "encryption_key_id "+d.varchar+" DEFAULT '' NOT NULL"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropColumn("webhook_notification_dbs", "encryption_key_id"),
+				d.dropColumn("webhook_endpoint_dbs", "encryption_key_id"),
+			}
+		},
+	},
+	{
+		Version:     6,
+		Description: "tenant ownership and quotas",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "tenant_id "+d.varchar+" DEFAULT '' NOT NULL"),
+				d.createIndex("idx_webhook_endpoint_dbs_tenant", "webhook_endpoint_dbs", false, "tenant_id"),
+				d.addColumn("webhook_notification_dbs", "tenant_id "+d.varchar+" DEFAULT '' NOT NULL"),
+				d.createIndex("idx_webhook_notification_dbs_tenant", "webhook_notification_dbs", false, "tenant_id", "id"),
+				d.createTable("webhook_tenant_quota_dbs",
+					"id "+d.primaryKey,
+					"created_at "+d.timestamp,
+					"updated_at "+d.timestamp,
+					"deleted_at "+d.timestamp,
+					"tenant_id "+d.varchar+" NOT NULL",
+					"max_endpoints "+d.integer+" NOT NULL",
+				),
+				d.createIndex("idx_webhook_tenant_quota_dbs_deleted_at", "webhook_tenant_quota_dbs", false, "deleted_at"),
+				d.createIndex("idx_webhook_tenant_quota_dbs_tenant", "webhook_tenant_quota_dbs", true, "tenant_id"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropTable("webhook_tenant_quota_dbs"),
+				d.dropIndex("idx_webhook_notification_dbs_tenant", "webhook_notification_dbs"),
+				d.dropColumn("webhook_notification_dbs", "tenant_id"),
+				d.dropIndex("idx_webhook_endpoint_dbs_tenant", "webhook_endpoint_dbs"),
+				d.dropColumn("webhook_endpoint_dbs", "tenant_id"),
+			}
+		},
+	},
+	{
+		Version:     7,
+		Description: "endpoint topic filters",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "include_topics "+d.text),
+				d.addColumn("webhook_endpoint_dbs", "exclude_topics "+d.text),
+				"UPDATE webhook_endpoint_dbs SET include_topics = '', exclude_topics = ''",
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropColumn("webhook_endpoint_dbs", "exclude_topics"),
+				d.dropColumn("webhook_endpoint_dbs", "include_topics"),
+			}
+		},
+	},
+	{
+		Version:     8,
+		Description: "endpoint description, labels and metadata",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "description "+d.text),
+				d.addColumn("webhook_endpoint_dbs", "metadata "+d.text),
+				"UPDATE webhook_endpoint_dbs SET description = '', metadata = ''",
+				d.createTable("webhook_endpoint_label_dbs",
+					"id "+d.primaryKey,
+					"endpoint_uuid "+d.uuid+" NOT NULL",
+					"label_key "+d.varchar+" NOT NULL",
+					"label_value "+d.varchar+" NOT NULL",
+				),
+				d.createIndex("idx_webhook_endpoint_label_dbs_endpoint", "webhook_endpoint_label_dbs", true, "endpoint_uuid", "label_key"),
+				d.createIndex("idx_webhook_endpoint_label_dbs_label", "webhook_endpoint_label_dbs", false, "label_key", "label_value"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropTable("webhook_endpoint_label_dbs"),
+				d.dropColumn("webhook_endpoint_dbs", "metadata"),
+				d.dropColumn("webhook_endpoint_dbs", "description"),
+			}
+		},
+	},
+	{
+		Version:     9,
+		Description: "endpoint custom headers",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.createTable("webhook_endpoint_header_dbs",
+					"id "+d.primaryKey,
+					"endpoint_uuid "+d.uuid+" NOT NULL",
+					"name "+d.varchar+" NOT NULL",
+					"value "+d.text+" NOT NULL",
+					"encryption_key_id "+d.varchar+" NOT NULL",
+				),
+				d.createIndex("idx_webhook_endpoint_header_dbs_endpoint", "webhook_endpoint_header_dbs", true, "endpoint_uuid", "name"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropTable("webhook_endpoint_header_dbs"),
+			}
+		},
+	},
+	{
+		Version:     10,
+		Description: "endpoint authentication",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "auth_type "+d.varchar+" DEFAULT '' NOT NULL"),
+				d.addColumn("webhook_endpoint_dbs", "auth_config "+d.text),
+				"UPDATE webhook_endpoint_dbs SET auth_config = ''",
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropColumn("webhook_endpoint_dbs", "auth_config"),
+				d.dropColumn("webhook_endpoint_dbs", "auth_type"),
+			}
+		},
+	},
+	{
+		Version:     11,
+		Description: "endpoint TLS settings",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "tls_config "+d.text),
+				d.addColumn("webhook_endpoint_dbs", "tls_encryption_key_id "+d.varchar+" DEFAULT '' NOT NULL"),
+				"UPDATE webhook_endpoint_dbs SET tls_config = ''",
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropColumn("webhook_endpoint_dbs", "tls_encryption_key_id"),
+				d.dropColumn("webhook_endpoint_dbs", "tls_config"),
+			}
+		},
+	},
+	{
+		Version:     12,
+		Description: "endpoint secrets and verification nonces",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "signing_secret "+d.text),
+				d.addColumn("webhook_endpoint_dbs", "signing_key_id "+d.varchar+" DEFAULT '' NOT NULL"),
+				"UPDATE webhook_endpoint_dbs SET signing_secret = ''",
+				d.createTable("webhook_verification_nonce_dbs",
+					"id "+d.primaryKey,
+					"endpoint_uuid "+d.uuid+" NOT NULL",
+					"nonce_hash "+d.varchar+" NOT NULL",
+					"created_at "+d.timestamp,
+					"expires_at "+d.timestamp+" NOT NULL",
+				),
+				d.createIndex("idx_webhook_verification_nonce_dbs_nonce", "webhook_verification_nonce_dbs", true, "nonce_hash"),
+				d.createIndex("idx_webhook_verification_nonce_dbs_expires_at", "webhook_verification_nonce_dbs", false, "expires_at"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropTable("webhook_verification_nonce_dbs"),
+				d.dropColumn("webhook_endpoint_dbs", "signing_key_id"),
+				d.dropColumn("webhook_endpoint_dbs", "signing_secret"),
+			}
+		},
+	},
+	{
+		Version:     13,
+		Description: "endpoint verification protocols",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "verification_config "+d.text),
+				"UPDATE webhook_endpoint_dbs SET verification_config = ''",
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropColumn("webhook_endpoint_dbs", "verification_config"),
+			}
+		},
+	},
+	{
+		Version:     14,
+		Description: "endpoint notification paths",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "notification_path "+d.varchar+" DEFAULT '' NOT NULL"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropColumn("webhook_endpoint_dbs", "notification_path"),
+			}
+		},
+	},
+	{
+		Version:     15,
+		Description: "background endpoint verification",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "confirmation_nonce "+d.varchar+" DEFAULT '' NOT NULL"),
+				d.addColumn("webhook_endpoint_dbs", "verification_pending_until "+d.timestamp),
+				d.addColumn("webhook_endpoint_dbs", "verification_attempts "+d.integer+" DEFAULT 0 NOT NULL"),
+				d.createIndex("idx_webhook_endpoint_dbs_confirmation", "webhook_endpoint_dbs", false, "confirmation_nonce"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropIndex("idx_webhook_endpoint_dbs_confirmation", "webhook_endpoint_dbs"),
+				d.dropColumn("webhook_endpoint_dbs", "verification_attempts"),
+				d.dropColumn("webhook_endpoint_dbs", "verification_pending_until"),
+				d.dropColumn("webhook_endpoint_dbs", "confirmation_nonce"),
+			}
+		},
+	},
+	{
+		Version:     16,
+		Description: "endpoint health checks",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "verified_at "+d.timestamp),
+				d.addColumn("webhook_endpoint_dbs", "last_checked_at "+d.timestamp),
+				d.addColumn("webhook_endpoint_dbs", "last_check "+d.varchar+" DEFAULT '' NOT NULL"),
+				d.addColumn("webhook_endpoint_dbs", "health_failures "+d.integer+" DEFAULT 0 NOT NULL"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropColumn("webhook_endpoint_dbs", "health_failures"),
+				d.dropColumn("webhook_endpoint_dbs", "last_check"),
+				d.dropColumn("webhook_endpoint_dbs", "last_checked_at"),
+				d.dropColumn("webhook_endpoint_dbs", "verified_at"),
+			}
+		},
+	},
+	{
+		Version:     17,
+		Description: "endpoint status history",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.createTable("webhook_endpoint_status_change_dbs",
+					"id "+d.primaryKey,
+					"endpoint_uuid "+d.uuid+" NOT NULL",
+					"from_status "+d.integer+" NOT NULL",
+					"to_status "+d.integer+" NOT NULL",
+					"actor "+d.varchar+" NOT NULL",
+					"reason "+d.varchar+" NOT NULL",
+					"created_at "+d.timestamp,
+				),
+				d.createIndex("idx_webhook_endpoint_status_change_dbs_endpoint", "webhook_endpoint_status_change_dbs", false, "endpoint_uuid"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropTable("webhook_endpoint_status_change_dbs"),
+			}
+		},
+	},
+	{
+		Version:     18,
+		Description: "paused endpoint deliveries",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "paused_at "+d.timestamp),
+				d.addColumn("webhook_endpoint_dbs", "paused_until "+d.timestamp),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropColumn("webhook_endpoint_dbs", "paused_until"),
+				d.dropColumn("webhook_endpoint_dbs", "paused_at"),
+			}
+		},
+	},
+	{
+		Version:     19,
+		Description: "tenant quota locks",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.createTable("webhook_tenant_lock_dbs",
+					"id "+d.primaryKey,
+					"tenant_id "+d.varchar+" NOT NULL",
+					"locked_at "+d.timestamp,
+				),
+				d.createIndex("idx_webhook_tenant_lock_dbs_tenant", "webhook_tenant_lock_dbs", true, "tenant_id"),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropTable("webhook_tenant_lock_dbs"),
+			}
+		},
+	},
+	{
+		Version:     20,
+		Description: "claims on flushing paused endpoints",
+		Up: func(d sqlDialect) []string {
+			return []string{
+				d.addColumn("webhook_endpoint_dbs", "flush_claimed_until "+d.timestamp),
+			}
+		},
+		Down: func(d sqlDialect) []string {
+			return []string{
+				d.dropColumn("webhook_endpoint_dbs", "flush_claimed_until"),
+			}
+		},
+	},
+}
+
+// Column types and DDL syntax of a database engine
+type sqlDialect struct {
+	engine     string
+	primaryKey string
+	timestamp  string
+	uuid       string
+	text       string
+	varchar    string
+	integer    string
+	boolean    string
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"sqlite": {
+		engine:     "sqlite",
+		primaryKey: "integer PRIMARY KEY AUTOINCREMENT",
+		timestamp:  "datetime",
+		uuid:       "text",
+		text:       "text",
+		varchar:    "text",
+		integer:    "integer",
+		boolean:    "numeric",
+	},
+	"postgres": {
+		engine:     "postgres",
+		primaryKey: "bigserial PRIMARY KEY",
+		timestamp:  "timestamptz",
+		uuid:       "uuid",
+		text:       "text",
+		varchar:    "varchar(255)",
+		integer:    "bigint",
+		boolean:    "boolean",
+	},
+	"mysql": {
+		engine:     "mysql",
+		primaryKey: "bigint unsigned AUTO_INCREMENT PRIMARY KEY",
+		timestamp:  "datetime(3)",
+		uuid:       "char(36)",
+		text:       "longtext",
+		varchar:    "varchar(255)",
+		integer:    "bigint",
+		boolean:    "boolean",
+	},
+	"sqlserver": {
+		engine:     "sqlserver",
+		primaryKey: "bigint IDENTITY(1,1) PRIMARY KEY",
+		timestamp:  "datetimeoffset",
+		uuid:       "nvarchar(36)",
+		text:       "nvarchar(MAX)",
+		varchar:    "nvarchar(255)",
+		integer:    "bigint",
+		boolean:    "bit",
+	},
+}
+
+func (d sqlDialect) createTable(table string, columns ...string) string {
+	return fmt.Sprintf(
+		"CREATE TABLE %s (\n\t%s\n)",
+		table, strings.Join(columns, ",\n\t"),
+	)
+}
+
+func (d sqlDialect) dropTable(table string) string {
+	return fmt.Sprintf("DROP TABLE %s", table)
+}
+
+func (d sqlDialect) addColumn(table, column string) string {
+	if d.engine == "sqlserver" {
+		return fmt.Sprintf("ALTER TABLE %s ADD %s", table, column)
+	}
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, column)
+}
+
+func (d sqlDialect) dropColumn(table, column string) string {
+	if d.engine == "sqlserver" {
+		// columns added with a DEFAULT hold on to a generated constraint
+		return fmt.Sprintf(
+			"DECLARE @df nvarchar(256); "+
+				"SELECT @df = name FROM sys.default_constraints "+
+				"WHERE parent_object_id = OBJECT_ID('%[1]s') "+
+				"AND parent_column_id = COLUMNPROPERTY(OBJECT_ID('%[1]s'), '%[2]s', 'ColumnId'); "+
+				"IF @df IS NOT NULL EXEC('ALTER TABLE %[1]s DROP CONSTRAINT ' + @df); "+
+				"ALTER TABLE %[1]s DROP COLUMN %[2]s",
+			table, column,
+		)
+	}
+	return fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, column)
+}
+
+func (d sqlDialect) createIndex(name, table string, unique bool, columns ...string) string {
+	kind := "INDEX"
+	if unique {
+		kind = "UNIQUE INDEX"
+	}
+	return fmt.Sprintf(
+		"CREATE %s %s ON %s (%s)",
+		kind, name, table, strings.Join(columns, ", "),
+	)
+}
+
+func (d sqlDialect) dropIndex(name, table string) string {
+	if d.engine == "mysql" || d.engine == "sqlserver" {
+		return fmt.Sprintf("DROP INDEX %s ON %s", name, table)
+	}
+	return fmt.Sprintf("DROP INDEX %s", name)
+}
+
+// Runs and records schema migrations against a single database
+type migrator struct {
+	db      *gorm.DB
+	dialect sqlDialect
+	log     *zap.Logger
+}
+
+func newMigrator(db *gorm.DB, engine string, log *zap.Logger) (*migrator, error) {
+	dialect, ok := sqlDialects[engine]
+	if !ok {
+		return nil, ErrUnsupportedDatabaseEngine
+	}
+	return &migrator{
+		db:      db,
+		dialect: dialect,
+		log:     log,
+	}, nil
+}
+
+// Creates the migrations table if needed.
+//
+// Databases created by earlier releases with AutoMigrate already hold
+// the tables of the first migration, so it's recorded as applied
+// instead of being run again.
+func (m *migrator) init() error {
+
+	if m.db.Migrator().HasTable(migrationsTable) {
+		return nil
+	}
+
+	err := m.db.Exec(
+		m.dialect.createTable(migrationsTable,
+			"version "+m.dialect.integer+" PRIMARY KEY",
+			"description "+m.dialect.varchar+" NOT NULL",
+			"applied_at "+m.dialect.timestamp,
+		),
+	).Error
+	if err != nil {
+		return err
+	}
+
+	if m.db.Migrator().HasTable("webhook_endpoint_dbs") {
+		m.log.Info("Found a schema created by AutoMigrate, recording it as migration 1")
+		return m.db.Create(&SchemaMigrationDB{
+			Version:     schemaMigrations[0].Version,
+			Description: schemaMigrations[0].Description,
+			AppliedAt:   time.Now(),
+		}).Error
+	}
+
+	return nil
+}
+
+// Returns the highest applied migration version, 0 for an empty database
+func (m *migrator) version() (int, error) {
+
+	if !m.db.Migrator().HasTable(migrationsTable) {
+		if m.db.Migrator().HasTable("webhook_endpoint_dbs") {
+			// created by AutoMigrate, see init
+			return schemaMigrations[0].Version, nil
+		}
+		return 0, nil
+	}
+
+	var applied []SchemaMigrationDB
+	tx := m.db.Order("version desc").Limit(1).Find(&applied)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	if len(applied) == 0 {
+		return 0, nil
+	}
+	return applied[0].Version, nil
+}
+
+// Migrations with a version above the current one, in ascending order
+func (m *migrator) pending() ([]schemaMigration, error) {
+
+	current, err := m.version()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []schemaMigration
+	for _, migration := range sortedMigrations() {
+		if migration.Version > current {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Applies all pending migrations, each one in its own transaction
+func (m *migrator) up() error {
+
+	err := m.init()
+	if err != nil {
+		return err
+	}
+
+	pending, err := m.pending()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range pending {
+		m.log.Info(
+			"Applying database migration",
+			zap.Int("Version", migration.Version),
+			zap.String("Description", migration.Description),
+		)
+		err = m.db.Transaction(func(tx *gorm.DB) error {
+			err := m.precheck(tx, migration)
+			if err != nil {
+				return err
+			}
+			for _, statement := range migration.Up(m.dialect) {
+				err := tx.Exec(statement).Error
+				if err != nil {
+					return err
+				}
+			}
+			return tx.Create(&SchemaMigrationDB{
+				Version:     migration.Version,
+				Description: migration.Description,
+				AppliedAt:   time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %w", migration.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// Stops the migration if its precheck finds anything
+func (m *migrator) precheck(tx *gorm.DB, migration schemaMigration) error {
+
+	if migration.Precheck == nil {
+		return nil
+	}
+
+	var found []string
+	err := tx.Raw(migration.Precheck(m.dialect)).Scan(&found).Error
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return nil
+	}
+
+	m.log.Error(
+		"Database migration precheck failed",
+		zap.Int("Version", migration.Version),
+		zap.Strings("Found", found),
+	)
+	const listed = 10
+	if len(found) > listed {
+		found = append(found[:listed], fmt.Sprintf("and %d more", len(found)-listed))
+	}
+	return fmt.Errorf("found %s: %w", strings.Join(found, ", "), migration.Violation)
+}
+
+// Reverts applied migrations, newest first, until the schema is at
+// the target version.
+//
+// MySQL commits DDL statements implicitly, so there a migration failing
+// halfway isn't rolled back, the statements before the failing one stay.
+func (m *migrator) down(target int) error {
+
+	if target < 0 || target > latestMigrationVersion() {
+		return ErrUnknownMigrationVersion
+	}
+
+	err := m.init()
+	if err != nil {
+		return err
+	}
+
+	current, err := m.version()
+	if err != nil {
+		return err
+	}
+	if target > current {
+		return ErrMigrationTargetAhead
+	}
+
+	migrations := sortedMigrations()
+	for i := len(migrations) - 1; i >= 0; i-- {
+
+		migration := migrations[i]
+		if migration.Version > current || migration.Version <= target {
+			continue
+		}
+
+		m.log.Info(
+			"Reverting database migration",
+			zap.Int("Version", migration.Version),
+			zap.String("Description", migration.Description),
+		)
+		err = m.db.Transaction(func(tx *gorm.DB) error {
+			for _, statement := range migration.Down(m.dialect) {
+				err := tx.Exec(statement).Error
+				if err != nil {
+					return err
+				}
+			}
+			return tx.Delete(&SchemaMigrationDB{}, migration.Version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("reverting migration %d failed: %w", migration.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// Prints the SQL of all pending migrations without running any of it
+func (m *migrator) dryRun(w io.Writer) error {
+
+	pending, err := m.pending()
+	if err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		_, err = fmt.Fprintf(w, "-- %s: schema is up to date\n", m.dialect.engine)
+		return err
+	}
+
+	for _, migration := range pending {
+		_, err = fmt.Fprintf(
+			w, "-- %s: migration %d, %s\n",
+			m.dialect.engine, migration.Version, migration.Description,
+		)
+		if err != nil {
+			return err
+		}
+		if migration.Precheck != nil {
+			_, err = fmt.Fprintf(w, "-- must return no rows first: %s;\n", migration.Precheck(m.dialect))
+			if err != nil {
+				return err
+			}
+		}
+		for _, statement := range migration.Up(m.dialect) {
+			_, err = fmt.Fprintf(w, "%s;\n", statement)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintln(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sortedMigrations() []schemaMigration {
+	migrations := make([]schemaMigration, len(schemaMigrations))
+	copy(migrations, schemaMigrations)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations
+}
+
+func latestMigrationVersion() int {
+	migrations := sortedMigrations()
+	return migrations[len(migrations)-1].Version
+}
+
+var ErrUnknownMigrationVersion error = errors.New(
+	`
+	cant migrate to the requested schema version.
+	Recover by retrying with a version between 0 and the latest migration
+	`,
+)
+var ErrMigrationTargetAhead error = errors.New(
+	`
+	cant migrate down to a version the schema hasnt reached yet, nothing was reverted.
+	Recover by retrying with a version at or below service.SchemaVersion(),
+	or by calling service.Migrate() to move the schema up
+	`,
+)
+var ErrDuplicateEndpointUUIDs error = errors.New(
+	`
+	cant add the unique index on endpoint UUIDs, some endpoints share one.
+	Recover by giving all but one of the endpoints listed a new UUID,
+	or erasing them, and migrating again
+	`,
+)
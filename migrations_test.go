@@ -0,0 +1,236 @@
+package ironhook
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Migrate -> MigrateDown -> DryRun -> Migrate
+func Test_MigrateUpDownFlow(t *testing.T) {
+
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := svc.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latestMigrationVersion() {
+		t.Fatal("Expected schema version ", latestMigrationVersion(), " found ", version)
+	}
+
+	// typos are refused rather than ignored
+	err = svc.MigrateDown(latestMigrationVersion() + 1)
+	if err != ErrUnknownMigrationVersion {
+		t.Fatal("Expected ErrUnknownMigrationVersion, got ", err)
+	}
+
+	err = svc.MigrateDown(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.MigrateDown(1)
+	if err != ErrMigrationTargetAhead {
+		t.Fatal("Expected ErrMigrationTargetAhead below the target, got ", err)
+	}
+
+	version, err = svc.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Fatal("Expected an empty schema after migrating down, found version ", version)
+	}
+
+	var plan bytes.Buffer
+	err = svc.DryRunMigrations(&plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(plan.String(), "CREATE TABLE webhook_endpoint_dbs") {
+		t.Fatal("Expected the dry run to print the pending SQL, got ", plan.String())
+	}
+
+	// dry run must not touch the schema
+	version, err = svc.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Fatal("Expected the dry run to leave the schema alone, found version ", version)
+	}
+
+	err = svc.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = svc.Create(
+		WebhookEndpoint{
+			URL: "http://localhost:8080",
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_AutoMigrateDisabled(t *testing.T) {
+
+	t.Setenv("HOOK_DB_AUTO_MIGRATE", "false")
+
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := svc.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Fatal("Expected no migrations to run, found version ", version)
+	}
+
+	err = svc.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err = svc.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latestMigrationVersion() {
+		t.Fatal("Expected schema version ", latestMigrationVersion(), " found ", version)
+	}
+}
+
+// Models as they were when the schema was managed by AutoMigrate
+type legacyWebhookEndpointDB struct {
+	gorm.Model
+	UUID   uuid.UUID             `gorm:"type:uuid"`
+	URL    string                `gorm:"not null"`
+	Status WebhookEndpointStatus `gorm:"not null"`
+}
+
+func (legacyWebhookEndpointDB) TableName() string {
+	return "webhook_endpoint_dbs"
+}
+
+type legacyWebhookNotificationDB struct {
+	gorm.Model
+	EventUUID    uuid.UUID `gorm:"type:uuid"`
+	Topic        string    `gorm:"not null"`
+	Body         string    `gorm:"not null"`
+	EndpointUUID uuid.UUID `gorm:"type:uuid"`
+}
+
+func (legacyWebhookNotificationDB) TableName() string {
+	return "webhook_notification_dbs"
+}
+
+// Databases created with AutoMigrate by earlier releases
+func Test_MigrateFromAutoMigrate(t *testing.T) {
+
+	db, err := databaseConnection("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AutoMigrate(
+		&legacyWebhookEndpointDB{},
+		&legacyWebhookNotificationDB{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := newMigrator(db, "sqlite", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.up()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := m.version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latestMigrationVersion() {
+		t.Fatal("Expected schema version ", latestMigrationVersion(), " found ", version)
+	}
+}
+
+func Test_sqlDialects(t *testing.T) {
+
+	for engine, dialect := range sqlDialects {
+		for _, migration := range schemaMigrations {
+			if len(migration.Up(dialect)) == 0 || len(migration.Down(dialect)) == 0 {
+				t.Errorf("migration %d has no statements for %s", migration.Version, engine)
+			}
+		}
+	}
+}
+
+// Create didn't stop duplicate UUIDs before migration 2
+func Test_MigrateDuplicateUUIDs(t *testing.T) {
+
+	db, err := databaseConnection("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(
+		&legacyWebhookEndpointDB{},
+		&legacyWebhookNotificationDB{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := uuid.Must(uuid.NewV4())
+	for i := 0; i < 2; i++ {
+		err = db.Create(&legacyWebhookEndpointDB{UUID: shared, URL: "https://example.com"}).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := newMigrator(db, "sqlite", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.up()
+	if !errors.Is(err, ErrDuplicateEndpointUUIDs) || !strings.Contains(err.Error(), shared.String()) {
+		t.Fatal("Expected ErrDuplicateEndpointUUIDs listing the UUID, got ", err)
+	}
+	version, err := m.version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Fatal("Expected the schema to stay at version 1, found ", version)
+	}
+
+	// after the recovery
+	err = db.Model(&legacyWebhookEndpointDB{}).Where("id = ?", 2).Update("uuid", uuid.Must(uuid.NewV4())).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.up()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
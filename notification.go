@@ -1,10 +1,24 @@
 package ironhook
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/gofrs/uuid"
 	"gorm.io/gorm"
 )
 
+type DeliveryStatus int
+
+const (
+	// recorded before delivery outcomes were tracked
+	DeliveryUnknown DeliveryStatus = iota
+	Delivered
+	DeliveryFailed
+	// waiting for a paused endpoint, see service.Pause()
+	DeliveryPending
+)
+
 type WebhookNotification struct {
 	EventUUID uuid.UUID `json:"event_uuid"`
 	Topic     string    `json:"topic"`
@@ -17,4 +31,67 @@ type WebhookNotificationDB struct {
 	Topic        string    `gorm:"not null"`
 	Body         string    `gorm:"not null"`
 	EndpointUUID uuid.UUID `gorm:"type:uuid"`
+	// outcome of the delivery
+	DeliveryStatus DeliveryStatus `gorm:"not null"`
+	// 0 when the endpoint couldn't be reached
+	ResponseCode int `gorm:"not null"`
+	// SHA-256 of the body, kept even when the body isn't
+	BodyHash        string          `gorm:"not null"`
+	PersistenceMode PersistenceMode `gorm:"not null"`
+	// master key the body is encrypted with, empty for plaintext
+	EncryptionKeyID string `gorm:"not null"`
+	// tenant of the endpoint at the time of sending
+	TenantID string `gorm:"not null"`
+}
+
+// associated data of encrypted notification bodies
+const notificationBodyColumn = "webhook_notification_dbs.body"
+
+// bodies are bound to the endpoint and the notification's ID,
+// so they're encrypted once the notification is saved
+func notificationBinding(db_notification *WebhookNotificationDB) binding {
+	return binding{
+		column: notificationBodyColumn,
+		row:    fmt.Sprintf("%s/%d", db_notification.EndpointUUID, db_notification.ID),
+	}
+}
+
+// A sent notification as recorded in the notifications history
+type WebhookNotificationRecord struct {
+	ID             uint           `json:"id"`
+	EndpointUUID   uuid.UUID      `json:"endpoint_uuid"`
+	EventUUID      uuid.UUID      `json:"event_uuid"`
+	Topic          string         `json:"topic"`
+	Body           string         `json:"body"`
+	DeliveryStatus DeliveryStatus `json:"delivery_status"`
+	ResponseCode   int            `json:"response_code"`
+	SentAt         time.Time      `json:"sent_at"`
+	// Body is empty unless the notification was persisted in full
+	PersistenceMode PersistenceMode `json:"persistence_mode"`
+	BodyHash        string          `json:"body_hash"`
+	TenantID        string          `json:"tenant_id,omitempty"`
+}
+
+func notificationDbToRecord(dbn *WebhookNotificationDB) *WebhookNotificationRecord {
+	return &WebhookNotificationRecord{
+		ID:              dbn.ID,
+		EndpointUUID:    dbn.EndpointUUID,
+		EventUUID:       dbn.EventUUID,
+		Topic:           dbn.Topic,
+		Body:            dbn.Body,
+		DeliveryStatus:  dbn.DeliveryStatus,
+		ResponseCode:    dbn.ResponseCode,
+		SentAt:          dbn.CreatedAt,
+		PersistenceMode: dbn.PersistenceMode,
+		BodyHash:        dbn.BodyHash,
+		TenantID:        dbn.TenantID,
+	}
+}
+
+func notificationsDbToRecords(dbns *[]WebhookNotificationDB) []WebhookNotificationRecord {
+	records := make([]WebhookNotificationRecord, len(*dbns))
+	for i, n := range *dbns {
+		records[i] = *notificationDbToRecord(&n)
+	}
+	return records
 }
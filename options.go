@@ -0,0 +1,24 @@
+package ironhook
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Customises the service beyond what the HOOK_* environment variables cover.
+//
+// service, err := ironhook.NewWebhookService(nil, ironhook.WithKeyProvider(kms))
+type ServiceOption func(*WebhookEndpointServiceImpl)
+
+// Encrypts sensitive values with data keys wrapped by the provider,
+// takes precedence over HOOK_ENCRYPTION_KEY and HOOK_ENCRYPTION_KEY_FILE
+func WithKeyProvider(provider KeyProvider) ServiceOption {
+	return func(s *WebhookEndpointServiceImpl) {
+		s.cipher.keys = provider
+	}
+}
+
+// Adds the service metrics to the registerer, like prometheus.DefaultRegisterer,
+// on top of service.MetricsHandler()
+func WithMetrics(registerer prometheus.Registerer) ServiceOption {
+	return func(s *WebhookEndpointServiceImpl) {
+		s.metrics.registerer = registerer
+	}
+}
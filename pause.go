@@ -0,0 +1,464 @@
+package ironhook
+
+import (
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Stops sending to the endpoint without losing notifications, say during
+// the receiver's maintenance window. Notify keeps them as DeliveryPending,
+// and they're sent in order once the endpoint is resumed, by service.Resume()
+// or when until passes. A nil until pauses until service.Resume().
+//
+// Unlike suspension, pausing doesn't change the endpoint status, and
+// health checks leave paused endpoints alone.
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) Pause(endpoint WebhookEndpoint, until *time.Time) (WebhookEndpoint, error) {
+
+	now := time.Now()
+	if until != nil && !until.After(now) {
+		return endpoint, ErrInvalidPause
+	}
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+	if model_endpoint.Status == Disabled {
+		return endpoint, ErrEndpointDisabled
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		current, err := lockPause(tx, model_endpoint)
+		if err != nil {
+			return err
+		}
+		// pausing again only moves the end of the pause
+		model_endpoint.PausedAt = current.PausedAt
+		if model_endpoint.PausedAt == nil {
+			model_endpoint.PausedAt = &now
+		}
+		model_endpoint.PausedUntil = until
+
+		return tx.Model(model_endpoint).UpdateColumns(map[string]interface{}{
+			"paused_at":    model_endpoint.PausedAt,
+			"paused_until": model_endpoint.PausedUntil,
+		}).Error
+	})
+	if err != nil {
+		s.log.Error("couldnt pause an endpoint", zap.Error(err))
+		return endpoint, err
+	}
+
+	s.log.Info(
+		"paused deliveries to an endpoint",
+		zap.String("UUID", endpoint.UUID.String()),
+		zap.String("Actor", s.actor),
+		zap.Timep("Until", until),
+	)
+	return *endpointDbToWeb(model_endpoint), nil
+}
+
+// part of service.Resume(), sends the pending notifications and lifts the pause
+func (s *WebhookEndpointServiceImpl) resumeDeliveries(endpoint WebhookEndpoint, reason string) (WebhookEndpoint, error) {
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+	if model_endpoint.Status == Disabled {
+		return endpoint, ErrEndpointDisabled
+	}
+	if !model_endpoint.Status.verified() {
+		// pending notifications wait for the endpoint to be verified again
+		return endpoint, ErrEndpointNotYetActivated
+	}
+
+	s.log.Info(
+		"resuming deliveries to an endpoint",
+		zap.String("UUID", endpoint.UUID.String()),
+		zap.String("Actor", s.actor),
+		zap.String("Reason", reason),
+	)
+
+	err = s.unpause(model_endpoint, false)
+	if err != nil {
+		return endpoint, err
+	}
+	return *endpointDbToWeb(model_endpoint), nil
+}
+
+// how long a claim on sending the pending notifications lasts,
+// renewed with every notification sent
+const flushClaimTTL = 5 * time.Minute
+
+// Sends the pending notifications, and lifts the pause once they're all out.
+// An unreachable endpoint stays paused with the rest still pending.
+//
+// One call at a time sends them, whichever service instance it runs on,
+// the others get ErrResumeInProgress. With expired_only, only pauses
+// which are over are lifted.
+func (s *WebhookEndpointServiceImpl) unpause(model_endpoint *WebhookEndpointDB, expired_only bool) error {
+
+	claimed, err := s.claimFlush(model_endpoint, expired_only)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		current, err := s.currentPause(model_endpoint)
+		if err != nil {
+			return err
+		}
+		if current.PausedAt == nil || (expired_only && !current.pauseOver(time.Now())) {
+			// resumed, or paused for longer, in the meantime
+			model_endpoint.PausedAt, model_endpoint.PausedUntil = current.PausedAt, current.PausedUntil
+			return nil
+		}
+		return ErrResumeInProgress
+	}
+
+	for {
+		err := s.flushPending(model_endpoint)
+		if err != nil {
+			s.releaseFlush(model_endpoint)
+			return err
+		}
+		done, err := s.liftPause(model_endpoint, expired_only)
+		if err != nil {
+			s.releaseFlush(model_endpoint)
+			return err
+		}
+		if done {
+			return nil
+		}
+		// more were queued while the last ones were being sent
+	}
+}
+
+// Claims sending the endpoint's pending notifications, unless another call
+// holds the claim. Claims of calls which went away run out after a while.
+func (s *WebhookEndpointServiceImpl) claimFlush(model_endpoint *WebhookEndpointDB, expired_only bool) (bool, error) {
+
+	now := time.Now()
+	tx := s.db.Model(&WebhookEndpointDB{}).
+		Where("id = ? AND paused_at IS NOT NULL", model_endpoint.ID).
+		Where("flush_claimed_until IS NULL OR flush_claimed_until < ?", now)
+	if expired_only {
+		tx = tx.Where("paused_until <= ?", now)
+	}
+	tx = tx.UpdateColumn("flush_claimed_until", now.Add(flushClaimTTL))
+	if tx.Error != nil {
+		s.log.Error("couldnt claim the pending notifications of an endpoint", zap.Error(tx.Error))
+		return false, tx.Error
+	}
+	return tx.RowsAffected == 1, nil
+}
+
+func (s *WebhookEndpointServiceImpl) renewFlush(model_endpoint *WebhookEndpointDB) error {
+	tx := s.db.Model(&WebhookEndpointDB{}).
+		Where("id = ?", model_endpoint.ID).
+		UpdateColumn("flush_claimed_until", time.Now().Add(flushClaimTTL))
+	if tx.Error != nil {
+		s.log.Error("couldnt renew the claim on the pending notifications", zap.Error(tx.Error))
+	}
+	return tx.Error
+}
+
+func (s *WebhookEndpointServiceImpl) releaseFlush(model_endpoint *WebhookEndpointDB) {
+	tx := s.db.Model(&WebhookEndpointDB{}).
+		Where("id = ?", model_endpoint.ID).
+		UpdateColumn("flush_claimed_until", nil)
+	if tx.Error != nil {
+		// runs out on its own
+		s.log.Warn("couldnt release the claim on the pending notifications", zap.Error(tx.Error))
+	}
+}
+
+// Lifts the pause, unless more notifications were queued in the meantime.
+// Returns whether the flush is done, with the pause lifted or, with
+// expired_only, the pause moved past now.
+func (s *WebhookEndpointServiceImpl) liftPause(model_endpoint *WebhookEndpointDB, expired_only bool) (bool, error) {
+
+	done, lifted := false, false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		current, err := lockPause(tx, model_endpoint)
+		if err != nil {
+			return err
+		}
+
+		columns := map[string]interface{}{"flush_claimed_until": nil}
+		if expired_only && !current.pauseOver(time.Now()) {
+			// paused for longer while the pending ones were sent
+			done = true
+			return tx.Model(model_endpoint).UpdateColumns(columns).Error
+		}
+
+		var pending int64
+		err = tx.Model(&WebhookNotificationDB{}).
+			Where("endpoint_uuid = ? AND delivery_status = ?", model_endpoint.UUID, DeliveryPending).
+			Count(&pending).
+			Error
+		if err != nil || pending > 0 {
+			return err
+		}
+
+		done, lifted = true, true
+		columns["paused_at"] = nil
+		columns["paused_until"] = nil
+		return tx.Model(model_endpoint).UpdateColumns(columns).Error
+	})
+	if err != nil {
+		s.log.Error("couldnt lift the pause of an endpoint", zap.Error(err))
+		return false, err
+	}
+	if lifted {
+		model_endpoint.PausedAt = nil
+		model_endpoint.PausedUntil = nil
+	}
+	return done, nil
+}
+
+// Notify's side of a pause: keeps the notification for later while paused,
+// or lifts the pause if it's over. Returns whether the notification was kept.
+func (s *WebhookEndpointServiceImpl) queueIfPaused(model_endpoint *WebhookEndpointDB, notification WebhookNotification) (bool, error) {
+
+	// the pause as it's saved, rather than as the endpoint was loaded
+	current, err := s.currentPause(model_endpoint)
+	if err != nil {
+		return false, err
+	}
+	if current.PausedAt == nil {
+		return false, nil
+	}
+	model_endpoint.PausedAt, model_endpoint.PausedUntil = current.PausedAt, current.PausedUntil
+
+	if current.pauseOver(time.Now()) {
+		err := s.unpause(model_endpoint, true)
+		if err == nil && model_endpoint.PausedAt == nil {
+			return false, nil
+		}
+		if err != nil && err != ErrResumeInProgress {
+			s.log.Warn("couldnt resume an endpoint whose pause is over", zap.Error(err))
+		}
+	}
+
+	queued := false
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		// the pause can't be lifted before this one is saved
+		current, err := lockPause(tx, model_endpoint)
+		if err != nil || current.PausedAt == nil {
+			return err
+		}
+		queued = true
+		return s.queueNotification(tx, *endpointDbToWeb(model_endpoint), notification)
+	})
+	if err != nil {
+		s.log.Error("couldnt queue a notification for a paused endpoint", zap.Error(err))
+		return false, err
+	}
+	return queued, nil
+}
+
+// Locks the endpoint's row until the transaction ends, and returns the pause
+// as it's saved. Queueing notifications, pausing and lifting a pause take
+// turns this way, across service instances too.
+func lockPause(tx *gorm.DB, model_endpoint *WebhookEndpointDB) (WebhookEndpointDB, error) {
+
+	err := tx.Model(&WebhookEndpointDB{}).
+		Where("id = ?", model_endpoint.ID).
+		UpdateColumn("paused_at", gorm.Expr("paused_at")).
+		Error
+	if err != nil {
+		return WebhookEndpointDB{}, err
+	}
+
+	var current WebhookEndpointDB
+	err = tx.Select("paused_at", "paused_until").First(&current, model_endpoint.ID).Error
+	return current, err
+}
+
+// the pause as it's saved, rather than as the endpoint was loaded
+func (s *WebhookEndpointServiceImpl) currentPause(model_endpoint *WebhookEndpointDB) (WebhookEndpointDB, error) {
+	var current WebhookEndpointDB
+	tx := s.db.Select("paused_at", "paused_until").First(&current, model_endpoint.ID)
+	if tx.Error != nil {
+		s.log.Error("couldnt fetch the pause of an endpoint", zap.Error(tx.Error))
+	}
+	return current, tx.Error
+}
+
+func (m WebhookEndpointDB) pauseOver(now time.Time) bool {
+	return m.PausedAt != nil && m.PausedUntil != nil && !now.Before(*m.PausedUntil)
+}
+
+// Saves the notification as DeliveryPending. The body is kept whatever the
+// persistence mode, until the notification is sent.
+func (s *WebhookEndpointServiceImpl) queueNotification(db *gorm.DB, endpoint WebhookEndpoint, notification WebhookNotification) error {
+
+	err := s.saveNotificationRow(db, &WebhookNotificationDB{
+		EventUUID:       notification.EventUUID,
+		Topic:           notification.Topic,
+		Body:            notification.Body,
+		EndpointUUID:    endpoint.UUID,
+		DeliveryStatus:  DeliveryPending,
+		BodyHash:        hashNotificationBody(notification.Body),
+		PersistenceMode: s.persistenceFor(endpoint.PersistenceMode),
+		TenantID:        endpoint.TenantID,
+	})
+	if err != nil {
+		s.log.Error("couldnt save a pending notification", zap.Error(err))
+	}
+	return err
+}
+
+// Sends the pending notifications of the endpoint, oldest first.
+// Stops at the first one the endpoint couldn't be reached for,
+// the ones it answered with an error are DeliveryFailed like with Notify.
+func (s *WebhookEndpointServiceImpl) flushPending(model_endpoint *WebhookEndpointDB) error {
+
+	var after uint
+	for {
+		var batch []WebhookNotificationDB
+		tx := s.db.
+			Where("endpoint_uuid = ? AND delivery_status = ? AND id > ?", model_endpoint.UUID, DeliveryPending, after).
+			Order("id").
+			Limit(rowBatchSize).
+			Find(&batch)
+		if tx.Error != nil {
+			s.log.Error("couldnt fetch pending notifications", zap.Error(tx.Error))
+			return tx.Error
+		}
+
+		for i := range batch {
+			pending := &batch[i]
+			err := s.renewFlush(model_endpoint)
+			if err != nil {
+				return err
+			}
+			encrypted_body, key_id := pending.Body, pending.EncryptionKeyID
+			err = s.decryptNotification(pending)
+			if err != nil {
+				return err
+			}
+
+			response_code, err := s.deliver(model_endpoint, WebhookNotification{
+				EventUUID: pending.EventUUID,
+				Topic:     pending.Topic,
+				Body:      pending.Body,
+			})
+			if err != nil && response_code == 0 {
+				s.log.Warn(
+					"couldnt send a pending notification, the endpoint stays paused",
+					zap.String("UUID", model_endpoint.UUID.String()),
+					zap.Error(err),
+				)
+				return err
+			}
+
+			delivery_status := Delivered
+			if err != nil {
+				delivery_status = DeliveryFailed
+			}
+			pending.Body, pending.EncryptionKeyID = encrypted_body, key_id
+			err = s.settlePending(pending, delivery_status, response_code)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(batch) < rowBatchSize {
+			return nil
+		}
+		after = batch[len(batch)-1].ID
+	}
+}
+
+// records the delivery of a pending notification,
+// as much of it as its persistence mode allows
+func (s *WebhookEndpointServiceImpl) settlePending(pending *WebhookNotificationDB, status DeliveryStatus, response_code int) error {
+
+	if pending.PersistenceMode == PersistNothing {
+		tx := s.db.Unscoped().Delete(pending)
+		if tx.Error != nil {
+			s.log.Error("couldnt delete a sent notification", zap.Error(tx.Error))
+		}
+		return tx.Error
+	}
+
+	columns := map[string]interface{}{
+		"delivery_status": status,
+		"response_code":   response_code,
+		// sent now rather than when it was queued
+		"created_at": time.Now(),
+	}
+	if pending.PersistenceMode == PersistMetadata {
+		columns["body"] = ""
+		columns["encryption_key_id"] = ""
+	}
+
+	tx := s.db.Model(pending).UpdateColumns(columns)
+	if tx.Error != nil {
+		s.log.Error("couldnt save a sent notification", zap.Error(tx.Error))
+	}
+	return tx.Error
+}
+
+// Resumes endpoints whose pause is over, in case nothing
+// is sent to them in the meantime
+func (s *WebhookEndpointServiceImpl) resumeExpiredPauses() error {
+
+	var expired []WebhookEndpointDB
+	tx := s.db.
+		Where("paused_until <= ? AND status IN ?", time.Now(), []WebhookEndpointStatus{Verified, Healthy}).
+		Order("id").
+		Find(&expired)
+	if tx.Error != nil {
+		s.log.Error("couldnt fetch endpoints to resume", zap.Error(tx.Error))
+		return tx.Error
+	}
+
+	for i := range expired {
+		// one at a time, an unreachable endpoint doesn't hold up the others
+		s.resumeExpiredPause(&expired[i])
+	}
+	return nil
+}
+
+func (s *WebhookEndpointServiceImpl) resumeExpiredPause(model_endpoint *WebhookEndpointDB) {
+
+	err := s.unpause(model_endpoint, true)
+	if err != nil || model_endpoint.PausedAt != nil {
+		// tried again next time
+		return
+	}
+	s.log.Info("resumed an endpoint whose pause is over", zap.String("UUID", model_endpoint.UUID.String()))
+}
+
+func (s *WebhookEndpointServiceImpl) startPauseWatch(interval time.Duration) {
+
+	s.log.Info("Starting the paused endpoints watch", zap.Duration("Interval", interval))
+
+	s.runPeriodically(interval, func() {
+		err := s.resumeExpiredPauses()
+		if err != nil {
+			s.log.Error("Failed resuming paused endpoints", zap.Error(err))
+		}
+	})
+}
+
+var ErrResumeInProgress error = errors.New(
+	`
+	the pending notifications of the endpoint are being sent by another call.
+	Recover by waiting for it, the pause is lifted once theyre all sent
+	`,
+)
+var ErrInvalidPause error = errors.New(
+	`
+	cant pause an endpoint until a time thats already passed.
+	Recover by retrying with a time in the future, or nil to pause until service.Resume()
+	`,
+)
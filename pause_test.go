@@ -0,0 +1,381 @@
+package ironhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keeps the bodies of the notifications it receives, in order,
+// and drops the connection while down
+type recordingReceiver struct {
+	mu       sync.Mutex
+	down     bool
+	received []string
+}
+
+func (r *recordingReceiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	if strings.Contains(request.URL.Path, "/verification") {
+		VerificationHandler(w, request)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.down {
+		panic(http.ErrAbortHandler)
+	}
+	var notification WebhookNotification
+	_ = json.NewDecoder(request.Body).Decode(&notification)
+	r.received = append(r.received, notification.Body)
+}
+
+func (r *recordingReceiver) setDown(down bool) {
+	r.mu.Lock()
+	r.down = down
+	r.mu.Unlock()
+}
+
+func (r *recordingReceiver) bodies() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(r.received, ",")
+}
+
+func countPendingForTests(t *testing.T, svc WebhookEndpointService, endpoint WebhookEndpoint) int64 {
+	return countNotifications(t, svc, NotificationQuery{
+		EndpointUUID:     endpoint.UUID,
+		DeliveryStatuses: []DeliveryStatus{DeliveryPending},
+	})
+}
+
+func Test_PauseAndResume(t *testing.T) {
+
+	receiver := &recordingReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	endpoint := newVerifiedEndpointForTests(t, svc, server.URL)
+	endpoint, err = svc.Pause(endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.PausedAt == nil || endpoint.PausedUntil != nil {
+		t.Fatal("Expected the endpoint to be paused until resumed")
+	}
+
+	for i := 1; i <= 3; i++ {
+		err = svc.Notify(endpoint, WebhookNotification{Body: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if receiver.bodies() != "" || countPendingForTests(t, svc, endpoint) != 3 {
+		t.Fatal("Expected the notifications to wait for the endpoint, received ", receiver.bodies())
+	}
+	_, err = svc.LastNotificationSent(endpoint)
+	if err != ErrRecordNotFound {
+		t.Fatal("Expected nothing sent yet, got ", err)
+	}
+
+	// still in maintenance
+	receiver.setDown(true)
+	_, err = svc.Resume(endpoint, "")
+	if err == nil {
+		t.Fatal("Expected an unreachable endpoint to stay paused")
+	}
+	endpoint, err = svc.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.PausedAt == nil || countPendingForTests(t, svc, endpoint) != 3 {
+		t.Fatal("Expected the endpoint to stay paused with its notifications pending")
+	}
+
+	receiver.setDown(false)
+	endpoint, err = svc.Resume(endpoint, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.PausedAt != nil || receiver.bodies() != "1,2,3" || countPendingForTests(t, svc, endpoint) != 0 {
+		t.Fatal("Expected the pending notifications to be sent in order, received ", receiver.bodies())
+	}
+	delivered := countNotifications(t, svc, NotificationQuery{
+		EndpointUUID:     endpoint.UUID,
+		DeliveryStatuses: []DeliveryStatus{Delivered},
+	})
+	if delivered != 3 {
+		t.Fatal("Expected 3 delivered notifications, found ", delivered)
+	}
+
+	err = svc.Notify(endpoint, WebhookNotification{Body: "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiver.bodies() != "1,2,3,4" {
+		t.Fatal("Expected notifications to be sent right away again, received ", receiver.bodies())
+	}
+
+	past := time.Now().Add(-time.Minute)
+	_, err = svc.Pause(endpoint, &past)
+	if err != ErrInvalidPause {
+		t.Fatal("Expected ErrInvalidPause, got ", err)
+	}
+}
+
+func Test_PauseUntil(t *testing.T) {
+
+	t.Setenv("HOOK_NOTIFICATION_PERSISTENCE", "none")
+	t.Setenv("HOOK_PAUSE_CHECK_INTERVAL", "20ms")
+
+	receiver := &recordingReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	endpoint := newVerifiedEndpointForTests(t, svc, server.URL)
+
+	// the next notification goes after the pending ones
+	until := time.Now().Add(50 * time.Millisecond)
+	_, err = svc.Pause(endpoint, &until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Notify(endpoint, WebhookNotification{Body: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); receiver.bodies() == "" && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+	if receiver.bodies() != "1" {
+		t.Fatal("Expected the endpoint to be resumed once the pause is over, received ", receiver.bodies())
+	}
+
+	// nothing kept once sent, like the persistence mode says,
+	// the receiver may get it a moment before it's settled
+	kept := func() int64 {
+		return countNotifications(t, svc, NotificationQuery{EndpointUUID: endpoint.UUID})
+	}
+	for deadline := time.Now().Add(5 * time.Second); kept() != 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+	if kept() != 0 {
+		t.Fatal("Expected no notifications to be kept")
+	}
+
+	endpoint, err = svc.Disable(endpoint, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.Pause(endpoint, nil)
+	if err != ErrEndpointDisabled {
+		t.Fatal("Expected ErrEndpointDisabled, got ", err)
+	}
+}
+
+// holds on to notifications until released
+type stuckReceiver struct {
+	arrived chan struct{}
+	release chan struct{}
+}
+
+func (r *stuckReceiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	if strings.Contains(request.URL.Path, "/verification") {
+		VerificationHandler(w, request)
+		return
+	}
+	r.arrived <- struct{}{}
+	<-r.release
+}
+
+func Test_PausedEndpointsDontWaitOnEachOther(t *testing.T) {
+
+	stuck := &stuckReceiver{arrived: make(chan struct{}, 1), release: make(chan struct{})}
+	stuck_server := httptest.NewServer(stuck)
+	defer stuck_server.Close()
+
+	generic_svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	slow := newVerifiedEndpointForTests(t, svc, stuck_server.URL)
+	other := newVerifiedEndpointForTests(t, svc, stuck_server.URL+"/other")
+	for _, endpoint := range []WebhookEndpoint{slow, other} {
+		_, err = svc.Pause(endpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = svc.Notify(slow, WebhookNotification{Body: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := make(chan error, 1)
+	go func() {
+		_, err := svc.Resume(slow, "")
+		resumed <- err
+	}()
+	<-stuck.arrived
+
+	// the other endpoint doesn't wait for the slow one to be flushed
+	done := make(chan error, 1)
+	go func() {
+		done <- svc.Notify(other, WebhookNotification{Body: "2"})
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the notification to be queued while another endpoint is flushed")
+	}
+	if countPendingForTests(t, svc, other) != 1 {
+		t.Fatal("Expected the notification to wait for the endpoint")
+	}
+
+	close(stuck.release)
+	err = <-resumed
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored WebhookEndpointDB
+	svc.db.Where("uuid = ?", slow.UUID).First(&stored)
+	if stored.PausedAt != nil || stored.FlushClaimedUntil != nil {
+		t.Fatal("Expected the pause lifted and the claim released, found ", stored.PausedAt, stored.FlushClaimedUntil)
+	}
+}
+
+// paused after Notify loaded the endpoint, but before it sent anything
+func Test_PauseWhileNotifying(t *testing.T) {
+
+	receiver := &recordingReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint := newVerifiedEndpointForTests(t, svc, server.URL)
+	arm := afterEndpointFetchForTests(t, svc)
+	arm(func() {
+		_, err := svc.Pause(endpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	err = svc.Notify(endpoint, WebhookNotification{Body: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiver.bodies() != "" || countPendingForTests(t, svc, endpoint) != 1 {
+		t.Fatal("Expected the notification to wait for the pause, received ", receiver.bodies())
+	}
+}
+
+// holds on to the first notification until released, records them all
+type gatedReceiver struct {
+	recordingReceiver
+	arrived chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (r *gatedReceiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	if !strings.Contains(request.URL.Path, "/verification") {
+		r.once.Do(func() {
+			r.arrived <- struct{}{}
+			<-r.release
+		})
+	}
+	r.recordingReceiver.ServeHTTP(w, request)
+}
+
+// two services on one database, like two instances of an app
+func Test_ResumeAcrossServices(t *testing.T) {
+
+	t.Setenv("HOOK_DB_DSN", filepath.Join(t.TempDir(), "hooks.db"))
+
+	receiver := &gatedReceiver{arrived: make(chan struct{}, 1), release: make(chan struct{})}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	var services []*WebhookEndpointServiceImpl
+	for i := 0; i < 2; i++ {
+		svc, err := NewWebhookService(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer svc.Close()
+		services = append(services, svc.(*WebhookEndpointServiceImpl))
+	}
+	first, second := services[0], services[1]
+
+	endpoint := newVerifiedEndpointForTests(t, first, server.URL)
+	_, err := first.Pause(endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = first.Notify(endpoint, WebhookNotification{Body: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := make(chan error, 1)
+	go func() {
+		_, err := first.Resume(endpoint, "")
+		resumed <- err
+	}()
+	<-receiver.arrived
+
+	// the other instance queues behind the flush, and doesn't start one of its own
+	err = second.Notify(endpoint, WebhookNotification{Body: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = second.Resume(endpoint, "")
+	if err != ErrResumeInProgress {
+		t.Fatal("Expected ErrResumeInProgress, got ", err)
+	}
+
+	close(receiver.release)
+	err = <-resumed
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiver.bodies() != "1,2" || countPendingForTests(t, second, endpoint) != 0 {
+		t.Fatal("Expected both notifications in order, received ", receiver.bodies())
+	}
+
+	stored, err := second.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.PausedAt != nil {
+		t.Fatal("Expected the pause to be lifted")
+	}
+}
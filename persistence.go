@@ -0,0 +1,52 @@
+package ironhook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// Decides how much of a sent notification is saved to the database.
+//
+// Notification bodies can carry personal data, use PersistMetadata
+// or PersistNothing if you'd rather not keep them around.
+type PersistenceMode string
+
+const (
+	// Endpoints use the service-wide mode, HOOK_NOTIFICATION_PERSISTENCE
+	PersistDefault PersistenceMode = ""
+	// Everything, including the body
+	PersistFull PersistenceMode = "full"
+	// Event UUID, topic, endpoint, outcome and a SHA-256 hash of the body
+	PersistMetadata PersistenceMode = "metadata"
+	// No record at all, history APIs won't know about the notification
+	PersistNothing PersistenceMode = "none"
+)
+
+func (m PersistenceMode) valid() bool {
+	switch m {
+	case PersistDefault, PersistFull, PersistMetadata, PersistNothing:
+		return true
+	}
+	return false
+}
+
+// The endpoint's own mode, or the service-wide one if it has none
+func (s *WebhookEndpointServiceImpl) persistenceFor(endpoint_mode PersistenceMode) PersistenceMode {
+	if endpoint_mode != PersistDefault {
+		return endpoint_mode
+	}
+	return s.persistence
+}
+
+func hashNotificationBody(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+var ErrUnsupportedPersistenceMode error = errors.New(
+	`
+	cant accept this notifications persistence mode.
+	Recover by retrying with one of: full, metadata, none
+	`,
+)
@@ -0,0 +1,94 @@
+package ironhook
+
+import (
+	"testing"
+
+	"github.com/gofrs/uuid"
+)
+
+func Test_PersistenceModes(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	t.Setenv("HOOK_NOTIFICATION_PERSISTENCE", "metadata")
+
+	svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	_, err = svc.Create(
+		WebhookEndpoint{
+			URL:             server.URL,
+			PersistenceMode: "everything",
+		},
+	)
+	if err != ErrUnsupportedPersistenceMode {
+		t.Fatal("Expected ErrUnsupportedPersistenceMode, got ", err)
+	}
+
+	metadata := newVerifiedEndpointForTests(t, svc, server.URL)
+	full, err := svc.SetPersistenceMode(newVerifiedEndpointForTests(t, svc, server.URL), PersistFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nothing, err := svc.SetPersistenceMode(newVerifiedEndpointForTests(t, svc, server.URL), PersistNothing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notification := WebhookNotification{
+		EventUUID: uuid.Must(uuid.NewV4()),
+		Topic:     "customer.registered",
+		Body:      `{"email": "someone@example.com"}`,
+	}
+	for _, endpoint := range []WebhookEndpoint{metadata, full, nothing} {
+		err = svc.Notify(endpoint, notification)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// metadata only
+	page, err := svc.ListNotifications(NotificationQuery{EndpointUUID: metadata.UUID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Notifications) != 1 {
+		t.Fatal("Expected one notification, found ", len(page.Notifications))
+	}
+	record := page.Notifications[0]
+	if record.Body != "" || record.PersistenceMode != PersistMetadata {
+		t.Fatal("Expected the body not to be persisted, found ", record)
+	}
+	if record.BodyHash != hashNotificationBody(notification.Body) || record.EventUUID != notification.EventUUID {
+		t.Fatal("Expected the metadata to be persisted, found ", record)
+	}
+
+	// in full
+	last, err := svc.LastNotificationSent(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Body != notification.Body {
+		t.Fatal("Expected the body to be persisted, found ", last.Body)
+	}
+
+	// nothing at all
+	_, err = svc.LastNotificationSent(nothing)
+	if err != ErrRecordNotFound {
+		t.Fatal("Expected ErrRecordNotFound, got ", err)
+	}
+}
+
+func Test_UnsupportedPersistenceConfig(t *testing.T) {
+
+	t.Setenv("HOOK_NOTIFICATION_PERSISTENCE", "sometimes")
+
+	_, err := NewWebhookService(nil)
+	if err != ErrUnsupportedPersistenceMode {
+		t.Fatal("Expected ErrUnsupportedPersistenceMode, got ", err)
+	}
+}
@@ -0,0 +1,302 @@
+package ironhook
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gorm.io/gorm"
+)
+
+type EndpointOrder string
+
+const (
+	OrderByID        EndpointOrder = "id"
+	OrderByCreatedAt EndpointOrder = "created_at"
+	OrderByUpdatedAt EndpointOrder = "updated_at"
+	OrderByURL       EndpointOrder = "url"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+	// rows loaded at once by bulk operations
+	rowBatchSize = 500
+)
+
+// Filters, ordering and pagination for service.ListEndpointsWithQuery()
+//
+// Zero values don't filter anything, so an empty query lists
+// all the endpoints, a page at a time.
+type EndpointQuery struct {
+	// Only endpoints in one of these statuses
+	Statuses []WebhookEndpointStatus
+	// Only endpoints with this host in the URL, port excluded
+	URLHost string
+	// Only endpoints of this tenant, tenant views are always limited to their own
+	TenantID string
+	// Only endpoints with all of these labels
+	Labels map[string]string
+	// Only endpoints with this text in the description, case-insensitive
+	DescriptionContains string
+
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+
+	// Defaults to OrderByID
+	OrderBy    EndpointOrder
+	Descending bool
+
+	// Defaults to 50, can't exceed 1000
+	PageSize int
+	// NextCursor of the previous page, empty for the first page
+	Cursor string
+}
+
+type EndpointPage struct {
+	Endpoints []WebhookEndpoint `json:"endpoints"`
+	// Empty on the last page
+	NextCursor string `json:"next_cursor"`
+	// Number of endpoints matching the filters, across all pages
+	TotalCount int64 `json:"total_count"`
+}
+
+// Filters and pagination for service.ListNotifications()
+//
+// Zero values don't filter anything. Notifications are listed
+// in the order they were sent.
+type NotificationQuery struct {
+	// Tenant views are always limited to their own
+	TenantID         string
+	EndpointUUID     uuid.UUID
+	EventUUID        uuid.UUID
+	Topic            string
+	DeliveryStatuses []DeliveryStatus
+
+	SentAfter  time.Time
+	SentBefore time.Time
+
+	// Newest first
+	Descending bool
+
+	// Defaults to 50, can't exceed 1000
+	PageSize int
+	// NextCursor of the previous page, empty for the first page
+	Cursor string
+}
+
+type NotificationPage struct {
+	Notifications []WebhookNotificationRecord `json:"notifications"`
+	// Empty on the last page
+	NextCursor string `json:"next_cursor"`
+	// Number of notifications matching the filters, across all pages
+	TotalCount int64 `json:"total_count"`
+}
+
+func (q NotificationQuery) filter(tx *gorm.DB) *gorm.DB {
+
+	if q.TenantID != "" {
+		tx = tx.Where("tenant_id = ?", q.TenantID)
+	}
+	if q.EndpointUUID != uuid.Nil {
+		tx = tx.Where("endpoint_uuid = ?", q.EndpointUUID)
+	}
+	if q.EventUUID != uuid.Nil {
+		tx = tx.Where("event_uuid = ?", q.EventUUID)
+	}
+	if q.Topic != "" {
+		tx = tx.Where("topic = ?", q.Topic)
+	}
+	if len(q.DeliveryStatuses) > 0 {
+		tx = tx.Where("delivery_status IN ?", q.DeliveryStatuses)
+	}
+
+	if !q.SentAfter.IsZero() {
+		tx = tx.Where("created_at > ?", q.SentAfter)
+	}
+	if !q.SentBefore.IsZero() {
+		tx = tx.Where("created_at < ?", q.SentBefore)
+	}
+
+	return tx
+}
+
+func (q NotificationQuery) validate() NotificationQuery {
+
+	if q.PageSize <= 0 {
+		q.PageSize = defaultPageSize
+	}
+	if q.PageSize > maxPageSize {
+		q.PageSize = maxPageSize
+	}
+
+	return q
+}
+
+func (q EndpointQuery) filter(tx *gorm.DB) *gorm.DB {
+
+	if len(q.Statuses) > 0 {
+		tx = tx.Where("status IN ?", q.Statuses)
+	}
+
+	if q.TenantID != "" {
+		tx = tx.Where("tenant_id = ?", q.TenantID)
+	}
+
+	for _, label := range labelsToDb(uuid.Nil, q.Labels) {
+		tx = tx.Where(
+			"EXISTS (SELECT 1 FROM webhook_endpoint_label_dbs WHERE webhook_endpoint_label_dbs.endpoint_uuid = webhook_endpoint_dbs.uuid AND label_key = ? AND label_value = ?)",
+			label.LabelKey, label.LabelValue,
+		)
+	}
+
+	if q.DescriptionContains != "" {
+		tx = tx.Where(
+			"LOWER(description) LIKE ? ESCAPE '!'",
+			"%"+escapeLike(strings.ToLower(q.DescriptionContains))+"%",
+		)
+	}
+
+	if q.URLHost != "" {
+		// scheme://host followed by the end of the URL, a port, path or query
+		host := "%://" + escapeLike(strings.ToLower(q.URLHost))
+		tx = tx.Where(
+			"(LOWER(url) LIKE ? ESCAPE '!' OR LOWER(url) LIKE ? ESCAPE '!' OR LOWER(url) LIKE ? ESCAPE '!' OR LOWER(url) LIKE ? ESCAPE '!')",
+			host, host+":%", host+"/%", host+"?%",
+		)
+	}
+
+	if !q.CreatedAfter.IsZero() {
+		tx = tx.Where("created_at > ?", q.CreatedAfter)
+	}
+	if !q.CreatedBefore.IsZero() {
+		tx = tx.Where("created_at < ?", q.CreatedBefore)
+	}
+	if !q.UpdatedAfter.IsZero() {
+		tx = tx.Where("updated_at > ?", q.UpdatedAfter)
+	}
+	if !q.UpdatedBefore.IsZero() {
+		tx = tx.Where("updated_at < ?", q.UpdatedBefore)
+	}
+
+	return tx
+}
+
+func (q EndpointQuery) validate() (EndpointQuery, error) {
+
+	switch q.OrderBy {
+	case "":
+		q.OrderBy = OrderByID
+	case OrderByID, OrderByCreatedAt, OrderByUpdatedAt, OrderByURL:
+	default:
+		return q, ErrUnsupportedOrdering
+	}
+
+	if q.PageSize <= 0 {
+		q.PageSize = defaultPageSize
+	}
+	if q.PageSize > maxPageSize {
+		q.PageSize = maxPageSize
+	}
+
+	return q, nil
+}
+
+// Applies keyset pagination after the row identified by the cursor,
+// with the row ID breaking ties of the ordering column.
+func paginate(tx *gorm.DB, table string, column string, descending bool, cursor string, page_size int) (*gorm.DB, error) {
+
+	direction, comparison := "ASC", ">"
+	if descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		if column == "id" {
+			tx = tx.Where("id "+comparison+" ?", after)
+		} else {
+			// the next page starts after the cursor row's sort value,
+			// without the row there's nothing to start after
+			var found int64
+			err := tx.Session(&gorm.Session{NewDB: true}).Table(table).Where("id = ?", after).Count(&found).Error
+			if err != nil {
+				return nil, err
+			}
+			if found == 0 {
+				return nil, ErrInvalidCursor
+			}
+
+			sort_value := fmt.Sprintf("(SELECT %s FROM %s WHERE id = ?)", column, table)
+			tx = tx.Where(
+				fmt.Sprintf(
+					"(%s %s %s OR (%s = %s AND id %s ?))",
+					column, comparison, sort_value, column, sort_value, comparison,
+				),
+				after, after, after,
+			)
+		}
+	}
+
+	if column != "id" {
+		tx = tx.Order(column + " " + direction)
+	}
+
+	// one extra row tells if there's a next page
+	return tx.Order("id " + direction).Limit(page_size + 1), nil
+}
+
+// Cursors are opaque to callers, they only carry the ID of the last row
+func encodeCursor(id uint) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(strconv.FormatUint(uint64(id), 10)),
+	)
+}
+
+func decodeCursor(cursor string) (uint, error) {
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+
+	id, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+
+	return uint(id), nil
+}
+
+// escapes LIKE wildcards, to be used with ESCAPE '!'
+func escapeLike(value string) string {
+	return strings.NewReplacer(
+		"!", "!!",
+		"%", "!%",
+		"_", "!_",
+	).Replace(value)
+}
+
+var ErrInvalidCursor error = errors.New(
+	`
+	cant understand the pagination cursor, or the row it points at
+	has been erased since.
+	Recover by retrying with the NextCursor of a previous page or without one
+	`,
+)
+var ErrUnsupportedOrdering error = errors.New(
+	`
+	cant order the results by the requested field.
+	Recover by retrying with one of the documented orderings
+	`,
+)
@@ -0,0 +1,215 @@
+package ironhook
+
+import (
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// How long notifications are kept in the database.
+// Zero values keep notifications forever.
+type RetentionPolicy struct {
+	// Delivered notifications older than this are deleted
+	MaxAge time.Duration
+	// Failed notifications older than this are deleted,
+	// defaults to MaxAge
+	FailedMaxAge time.Duration
+	// Only the newest notifications of every endpoint are kept,
+	// older failed ones are kept for FailedMaxAge
+	MaxRowsPerEndpoint int
+}
+
+func retentionBatchSizeFromConfig() int {
+	batch_size := viper.GetInt("retention_batch_size")
+	if batch_size <= 0 {
+		return 1000
+	}
+	return batch_size
+}
+
+func retentionPolicyFromConfig() RetentionPolicy {
+	return RetentionPolicy{
+		MaxAge:             viper.GetDuration("retention_max_age"),
+		FailedMaxAge:       viper.GetDuration("retention_failed_max_age"),
+		MaxRowsPerEndpoint: viper.GetInt("retention_max_rows_per_endpoint"),
+	}
+}
+
+func (p RetentionPolicy) enabled() bool {
+	return p.MaxAge > 0 || p.FailedMaxAge > 0 || p.MaxRowsPerEndpoint > 0
+}
+
+// Hard-deletes all notifications sent before the given time,
+// regardless of the retention policy. Returns the number of deleted notifications.
+func (s *WebhookEndpointServiceImpl) Purge(before time.Time) (int64, error) {
+
+	if err := s.allTenantsOnly(); err != nil {
+		return 0, err
+	}
+
+	deleted, err := s.deleteNotificationsInBatches(func(tx *gorm.DB) *gorm.DB {
+		// not sent yet, see service.Pause()
+		return tx.Where("created_at < ? AND delivery_status <> ?", before, DeliveryPending)
+	})
+	if err != nil {
+		return deleted, err
+	}
+
+	s.log.Info(
+		"Purged notifications",
+		zap.Time("Before", before),
+		zap.Int64("Deleted", deleted),
+	)
+	return deleted, nil
+}
+
+// Applies the retention policy once, run periodically by the janitor
+func (s *WebhookEndpointServiceImpl) enforceRetention() (int64, error) {
+
+	policy := s.retention
+	var total int64
+
+	failed_max_age := policy.FailedMaxAge
+	if failed_max_age == 0 {
+		failed_max_age = policy.MaxAge
+	}
+
+	if policy.MaxAge > 0 {
+		cutoff := time.Now().Add(-policy.MaxAge)
+		deleted, err := s.deleteNotificationsInBatches(func(tx *gorm.DB) *gorm.DB {
+			return tx.Where("created_at < ? AND delivery_status NOT IN ?", cutoff, []DeliveryStatus{DeliveryFailed, DeliveryPending})
+		})
+		total += deleted
+		if err != nil {
+			return total, err
+		}
+	}
+
+	if failed_max_age > 0 {
+		cutoff := time.Now().Add(-failed_max_age)
+		deleted, err := s.deleteNotificationsInBatches(func(tx *gorm.DB) *gorm.DB {
+			return tx.Where("created_at < ? AND delivery_status = ?", cutoff, DeliveryFailed)
+		})
+		total += deleted
+		if err != nil {
+			return total, err
+		}
+	}
+
+	if policy.MaxRowsPerEndpoint > 0 {
+		deleted, err := s.enforceMaxRowsPerEndpoint(policy.MaxRowsPerEndpoint)
+		total += deleted
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+func (s *WebhookEndpointServiceImpl) enforceMaxRowsPerEndpoint(max_rows int) (int64, error) {
+
+	var over_limit []uuid.UUID
+	tx := s.db.Unscoped().
+		Model(&WebhookNotificationDB{}).
+		Group("endpoint_uuid").
+		Having("COUNT(*) > ?", max_rows).
+		Pluck("endpoint_uuid", &over_limit)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+
+	var total int64
+	for _, endpoint_uuid := range over_limit {
+
+		// everything older than the newest max_rows notifications
+		var newest []uint
+		tx = s.db.Unscoped().
+			Model(&WebhookNotificationDB{}).
+			Where("endpoint_uuid = ?", endpoint_uuid).
+			Order("id DESC").
+			Limit(max_rows).
+			Pluck("id", &newest)
+		if tx.Error != nil {
+			return total, tx.Error
+		}
+		if len(newest) < max_rows {
+			continue
+		}
+		oldest_kept := newest[len(newest)-1]
+
+		deleted, err := s.deleteNotificationsInBatches(func(tx *gorm.DB) *gorm.DB {
+			// failures are left to FailedMaxAge, like for MaxAge
+			return tx.Where("endpoint_uuid = ? AND id < ? AND delivery_status NOT IN ?", endpoint_uuid, oldest_kept, []DeliveryStatus{DeliveryFailed, DeliveryPending})
+		})
+		total += deleted
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// Hard-deletes matching notifications a batch at a time,
+// so large deletions don't lock the table for long.
+func (s *WebhookEndpointServiceImpl) deleteNotificationsInBatches(scope func(*gorm.DB) *gorm.DB) (int64, error) {
+
+	var total int64
+	for {
+		var ids []uint
+		tx := scope(s.db.Unscoped().Model(&WebhookNotificationDB{})).
+			Order("id").
+			Limit(s.retentionBatchSize).
+			Pluck("id", &ids)
+		if tx.Error != nil {
+			s.log.Error("couldnt select notifications for deletion", zap.Error(tx.Error))
+			return total, tx.Error
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+
+		tx = s.db.Unscoped().Delete(&WebhookNotificationDB{}, ids)
+		if tx.Error != nil {
+			s.log.Error("couldnt delete notifications", zap.Error(tx.Error))
+			return total, tx.Error
+		}
+		total += tx.RowsAffected
+
+		if len(ids) < s.retentionBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// Runs the retention policy in the background until the service is closed
+func (s *WebhookEndpointServiceImpl) startJanitor(interval time.Duration) {
+
+	if interval <= 0 {
+		s.log.Warn("Unusable retention interval, falling back to an hour", zap.Duration("Interval", interval))
+		interval = time.Hour
+	}
+
+	s.log.Info(
+		"Starting the notifications janitor",
+		zap.Duration("Interval", interval),
+		zap.Duration("MaxAge", s.retention.MaxAge),
+		zap.Duration("FailedMaxAge", s.retention.FailedMaxAge),
+		zap.Int("MaxRowsPerEndpoint", s.retention.MaxRowsPerEndpoint),
+	)
+
+	s.runPeriodically(interval, func() {
+		deleted, err := s.enforceRetention()
+		if err != nil {
+			s.log.Error("Failed enforcing the retention policy", zap.Error(err))
+			return
+		}
+		if deleted > 0 {
+			s.log.Info("Deleted expired notifications", zap.Int64("Deleted", deleted))
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package ironhook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// notifies the endpoint and backdates the notification
+func notifyAt(t *testing.T, svc *WebhookEndpointServiceImpl, endpoint WebhookEndpoint, sent_at time.Time) {
+
+	err := svc.Notify(
+		endpoint,
+		WebhookNotification{
+			EventUUID: uuid.Must(uuid.NewV4()),
+		},
+	)
+	if err != nil && err != ErrFailedNotifyingTheEndpoint {
+		t.Fatal(err)
+	}
+
+	var last WebhookNotificationDB
+	tx := svc.db.Last(&last)
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+	tx = svc.db.Model(&last).UpdateColumn("created_at", sent_at)
+	if tx.Error != nil {
+		t.Fatal(tx.Error)
+	}
+}
+
+func newVerifiedEndpointForTests(t *testing.T, svc WebhookEndpointService, url string) WebhookEndpoint {
+
+	endpoint, err := svc.Create(
+		WebhookEndpoint{
+			URL: url,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified_endpoint, err := svc.Verify(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verified_endpoint
+}
+
+func countNotifications(t *testing.T, svc WebhookEndpointService, query NotificationQuery) int64 {
+	page, err := svc.ListNotifications(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return page.TotalCount
+}
+
+func Test_RetentionPolicy(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	t.Setenv("HOOK_RETENTION_MAX_AGE", "24h")
+	t.Setenv("HOOK_RETENTION_FAILED_MAX_AGE", "72h")
+	t.Setenv("HOOK_RETENTION_MAX_ROWS_PER_ENDPOINT", "3")
+	t.Setenv("HOOK_RETENTION_BATCH_SIZE", "2")
+
+	generic_svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	healthy := newVerifiedEndpointForTests(t, svc, server.URL)
+	failing := newVerifiedEndpointForTests(t, svc, server.URL+"/failing")
+
+	now := time.Now()
+	// expired
+	notifyAt(t, svc, healthy, now.Add(-48*time.Hour))
+	// failures are kept for longer
+	notifyAt(t, svc, failing, now.Add(-48*time.Hour))
+	// expired failure
+	notifyAt(t, svc, failing, now.Add(-96*time.Hour))
+	// recent, over the per endpoint limit
+	for i := 0; i < 5; i++ {
+		notifyAt(t, svc, healthy, now.Add(-time.Duration(5-i)*time.Minute))
+	}
+
+	deleted, err := svc.enforceRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 4 {
+		t.Fatal("Expected 4 deleted notifications, found ", deleted)
+	}
+
+	if n := countNotifications(t, svc, NotificationQuery{EndpointUUID: healthy.UUID}); n != 3 {
+		t.Fatal("Expected 3 notifications left for the healthy endpoint, found ", n)
+	}
+	if n := countNotifications(t, svc, NotificationQuery{EndpointUUID: failing.UUID}); n != 1 {
+		t.Fatal("Expected 1 notification left for the failing endpoint, found ", n)
+	}
+}
+
+// the per endpoint limit doesnt cut failures short
+func Test_MaxRowsKeepsFailures(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	t.Setenv("HOOK_RETENTION_FAILED_MAX_AGE", "72h")
+	t.Setenv("HOOK_RETENTION_MAX_ROWS_PER_ENDPOINT", "2")
+
+	generic_svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	failing := newVerifiedEndpointForTests(t, svc, server.URL+"/failing")
+
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		notifyAt(t, svc, failing, now.Add(-time.Duration(4-i)*time.Hour))
+	}
+
+	deleted, err := svc.enforceRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 0 {
+		t.Fatal("Expected failures within FailedMaxAge to be kept, deleted ", deleted)
+	}
+	if n := countNotifications(t, svc, NotificationQuery{EndpointUUID: failing.UUID}); n != 4 {
+		t.Fatal("Expected 4 notifications left for the failing endpoint, found ", n)
+	}
+}
+
+func Test_Purge(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint := newVerifiedEndpointForTests(t, svc, server.URL)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		notifyAt(t, svc, endpoint, now.Add(-time.Duration(i+1)*time.Hour))
+	}
+	notifyAt(t, svc, endpoint, now)
+
+	deleted, err := svc.Purge(now.Add(-30 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 3 {
+		t.Fatal("Expected 3 purged notifications, found ", deleted)
+	}
+	if n := countNotifications(t, svc, NotificationQuery{}); n != 1 {
+		t.Fatal("Expected 1 notification left, found ", n)
+	}
+}
+
+func Test_JanitorRunsInBackground(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	t.Setenv("HOOK_RETENTION_MAX_AGE", "1h")
+	t.Setenv("HOOK_RETENTION_INTERVAL", "10ms")
+
+	generic_svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint := newVerifiedEndpointForTests(t, svc, server.URL)
+	notifyAt(t, svc, endpoint, time.Now().Add(-2*time.Hour))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for countNotifications(t, svc, NotificationQuery{}) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the janitor to delete the expired notification")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = svc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
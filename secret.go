@@ -0,0 +1,195 @@
+package ironhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// associated data of encrypted endpoint secrets
+const endpointSecretColumn = "webhook_endpoint_dbs.signing_secret"
+
+// tells ironhook secrets apart in config files and logs
+const secretPrefix = "ihsec_"
+
+// set by ironhook on the requests it signs
+const (
+	SignatureHeader = "X-Ironhook-Signature"
+	TimestampHeader = "X-Ironhook-Timestamp"
+)
+
+func newEndpointSecret() string {
+	return secretPrefix + hex.EncodeToString(randomBytes(32))
+}
+
+// hex encoded HMAC-SHA256 of the message
+func hmacHex(secret string, message []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(message)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// What an endpoint answers a VerificationChallenge with
+func ChallengeResponse(secret, nonce string) string {
+	return hmacHex(secret, []byte(nonce))
+}
+
+// "v1=" and the HMAC of "<timestamp>.<payload>"
+func signature(secret, timestamp string, payload []byte) string {
+	return "v1=" + hmacHex(secret, append([]byte(timestamp+"."), payload...))
+}
+
+func signRequest(request *http.Request, secret string, payload []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	request.Header.Set(TimestampHeader, timestamp)
+	request.Header.Set(SignatureHeader, signature(secret, timestamp, payload))
+}
+
+// For receivers, checks the X-Ironhook-Signature and X-Ironhook-Timestamp
+// headers of a request against the endpoint secret. The payload is the
+// request body, or the nonce or challenge of GET verification requests.
+//
+// Requests signed longer than tolerance ago are refused, so captured
+// requests can't be replayed later on.
+func VerifySignature(secret string, header http.Header, payload []byte, tolerance time.Duration) error {
+
+	timestamp := header.Get(TimestampHeader)
+	signed_at, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	age := time.Since(time.Unix(signed_at, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrInvalidSignature
+	}
+
+	expected := signature(secret, timestamp, payload)
+	for _, candidate := range strings.Split(header.Get(SignatureHeader), ",") {
+		if hmac.Equal([]byte(strings.TrimSpace(candidate)), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// Replaces the endpoint secret with a new one. The secret is only handed
+// back here and by Create, keep it for the receiver.
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) RotateSecret(endpoint WebhookEndpoint) (WebhookEndpoint, error) {
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+
+	secret := newEndpointSecret()
+	err = s.encryptSecret(model_endpoint, secret)
+	if err != nil {
+		return endpoint, err
+	}
+
+	s.log.Info("rotating the endpoint secret", zap.String("UUID", endpoint.UUID.String()))
+
+	tx := s.db.Model(model_endpoint).UpdateColumns(map[string]interface{}{
+		"signing_secret": model_endpoint.SigningSecret,
+		"signing_key_id": model_endpoint.SigningKeyID,
+	})
+	if tx.Error != nil {
+		s.log.Error("couldnt save the endpoint secret", zap.Error(tx.Error))
+		return endpoint, tx.Error
+	}
+
+	web_endpoint := endpointDbToWeb(model_endpoint)
+	web_endpoint.Secret = secret
+	return *web_endpoint, nil
+}
+
+// sets the secret columns of the endpoint
+func (s *WebhookEndpointServiceImpl) encryptSecret(model_endpoint *WebhookEndpointDB, secret string) error {
+
+	encrypted, key_id, err := s.cipher.encrypt(secret, binding{endpointSecretColumn, model_endpoint.UUID.String()})
+	if err != nil {
+		s.log.Error("couldnt encrypt the endpoint secret", zap.Error(err))
+		return err
+	}
+	model_endpoint.SigningSecret = encrypted
+	model_endpoint.SigningKeyID = key_id
+	return nil
+}
+
+// empty for endpoints created before secrets
+func (s *WebhookEndpointServiceImpl) decryptSecret(model_endpoint *WebhookEndpointDB) (string, error) {
+
+	secret, err := s.cipher.decrypt(model_endpoint.SigningSecret, model_endpoint.SigningKeyID, binding{endpointSecretColumn, model_endpoint.UUID.String()})
+	if err != nil {
+		s.log.Error(
+			"couldnt decrypt the endpoint secret",
+			zap.String("UUID", model_endpoint.UUID.String()),
+			zap.Error(err),
+		)
+	}
+	return secret, err
+}
+
+// part of service.ReEncrypt()
+func (s *WebhookEndpointServiceImpl) reEncryptEndpointSecrets(current string) (int64, error) {
+
+	var total int64
+	var after uint
+	for {
+		var batch []WebhookEndpointDB
+		tx := s.db.Unscoped().
+			Where("id > ? AND signing_key_id <> ? AND signing_secret <> ''", after, current).
+			Order("id").
+			Limit(rowBatchSize).
+			Find(&batch)
+		if tx.Error != nil {
+			s.log.Error("couldnt fetch endpoints for re-encryption", zap.Error(tx.Error))
+			return total, tx.Error
+		}
+
+		for i := range batch {
+			secret, err := s.decryptSecret(&batch[i])
+			if err != nil {
+				return total, err
+			}
+			err = s.encryptSecret(&batch[i], secret)
+			if err != nil {
+				return total, err
+			}
+			tx = s.db.Unscoped().
+				Model(&batch[i]).
+				UpdateColumns(map[string]interface{}{
+					"signing_secret": batch[i].SigningSecret,
+					"signing_key_id": batch[i].SigningKeyID,
+				})
+			if tx.Error != nil {
+				s.log.Error("couldnt save a re-encrypted endpoint", zap.Error(tx.Error))
+				return total, tx.Error
+			}
+			total++
+		}
+
+		if len(batch) < rowBatchSize {
+			break
+		}
+		after = batch[len(batch)-1].ID
+	}
+	return total, nil
+}
+
+var ErrInvalidSignature error = errors.New(
+	`
+	the request signature doesnt match, or was made too long ago.
+	Recover by checking the receiver uses the current endpoint secret,
+	and that its clock is in sync
+	`,
+)
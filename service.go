@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gofrs/uuid"
@@ -17,23 +18,86 @@ import (
 type WebhookEndpointService interface {
 	Create(WebhookEndpoint) (WebhookEndpoint, error)
 	UpdateURL(WebhookEndpoint) (WebhookEndpoint, error)
+	Update(WebhookEndpoint) (WebhookEndpoint, error)
+	SetPersistenceMode(WebhookEndpoint, PersistenceMode) (WebhookEndpoint, error)
+	SetTopicFilter(WebhookEndpoint, TopicFilter) (WebhookEndpoint, error)
+	SetHeaders(WebhookEndpoint, map[string]string) (WebhookEndpoint, error)
+	SetAuth(WebhookEndpoint, EndpointAuth) (WebhookEndpoint, error)
+	SetTLS(WebhookEndpoint, EndpointTLS) (WebhookEndpoint, error)
+	RotateSecret(WebhookEndpoint) (WebhookEndpoint, error)
+	SetVerificationProtocol(WebhookEndpoint, VerificationProtocol) (WebhookEndpoint, error)
 	Verify(WebhookEndpoint) (WebhookEndpoint, error)
+	VerifyAsync(WebhookEndpoint) (WebhookEndpoint, error)
+	ConfirmVerification(string) (WebhookEndpoint, error)
+	Suspend(WebhookEndpoint, string) (WebhookEndpoint, error)
+	Disable(WebhookEndpoint, string) (WebhookEndpoint, error)
+	Resume(WebhookEndpoint, string) (WebhookEndpoint, error)
+	Pause(WebhookEndpoint, *time.Time) (WebhookEndpoint, error)
+	StatusHistory(WebhookEndpoint) ([]StatusChange, error)
 	Get(WebhookEndpoint) (WebhookEndpoint, error)
 	Delete(WebhookEndpoint) error
+	ListDeletedEndpoints() (*[]WebhookEndpoint, error)
+	Restore(WebhookEndpoint) (WebhookEndpoint, error)
+	Erase(WebhookEndpoint) error
 	Notify(WebhookEndpoint, WebhookNotification) error
+	NotifyOwner(string, WebhookNotification) ([]uuid.UUID, error)
 	LastNotificationSent(WebhookEndpoint) (WebhookNotification, error)
+	ListNotifications(NotificationQuery) (NotificationPage, error)
+	GetNotification(uint) (WebhookNotificationRecord, error)
 	ListEndpoints() (*[]WebhookEndpoint, error)
+	ListEndpointsWithQuery(EndpointQuery) (EndpointPage, error)
+	Migrate() error
+	MigrateDown(int) error
+	DryRunMigrations(io.Writer) error
+	SchemaVersion() (int, error)
+	Purge(time.Time) (int64, error)
+	ReEncrypt() (int64, error)
+	Export(io.Writer) error
+	Import(io.Reader, ImportConflictStrategy) (ImportSummary, error)
+	Close() error
+	ForTenant(string) (WebhookEndpointService, error)
+	SetTenantQuota(string, int) error
+	WithActor(string) (WebhookEndpointService, error)
+	MetricsHandler() http.Handler
 }
 
 type WebhookEndpointServiceImpl struct {
 	WebhookEndpointService
-	db   *gorm.DB
-	log  *zap.Logger
-	http *http.Client
+	db       *gorm.DB
+	log      *zap.Logger
+	http     *http.Client
+	migrator *migrator
+
+	// set on tenant views, see ForTenant
+	tenant string
+	// recorded with status changes, see WithActor
+	actor string
+
+	persistence        PersistenceMode
+	notificationPath   string
+	cipher             fieldCipher
+	retention          RetentionPolicy
+	retentionBatchSize int
+	egress             egressPolicy
+	verification       verificationSettings
+	health             healthSettings
+	tokens             *tokenCache
+	transports         *transportCache
+	metrics            *serviceMetrics
+
+	// background workers
+	stop    chan struct{}
+	workers *sync.WaitGroup
+	closing *sync.Once
+	// wakes up the background verification
+	pendingVerifications chan struct{}
 }
 
 // Creates a new Webhook service, connects to a database and applies migrations
-func NewWebhookService(custom_http_client *http.Client) (WebhookEndpointService, error) {
+//
+// Set HOOK_DB_AUTO_MIGRATE=false to manage the schema yourself,
+// see service.Migrate() and service.DryRunMigrations()
+func NewWebhookService(custom_http_client *http.Client, options ...ServiceOption) (WebhookEndpointService, error) {
 
 	// Viper Config
 	// ------------
@@ -61,14 +125,54 @@ func NewWebhookService(custom_http_client *http.Client) (WebhookEndpointService,
 
 	// DB migrations
 	// -------------
-	logger.Info("Applying database migrations")
-	err = db.AutoMigrate(
-		&WebhookEndpointDB{},
-		&WebhookNotificationDB{},
+	db_migrator, err := newMigrator(
+		db,
+		viper.GetString("db_engine"),
+		logger,
 	)
 	if err != nil {
 		return nil, err
 	}
+	if viper.GetBool("db_auto_migrate") {
+		logger.Info("Applying database migrations")
+		err = db_migrator.up()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		version, err := db_migrator.version()
+		if err != nil {
+			return nil, err
+		}
+		if version < latestMigrationVersion() {
+			logger.Warn(
+				"Database schema is behind, run service.Migrate() before using the service",
+				zap.Int("SchemaVersion", version),
+				zap.Int("LatestVersion", latestMigrationVersion()),
+			)
+		}
+	}
+
+	// Notifications persistence
+	// -------------------------
+	persistence := PersistenceMode(viper.GetString("notification_persistence"))
+	if persistence == PersistDefault || !persistence.valid() {
+		return nil, ErrUnsupportedPersistenceMode
+	}
+
+	// Notification URLs
+	// -----------------
+	notification_path := viper.GetString("notification_path")
+	if notification_path == "" || validateNotificationPath(notification_path) != nil {
+		return nil, ErrInvalidNotificationPath
+	}
+
+	// Encryption at rest
+	// -----------------
+	key_provider, err := keyProviderFromConfig()
+	if err != nil {
+		return nil, err
+	}
 
 	// Universal HTTP client
 	// ---------------------
@@ -81,14 +185,86 @@ func NewWebhookService(custom_http_client *http.Client) (WebhookEndpointService,
 		http_client = custom_http_client
 	}
 
+	// Verification
+	// ------------
+	verification, err := verificationSettingsFromConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Health checks
+	// -------------
+	health, err := healthSettingsFromConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Egress policy
+	// -------------
+	egress := egressPolicyFromConfig()
+	http_client = egress.guardClient(http_client, logger)
+
 	// Pulling it all together
 	// -----------------------
 	logger.Info("Pulling together a new Webhooks service")
-	return &WebhookEndpointServiceImpl{
-		db:   db,
-		log:  logger,
-		http: http_client,
-	}, nil
+	svc := &WebhookEndpointServiceImpl{
+		db:                 db,
+		log:                logger,
+		http:               http_client,
+		migrator:           db_migrator,
+		persistence:        persistence,
+		notificationPath:   notification_path,
+		cipher:             fieldCipher{keys: key_provider},
+		retention:          retentionPolicyFromConfig(),
+		retentionBatchSize: retentionBatchSizeFromConfig(),
+		egress:             egress,
+		verification:       verification,
+		health:             health,
+		tokens:             newTokenCache(),
+		transports:         newTransportCache(egress.guardTransport(http.DefaultTransport.(*http.Transport))),
+		metrics:            newServiceMetrics(db, logger),
+		stop:               make(chan struct{}),
+		workers:            &sync.WaitGroup{},
+		closing:            &sync.Once{},
+
+		pendingVerifications: make(chan struct{}, 1),
+	}
+
+	for _, option := range options {
+		option(svc)
+	}
+
+	err = svc.metrics.register()
+	if err != nil {
+		return nil, err
+	}
+
+	if svc.cipher.enabled() {
+		logger.Info(
+			"Encrypting sensitive values at rest",
+			zap.String("KeyID", svc.cipher.keys.CurrentKeyID()),
+		)
+	} else {
+		logger.Info("No encryption keys configured, sensitive values are stored in plaintext")
+	}
+
+	// Background workers
+	// ------------------
+	if svc.retention.enabled() {
+		svc.startJanitor(viper.GetDuration("retention_interval"))
+	}
+	if viper.GetDuration("tls_expiry_check_interval") > 0 {
+		svc.startCertificateWatch(viper.GetDuration("tls_expiry_check_interval"))
+	}
+	svc.startVerificationRetries(verification.retryInterval)
+	if health.interval > 0 {
+		svc.startHealthChecks(health.interval)
+	}
+	if viper.GetDuration("pause_check_interval") > 0 {
+		svc.startPauseWatch(viper.GetDuration("pause_check_interval"))
+	}
+
+	return svc, nil
 }
 
 // Creates a new unverified Webhook Endpoint. The next step would be to run
@@ -109,12 +285,69 @@ func (s *WebhookEndpointServiceImpl) Create(endpoint WebhookEndpoint) (WebhookEn
 		// recover by retrying with a non-empty endpoint URL
 		return endpoint, ErrEmptyEndpointURL
 	}
+	if err := s.checkEgress(endpoint.URL); err != nil {
+		return endpoint, err
+	}
+
+	if !endpoint.PersistenceMode.valid() {
+		return endpoint, ErrUnsupportedPersistenceMode
+	}
+
+	if !endpoint.TopicFilter.valid() {
+		return endpoint, ErrInvalidTopicPattern
+	}
+	if err := validateLabels(endpoint.Labels); err != nil {
+		return endpoint, err
+	}
+	if err := validateMetadata(endpoint.Metadata); err != nil {
+		return endpoint, err
+	}
+	if err := endpoint.Verification.validate(); err != nil {
+		return endpoint, err
+	}
+	if err := validateNotificationPath(endpoint.NotificationPath); err != nil {
+		return endpoint, err
+	}
+
+	if s.tenant != "" {
+		if endpoint.TenantID != "" && endpoint.TenantID != s.tenant {
+			return endpoint, ErrTenantMismatch
+		}
+		endpoint.TenantID = s.tenant
+	}
+	// soft-deleted endpoints still hold on to their UUID
+	exists, err := s.endpointUUIDTaken(endpoint.UUID)
+	if err != nil {
+		return endpoint, err
+	}
+	if exists {
+		// recover by retrying with a different or an empty UUID
+		return endpoint, ErrDuplicateEndpoint
+	}
 
 	db_endpoint := WebhookEndpointDB{
-		UUID:   endpoint.UUID,
-		URL:    endpoint.URL,
-		Status: endpoint.Status,
+		UUID:               endpoint.UUID,
+		URL:                endpoint.URL,
+		Status:             endpoint.Status,
+		PersistenceMode:    endpoint.PersistenceMode,
+		TenantID:           endpoint.TenantID,
+		IncludeTopics:      encodeTopics(endpoint.TopicFilter.Include),
+		ExcludeTopics:      encodeTopics(endpoint.TopicFilter.Exclude),
+		Description:        endpoint.Description,
+		Metadata:           string(endpoint.Metadata),
+		VerificationConfig: encodeVerificationProtocol(endpoint.Verification),
+		NotificationPath:   endpoint.NotificationPath,
+		// created along with the endpoint, in the same transaction
+		Labels: labelsToDb(endpoint.UUID, endpoint.Labels),
+	}
+
+	// handed back this once, see RotateSecret
+	secret := newEndpointSecret()
+	err = s.encryptSecret(&db_endpoint, secret)
+	if err != nil {
+		return endpoint, err
 	}
+	endpoint.Secret = secret
 
 	s.log.Info(
 		"Creating a new endpoint",
@@ -127,8 +360,17 @@ func (s *WebhookEndpointServiceImpl) Create(endpoint WebhookEndpoint) (WebhookEn
 			zap.String("UUID", db_endpoint.UUID.String()))
 	}()
 
-	tx := s.db.Create(&db_endpoint)
-	return endpoint, tx.Error
+	err = s.withinTenantQuota(endpoint.TenantID, func(tx *gorm.DB) error {
+		return tx.Create(&db_endpoint).Error
+	})
+	if err != nil && err != ErrTenantQuotaExceeded {
+		// lost a race with a concurrent Create
+		exists, taken_err := s.endpointUUIDTaken(endpoint.UUID)
+		if taken_err == nil && exists {
+			return endpoint, ErrDuplicateEndpoint
+		}
+	}
+	return endpoint, err
 }
 
 // Updates the endpoint with a new URL. The endpoint is then switched to Unverified
@@ -137,6 +379,8 @@ func (s *WebhookEndpointServiceImpl) Create(endpoint WebhookEndpoint) (WebhookEn
 // verified_endpoint, err := service.Verify(endpoint)
 //
 // Otherwise you will not be able to send Notifiations to the endpoint.
+// Returns ErrStatusChanged, and changes nothing, if the endpoint status
+// changed in the meantime.
 //
 // endpoint.UUID is used to find the webhook in the database.
 func (s *WebhookEndpointServiceImpl) UpdateURL(endpoint WebhookEndpoint) (WebhookEndpoint, error) {
@@ -154,14 +398,162 @@ func (s *WebhookEndpointServiceImpl) UpdateURL(endpoint WebhookEndpoint) (Webhoo
 		s.log.Info("URL is same as before, nothing to do", zap.String("UUID", endpoint.UUID.String()))
 		return endpoint, nil
 	}
+	if err := s.checkEgress(endpoint.URL); err != nil {
+		return endpoint, err
+	}
 
 	s.log.Info("updating the URL and Status", zap.String("UUID", endpoint.UUID.String()))
 
-	model_endpoint.URL = endpoint.URL
-	model_endpoint.Status = Unverified
+	err = s.guardedStatusChange(
+		model_endpoint,
+		anyEndpoint,
+		statusAfterURLChange(model_endpoint.Status),
+		s.actor,
+		"URL changed",
+		map[string]interface{}{"url": endpoint.URL, "updated_at": time.Now()},
+	)
+	return endpoint, err
+}
 
-	tx := s.db.Save(&model_endpoint)
-	return endpoint, tx.Error
+// the new URL has to be verified, unless the endpoint is disabled anyway
+func statusAfterURLChange(status WebhookEndpointStatus) WebhookEndpointStatus {
+	if status == Disabled {
+		return Disabled
+	}
+	return Unverified
+}
+
+// Replaces all the editable fields of the endpoint: URL, description, labels,
+// metadata, topic filter, persistence mode, verification protocol and
+// notification path. Fetch the endpoint with service.Get() first if you only
+// want to change some of them.
+//
+// Changing the URL switches the endpoint to Unverified, like service.UpdateURL(),
+// and returns ErrStatusChanged if the status changed in the meantime.
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) Update(endpoint WebhookEndpoint) (WebhookEndpoint, error) {
+
+	if endpoint.URL == "" {
+		return endpoint, ErrEmptyEndpointURL
+	}
+	if err := s.checkEgress(endpoint.URL); err != nil {
+		return endpoint, err
+	}
+	if !endpoint.PersistenceMode.valid() {
+		return endpoint, ErrUnsupportedPersistenceMode
+	}
+	if !endpoint.TopicFilter.valid() {
+		return endpoint, ErrInvalidTopicPattern
+	}
+	if err := validateLabels(endpoint.Labels); err != nil {
+		return endpoint, err
+	}
+	if err := validateMetadata(endpoint.Metadata); err != nil {
+		return endpoint, err
+	}
+	if err := endpoint.Verification.validate(); err != nil {
+		return endpoint, err
+	}
+	if err := validateNotificationPath(endpoint.NotificationPath); err != nil {
+		return endpoint, err
+	}
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+	if endpoint.TenantID != "" && endpoint.TenantID != model_endpoint.TenantID {
+		// endpoints can't move between tenants
+		return endpoint, ErrTenantMismatch
+	}
+
+	s.log.Info("updating an endpoint", zap.String("UUID", endpoint.UUID.String()))
+
+	updated := *model_endpoint
+	updated.URL = endpoint.URL
+	updated.PersistenceMode = endpoint.PersistenceMode
+	updated.IncludeTopics = encodeTopics(endpoint.TopicFilter.Include)
+	updated.ExcludeTopics = encodeTopics(endpoint.TopicFilter.Exclude)
+	updated.Description = endpoint.Description
+	updated.Metadata = string(endpoint.Metadata)
+	updated.VerificationConfig = encodeVerificationProtocol(endpoint.Verification)
+	updated.NotificationPath = endpoint.NotificationPath
+	updated.UpdatedAt = time.Now()
+
+	// only the columns Update owns, whatever else changes in the meantime stays
+	columns := map[string]interface{}{
+		"persistence_mode":    updated.PersistenceMode,
+		"include_topics":      updated.IncludeTopics,
+		"exclude_topics":      updated.ExcludeTopics,
+		"description":         updated.Description,
+		"metadata":            updated.Metadata,
+		"verification_config": updated.VerificationConfig,
+		"notification_path":   updated.NotificationPath,
+		"updated_at":          updated.UpdatedAt,
+	}
+	url_changed := updated.URL != model_endpoint.URL
+	if url_changed {
+		columns["url"] = updated.URL
+		updated.Status = statusAfterURLChange(model_endpoint.Status)
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if url_changed {
+			err = statusChangeIn(tx, model_endpoint, anyEndpoint, updated.Status, s.actor, "URL changed", columns)
+		} else {
+			err = tx.Model(model_endpoint).UpdateColumns(columns).Error
+		}
+		if err != nil {
+			return err
+		}
+		return replaceLabels(tx, model_endpoint.UUID, endpoint.Labels)
+	})
+	if err == ErrStatusChanged || err == ErrIllegalStatusTransition {
+		s.logStatusChangeError(model_endpoint, model_endpoint.Status, updated.Status, err)
+		return endpoint, err
+	}
+	if err != nil {
+		s.log.Error("couldnt update an endpoint", zap.Error(err))
+		return endpoint, err
+	}
+
+	updated.Labels = labelsToDb(updated.UUID, endpoint.Labels)
+	return *endpointDbToWeb(&updated), nil
+}
+
+// Changes how much of the endpoint's notifications is saved to the database.
+// PersistDefault switches the endpoint back to the service-wide mode.
+//
+// Notifications saved until now are left as they are.
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) SetPersistenceMode(endpoint WebhookEndpoint, mode PersistenceMode) (WebhookEndpoint, error) {
+
+	if !mode.valid() {
+		return endpoint, ErrUnsupportedPersistenceMode
+	}
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+
+	s.log.Info(
+		"updating the notifications persistence",
+		zap.String("UUID", endpoint.UUID.String()),
+		zap.String("PersistenceMode", string(mode)),
+	)
+
+	model_endpoint.PersistenceMode = mode
+	tx := s.db.Model(model_endpoint).UpdateColumn("persistence_mode", mode)
+	if tx.Error != nil {
+		s.log.Error("couldnt save the persistence mode", zap.Error(tx.Error))
+		return endpoint, tx.Error
+	}
+
+	return *endpointDbToWeb(model_endpoint), nil
 }
 
 // Verifies user's control over the provided endpoint.
@@ -173,6 +565,9 @@ func (s *WebhookEndpointServiceImpl) UpdateURL(endpoint WebhookEndpoint) (Webhoo
 // <endpoint.URL>/verification?id=abcd
 //
 // The verification process expects to see "abcd" in the response body.
+// The path, method and answer are configurable, see VerificationProtocol.
+//
+// Failed verifications return a *VerificationError telling why.
 func (s *WebhookEndpointServiceImpl) Verify(endpoint WebhookEndpoint) (WebhookEndpoint, error) {
 	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
 	if err != nil {
@@ -183,46 +578,27 @@ func (s *WebhookEndpointServiceImpl) Verify(endpoint WebhookEndpoint) (WebhookEn
 		return endpoint, ErrInternalProcessingError
 	}
 
-	if model_endpoint.Status > Suspended {
-		// Verified = 2, Healthy = 3
+	if model_endpoint.Status.verified() {
 		s.log.Info("endpoint already verified")
 		return endpoint, nil
 	}
-
-	url, err := prepareEndpointForVerification(model_endpoint.URL, model_endpoint.UUID.String())
-	if err != nil {
-		return endpoint, err
+	if !model_endpoint.Status.canMoveTo(Verified) {
+		return endpoint, ErrIllegalStatusTransition
 	}
 
-	var resp *http.Response
-	client := &http.Client{
-		Timeout: time.Second * 3,
-	}
-	resp, err = client.Get(url)
+	err = s.verifyEndpoint(model_endpoint)
 	if err != nil {
-		return endpoint, err
-	}
-	defer resp.Body.Close()
-
-	verificationResult := verifyResponseBodyForVerification(
-		resp.Body,
-		endpoint.UUID.String(),
-	)
-	if verificationResult != nil {
 		s.log.Warn(
 			"Failed endpoint verification",
 			zap.String("UUID", endpoint.UUID.String()),
-			zap.Error(verificationResult))
-		return endpoint, ErrFailedEndpointVerification
+			zap.Error(err))
+		return endpoint, err
 	}
 	s.log.Info("successfully verified an endpoint",
 		zap.String("UUID", endpoint.UUID.String()))
 
-	// mark the URL unverified
-	model_endpoint.Status = Verified
 	endpoint.Status = Verified
-	tx := s.db.Save(&model_endpoint)
-	return endpoint, tx.Error
+	return endpoint, s.markVerified(model_endpoint, s.actor, "passed verification")
 }
 
 // Deletes the indicated Endpoint
@@ -242,6 +618,92 @@ func (s *WebhookEndpointServiceImpl) Delete(endpoint WebhookEndpoint) error {
 	return tx.Error
 }
 
+// Lists endpoints which were deleted with service.Delete()
+// and can still be restored
+func (s *WebhookEndpointServiceImpl) ListDeletedEndpoints() (*[]WebhookEndpoint, error) {
+
+	var db_endpoints []WebhookEndpointDB
+
+	tx := withEndpointDetails(s.tenantScope(s.db.Unscoped())).Where("deleted_at IS NOT NULL").Find(&db_endpoints)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	return endpointsDbToWeb(&db_endpoints), nil
+}
+
+// Brings back an endpoint deleted with service.Delete(),
+// in the status it was deleted in.
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) Restore(endpoint WebhookEndpoint) (WebhookEndpoint, error) {
+
+	model_endpoint, err := s.fetchAnyWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+	if !model_endpoint.DeletedAt.Valid {
+		// recover by using the endpoint as it is
+		return *endpointDbToWeb(model_endpoint), ErrEndpointNotDeleted
+	}
+
+	s.log.Info("restoring a deleted endpoint", zap.String("UUID", endpoint.UUID.String()))
+
+	// counts against the quota again
+	err = s.withinTenantQuota(model_endpoint.TenantID, func(tx *gorm.DB) error {
+		return tx.Unscoped().Model(model_endpoint).Update("deleted_at", nil).Error
+	})
+	if err != nil {
+		return endpoint, err
+	}
+
+	return *endpointDbToWeb(model_endpoint), nil
+}
+
+// Permanently removes the endpoint, deleted or not, along with
+// all of its notifications. There's no way back, use it for requests
+// like GDPR erasure, otherwise stick to service.Delete()
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) Erase(endpoint WebhookEndpoint) error {
+
+	model_endpoint, err := s.fetchAnyWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return err
+	}
+
+	s.log.Info("erasing an endpoint and its notifications", zap.String("UUID", endpoint.UUID.String()))
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+
+		err := tx.Unscoped().
+			Where("endpoint_uuid = ?", model_endpoint.UUID).
+			Delete(&WebhookNotificationDB{}).Error
+		if err != nil {
+			return err
+		}
+
+		err = replaceLabels(tx, model_endpoint.UUID, nil)
+		if err != nil {
+			return err
+		}
+		err = replaceHeaders(tx, model_endpoint.UUID, nil)
+		if err != nil {
+			return err
+		}
+		err = tx.Where("endpoint_uuid = ?", model_endpoint.UUID).Delete(&WebhookVerificationNonceDB{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("endpoint_uuid = ?", model_endpoint.UUID).Delete(&WebhookEndpointStatusChangeDB{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Delete(model_endpoint).Error
+	})
+}
+
 // Fetches the indicated Endpoint from the database
 //
 // endpoint.UUID is used to find the webhook in the database.
@@ -256,79 +718,98 @@ func (s *WebhookEndpointServiceImpl) Get(endpoint WebhookEndpoint) (WebhookEndpo
 		return endpoint, ErrInternalProcessingError
 	}
 
-	simplified_webhook_endpoint := WebhookEndpoint{
-		UUID:   model_endpoint.UUID,
-		URL:    model_endpoint.URL,
-		Status: model_endpoint.Status,
-	}
-
-	return simplified_webhook_endpoint, nil
+	return *endpointDbToWeb(model_endpoint), nil
 }
 
 // Notify sends a Notification to a verified Endpoint.
 //
+// Notifications to paused endpoints are kept as DeliveryPending
+// and sent once the endpoint is resumed, see service.Pause()
+//
 // Notification's Topic and Body can be empty
 func (s *WebhookEndpointServiceImpl) Notify(endpoint WebhookEndpoint, notification WebhookNotification) error {
 
-	ref_endpoint, err := s.Get(endpoint)
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
 	if err != nil {
 		return err
 	}
+	ref_endpoint := *endpointDbToWeb(model_endpoint)
 
-	if ref_endpoint.Status < Verified {
+	if ref_endpoint.Status == Disabled {
+		return ErrEndpointDisabled
+	}
+	if !ref_endpoint.Status.verified() {
 		// recover by running service.Verify(endpoint) first
 		return ErrEndpointNotYetActivated
 	}
 
-	jsonval, err := json.Marshal(notification)
-	if err != nil {
+	// paused since the endpoint was loaded or not, see queueIfPaused
+	queued, err := s.queueIfPaused(model_endpoint, notification)
+	if queued || err != nil {
 		return err
 	}
-	final_url, err := prepareEndpointForNotification(ref_endpoint.URL)
-	if err != nil {
-		return err
-	}
-	request, err := http.NewRequest("GET", final_url, bytes.NewBuffer(jsonval))
+
+	response_code, err := s.deliver(model_endpoint, notification)
 	if err != nil {
+		// keep a record of the failed attempt, the error that matters is err
+		_ = s.recordNotification(ref_endpoint, notification, DeliveryFailed, response_code)
 		return err
 	}
 
-	request.Header.Set("Content-Type", "application/json")
-	response, err := s.http.Do(request)
+	// save the notification, see HOOK_NOTIFICATION_PERSISTENCE
+	return s.recordNotification(ref_endpoint, notification, Delivered, response_code)
+}
+
+// Sends the notification to the endpoint. The response code is 0
+// when the endpoint couldn't be reached.
+func (s *WebhookEndpointServiceImpl) deliver(model_endpoint *WebhookEndpointDB, notification WebhookNotification) (response_code int, err error) {
+
+	started := time.Now()
+	defer func() {
+		s.metrics.observeNotification(model_endpoint, response_code, err, time.Since(started))
+	}()
+
+	jsonval, err := json.Marshal(notification)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer response.Body.Close()
-
-	// TODO: introduce toggle for notifications persistence
-	// save the notification
-	db_notifiaction := WebhookNotificationDB{
-		EventUUID:    notification.EventUUID,
-		Topic:        notification.Topic,
-		Body:         notification.Body,
-		EndpointUUID: ref_endpoint.UUID,
+	final_url, err := prepareEndpointForNotification(model_endpoint.URL, s.notificationPathFor(model_endpoint), notification.Topic)
+	if err != nil {
+		return 0, err
 	}
-	tx := s.db.Create(&db_notifiaction)
-	if tx.Error != nil {
-		return tx.Error
+	response, err := s.sendToEndpoint(s.http, model_endpoint, func() (*http.Request, error) {
+		request, err := http.NewRequest("GET", final_url, bytes.NewBuffer(jsonval))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		return request, nil
+	})
+	if err != nil {
+		return 0, err
 	}
+	defer response.Body.Close()
 
 	// TODO: perhaps worth narrowing down
 	if response.StatusCode >= 400 {
 		body, err := io.ReadAll(response.Body)
 		if err != nil {
-			return ErrFailedNotifyingTheEndpoint
+			return response.StatusCode, ErrFailedNotifyingTheEndpoint
 		}
 		s.log.Warn(
 			"notifiaction returned HTTP error code:",
 			zap.Int("StatusCode", response.StatusCode),
 			zap.String("Body", string(body)),
 		)
-		return ErrFailedNotifyingTheEndpoint
+		return response.StatusCode, ErrFailedNotifyingTheEndpoint
 	}
-	return nil
+	return response.StatusCode, nil
 }
 
+// Returns the last notification recorded for the endpoint.
+//
+// The Body is empty unless the notification was persisted in full,
+// and endpoints with PersistNothing have no notifications to return.
 func (s *WebhookEndpointServiceImpl) LastNotificationSent(endpoint WebhookEndpoint) (WebhookNotification, error) {
 
 	if endpoint.UUID == uuid.Nil {
@@ -336,7 +817,7 @@ func (s *WebhookEndpointServiceImpl) LastNotificationSent(endpoint WebhookEndpoi
 	}
 
 	var db_notifiaction WebhookNotificationDB
-	tx := s.db.Last(&db_notifiaction, "endpoint_uuid = ?", endpoint.UUID)
+	tx := s.tenantScope(s.db).Last(&db_notifiaction, "endpoint_uuid = ? AND delivery_status <> ?", endpoint.UUID, DeliveryPending)
 	if tx.Error != nil {
 		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
 			s.log.Error("couldnt find any notifications in the database for provided endpoint", zap.Error(tx.Error))
@@ -347,6 +828,11 @@ func (s *WebhookEndpointServiceImpl) LastNotificationSent(endpoint WebhookEndpoi
 		}
 	}
 
+	err := s.decryptNotification(&db_notifiaction)
+	if err != nil {
+		return WebhookNotification{}, err
+	}
+
 	return WebhookNotification{
 		EventUUID: db_notifiaction.EventUUID,
 		Topic:     db_notifiaction.Topic,
@@ -355,11 +841,86 @@ func (s *WebhookEndpointServiceImpl) LastNotificationSent(endpoint WebhookEndpoi
 
 }
 
+// Lists a page of sent notifications matching the query, across all endpoints
+// unless the query names one.
+//
+// Pass the NextCursor of a page in the query to fetch the following one,
+// an empty NextCursor means there are no more pages.
+func (s *WebhookEndpointServiceImpl) ListNotifications(query NotificationQuery) (NotificationPage, error) {
+
+	query = query.validate()
+
+	var total int64
+	tx := query.filter(s.tenantScope(s.db.Model(&WebhookNotificationDB{}))).Count(&total)
+	if tx.Error != nil {
+		s.log.Error("couldnt count notifications in the database", zap.Error(tx.Error))
+		return NotificationPage{}, tx.Error
+	}
+
+	page_tx, err := paginate(
+		query.filter(s.tenantScope(s.db.Model(&WebhookNotificationDB{}))),
+		"webhook_notification_dbs",
+		"id",
+		query.Descending,
+		query.Cursor,
+		query.PageSize,
+	)
+	if err != nil {
+		return NotificationPage{}, err
+	}
+
+	var db_notifications []WebhookNotificationDB
+	tx = page_tx.Find(&db_notifications)
+	if tx.Error != nil {
+		s.log.Error("couldnt fetch notifications from the database", zap.Error(tx.Error))
+		return NotificationPage{}, tx.Error
+	}
+
+	for i := range db_notifications {
+		err = s.decryptNotification(&db_notifications[i])
+		if err != nil {
+			return NotificationPage{}, err
+		}
+	}
+
+	page := NotificationPage{
+		TotalCount: total,
+	}
+	if len(db_notifications) > query.PageSize {
+		db_notifications = db_notifications[:query.PageSize]
+		page.NextCursor = encodeCursor(db_notifications[len(db_notifications)-1].ID)
+	}
+	page.Notifications = notificationsDbToRecords(&db_notifications)
+
+	return page, nil
+}
+
+// Fetches a single sent notification by the ID of its record
+func (s *WebhookEndpointServiceImpl) GetNotification(id uint) (WebhookNotificationRecord, error) {
+
+	var db_notification WebhookNotificationDB
+	tx := s.tenantScope(s.db).First(&db_notification, id)
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			return WebhookNotificationRecord{}, ErrRecordNotFound
+		}
+		s.log.Error("couldnt fetch a notification from the database", zap.Error(tx.Error))
+		return WebhookNotificationRecord{}, tx.Error
+	}
+
+	err := s.decryptNotification(&db_notification)
+	if err != nil {
+		return WebhookNotificationRecord{}, err
+	}
+
+	return *notificationDbToRecord(&db_notification), nil
+}
+
 func (s *WebhookEndpointServiceImpl) ListEndpoints() (*[]WebhookEndpoint, error) {
 
 	var db_endpoints []WebhookEndpointDB
 
-	tx := s.db.Find(&db_endpoints)
+	tx := withEndpointDetails(s.tenantScope(s.db)).Find(&db_endpoints)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
@@ -367,6 +928,121 @@ func (s *WebhookEndpointServiceImpl) ListEndpoints() (*[]WebhookEndpoint, error)
 	return endpointsDbToWeb(&db_endpoints), nil
 }
 
+// Lists a page of endpoints matching the query.
+//
+// Pass the NextCursor of a page in the query to fetch the following one,
+// an empty NextCursor means there are no more pages.
+func (s *WebhookEndpointServiceImpl) ListEndpointsWithQuery(query EndpointQuery) (EndpointPage, error) {
+
+	query, err := query.validate()
+	if err != nil {
+		return EndpointPage{}, err
+	}
+
+	var total int64
+	tx := query.filter(s.tenantScope(s.db.Model(&WebhookEndpointDB{}))).Count(&total)
+	if tx.Error != nil {
+		s.log.Error("couldnt count endpoints in the database", zap.Error(tx.Error))
+		return EndpointPage{}, tx.Error
+	}
+
+	page_tx, err := paginate(
+		query.filter(s.tenantScope(s.db.Model(&WebhookEndpointDB{}))),
+		"webhook_endpoint_dbs",
+		string(query.OrderBy),
+		query.Descending,
+		query.Cursor,
+		query.PageSize,
+	)
+	if err != nil {
+		return EndpointPage{}, err
+	}
+
+	var db_endpoints []WebhookEndpointDB
+	tx = withEndpointDetails(page_tx).Find(&db_endpoints)
+	if tx.Error != nil {
+		s.log.Error("couldnt fetch endpoints from the database", zap.Error(tx.Error))
+		return EndpointPage{}, tx.Error
+	}
+
+	page := EndpointPage{
+		TotalCount: total,
+	}
+	if len(db_endpoints) > query.PageSize {
+		db_endpoints = db_endpoints[:query.PageSize]
+		page.NextCursor = encodeCursor(db_endpoints[len(db_endpoints)-1].ID)
+	}
+	page.Endpoints = *endpointsDbToWeb(&db_endpoints)
+
+	return page, nil
+}
+
+// Stops the background workers and closes the database connection.
+//
+// The service can't be used after it's closed, closing it again
+// returns ErrServiceClosed.
+func (s *WebhookEndpointServiceImpl) Close() error {
+
+	if err := s.allTenantsOnly(); err != nil {
+		return err
+	}
+
+	err := ErrServiceClosed
+	s.closing.Do(func() {
+		close(s.stop)
+		s.workers.Wait()
+		s.transports.closeAll()
+		s.metrics.unregister()
+
+		sqlDB, db_err := s.db.DB()
+		if db_err != nil {
+			err = db_err
+			return
+		}
+		err = sqlDB.Close()
+	})
+	return err
+}
+
+// Applies all pending schema migrations.
+//
+// Only needed when automatic migrations are disabled
+// with HOOK_DB_AUTO_MIGRATE=false
+func (s *WebhookEndpointServiceImpl) Migrate() error {
+
+	if err := s.allTenantsOnly(); err != nil {
+		return err
+	}
+	return s.migrator.up()
+}
+
+// Reverts schema migrations until the database is at the given version.
+//
+// MigrateDown(0) drops all the ironhook tables. On MySQL a migration
+// failing halfway isn't rolled back, DDL statements commit implicitly.
+func (s *WebhookEndpointServiceImpl) MigrateDown(version int) error {
+
+	if err := s.allTenantsOnly(); err != nil {
+		return err
+	}
+	return s.migrator.down(version)
+}
+
+// Writes the SQL of all pending migrations to w without running it,
+// so it can be reviewed or applied by hand.
+func (s *WebhookEndpointServiceImpl) DryRunMigrations(w io.Writer) error {
+
+	if err := s.allTenantsOnly(); err != nil {
+		return err
+	}
+	return s.migrator.dryRun(w)
+}
+
+// Returns the version of the last applied schema migration
+func (s *WebhookEndpointServiceImpl) SchemaVersion() (int, error) {
+	return s.migrator.version()
+}
+
 var ErrEndpointNotYetActivated error = errors.New(
 	`the endpoint youre trying to notify hasnt yet been activated.
 	recover by running service.Verify(endpoint) first`,
@@ -376,6 +1052,14 @@ var ErrFailedNotifyingTheEndpoint error = errors.New(
 	This is perhaps an external issue, recovering might require 
 	checking if the request body is parsed correctly and on both ends`,
 )
+var ErrEndpointNotDeleted error = errors.New(
+	`the endpoint youre trying to restore hasnt been deleted.
+	There's nothing to recover from, it can be used as it is`,
+)
+var ErrServiceClosed error = errors.New(
+	`the service has already been closed.
+	There's nothing to recover from, create a new service if you need one`,
+)
 var ErrInternalProcessingError error = errors.New(
 	`an internal error occured that shouldn't have happened.
 	Please submit an issue with as much detail as possible`,
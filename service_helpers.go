@@ -1,47 +1,101 @@
 package ironhook
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"io"
 	"net/url"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
 
-// append /verification?id=<uuid> to the endpoint
-func prepareEndpointForVerification(endpoint, uuid string) (string, error) {
+// append the verification path, like /verification?id=<uuid>, to the endpoint.
+// "/" leaves the path as it is, query parameters of the endpoint are kept
+func prepareEndpointForVerification(endpoint, verification_path string, params url.Values) (string, error) {
 
 	u, err := prepareEndpointForOperations(endpoint)
 	if err != nil {
 		return "", err
 	}
 
-	u.Path = path.Join(u.Path, "verification")
+	if strings.Trim(verification_path, "/") != "" {
+		u.Path = path.Join(u.Path, verification_path)
+	}
 
 	q := u.Query()
-	q.Set("id", uuid)
+	for name, values := range params {
+		q[name] = values
+	}
 
 	u.RawQuery = q.Encode()
 
 	return u.String(), nil
 }
 
-// append /notification to the endpoint
-func prepareEndpointForNotification(endpoint string) (string, error) {
+// stands for the notification topic in notification paths
+const topicPlaceholder = "{topic}"
+
+// append the notification path, like /notification or /events/{topic}, to the endpoint.
+// "/" leaves the path as it is, query parameters of the endpoint are kept
+func prepareEndpointForNotification(endpoint, notification_path, topic string) (string, error) {
 
 	u, err := prepareEndpointForOperations(endpoint)
 	if err != nil {
 		return "", err
 	}
 
-	u.Path = path.Join(u.Path, "notification")
+	if strings.Trim(notification_path, "/") == "" {
+		return u.String(), nil
+	}
+
+	// topics are a single path segment, whatever they hold
+	escaped_topic := url.PathEscape(topic)
+	if strings.Trim(escaped_topic, ".") == "" {
+		escaped_topic = strings.ReplaceAll(escaped_topic, ".", "%2E")
+	}
+	raw_path := path.Join(u.EscapedPath(), strings.ReplaceAll(notification_path, topicPlaceholder, escaped_topic))
+
+	u.Path, err = url.PathUnescape(raw_path)
+	if err != nil {
+		return "", err
+	}
+	u.RawPath = raw_path
 
 	return u.String(), nil
 }
 
+// a path, with {topic} as the only placeholder
+func validateNotificationPath(notification_path string) error {
+
+	if notification_path == "" {
+		return nil
+	}
+
+	bare := strings.ReplaceAll(notification_path, topicPlaceholder, "topic")
+	if strings.ContainsAny(bare, "{}") || strings.Contains(bare, "..") {
+		return ErrInvalidNotificationPath
+	}
+	u, err := url.Parse(bare)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.RawQuery != "" || u.Fragment != "" {
+		return ErrInvalidNotificationPath
+	}
+	return nil
+}
+
+// the endpoint's notification path or the service-wide one
+func (s *WebhookEndpointServiceImpl) notificationPathFor(model_endpoint *WebhookEndpointDB) string {
+	if model_endpoint.NotificationPath != "" {
+		return model_endpoint.NotificationPath
+	}
+	return s.notificationPath
+}
+
 // parse string endpoint into url object
 func prepareEndpointForOperations(endpoint string) (*url.URL, error) {
 
@@ -68,15 +122,33 @@ func prepareEndpointForOperations(endpoint string) (*url.URL, error) {
 
 }
 
+// early feedback on URLs the egress policy would refuse to connect to,
+// malformed URLs are reported when they're used
+func (s *WebhookEndpointServiceImpl) checkEgress(endpoint_url string) error {
+
+	u, err := prepareEndpointForOperations(endpoint_url)
+	if err != nil {
+		return nil
+	}
+
+	err = s.egress.checkURLHost(u.Hostname())
+	if err != nil {
+		s.log.Warn("endpoint URL refused by the egress policy", zap.String("Host", u.Hostname()))
+	}
+	return err
+}
+
 // verify if the response body holds the expected information
-func verifyResponseBodyForVerification(iobody io.Reader, uuid string) error {
+func verifyResponseBodyForVerification(iobody io.Reader, expected string) error {
 
 	body, err := io.ReadAll(iobody)
 	if err != nil {
 		return err
 	}
 
-	if string(body) != uuid {
+	// a trailing newline is fine
+	answer := strings.TrimSpace(string(body))
+	if subtle.ConstantTimeCompare([]byte(answer), []byte(expected)) != 1 {
 		return ErrIncorrectVerificationResponse
 		// return fmt.Errorf("incorrect verification response, have %s want %s", string(body), uuid)
 	}
@@ -84,7 +156,42 @@ func verifyResponseBodyForVerification(iobody io.Reader, uuid string) error {
 	return nil
 }
 
+// same as verifyResponseBodyForVerification, for a field of a JSON response.
+// Nested fields are separated with dots, like "data.challenge"
+func verifyJSONResponseForVerification(iobody io.Reader, field string, expected string) error {
+
+	var document interface{}
+	err := json.NewDecoder(iobody).Decode(&document)
+	if err != nil {
+		return ErrIncorrectVerificationResponse
+	}
+
+	for _, key := range strings.Split(field, ".") {
+		object, ok := document.(map[string]interface{})
+		if !ok {
+			return ErrIncorrectVerificationResponse
+		}
+		document = object[key]
+	}
+
+	answer, ok := document.(string)
+	if !ok || subtle.ConstantTimeCompare([]byte(answer), []byte(expected)) != 1 {
+		return ErrIncorrectVerificationResponse
+	}
+	return nil
+}
+
+// endpoints of other tenants are reported as missing on tenant views
 func (s *WebhookEndpointServiceImpl) fetchWebhookEndpointFromDB(endpoint WebhookEndpoint) (*WebhookEndpointDB, error) {
+	return s.findWebhookEndpointIn(s.tenantScope(s.db), endpoint)
+}
+
+// same as fetchWebhookEndpointFromDB, soft-deleted endpoints included
+func (s *WebhookEndpointServiceImpl) fetchAnyWebhookEndpointFromDB(endpoint WebhookEndpoint) (*WebhookEndpointDB, error) {
+	return s.findWebhookEndpointIn(s.tenantScope(s.db.Unscoped()), endpoint)
+}
+
+func (s *WebhookEndpointServiceImpl) findWebhookEndpointIn(db *gorm.DB, endpoint WebhookEndpoint) (*WebhookEndpointDB, error) {
 
 	if endpoint.UUID == uuid.Nil {
 		return nil, ErrEmptyEndpointUUID
@@ -92,7 +199,7 @@ func (s *WebhookEndpointServiceImpl) fetchWebhookEndpointFromDB(endpoint Webhook
 
 	var reference_endpoint WebhookEndpointDB
 
-	tx := s.db.First(
+	tx := withEndpointDetails(db).First(
 		&reference_endpoint,
 		"uuid = ?", endpoint.UUID,
 	)
@@ -118,6 +225,133 @@ func (s *WebhookEndpointServiceImpl) fetchWebhookEndpointFromDB(endpoint Webhook
 	return &reference_endpoint, nil
 }
 
+// runs the job every interval until the service is closed
+func (s *WebhookEndpointServiceImpl) runPeriodically(interval time.Duration, job func()) {
+
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				job()
+			}
+		}
+	}()
+}
+
+// saves a sent notification along with the outcome of its delivery,
+// as much of it as the persistence mode allows
+func (s *WebhookEndpointServiceImpl) recordNotification(endpoint WebhookEndpoint, notification WebhookNotification, status DeliveryStatus, response_code int) error {
+
+	mode := s.persistenceFor(endpoint.PersistenceMode)
+	if mode == PersistNothing {
+		return nil
+	}
+
+	db_notifiaction := WebhookNotificationDB{
+		EventUUID:       notification.EventUUID,
+		Topic:           notification.Topic,
+		Body:            notification.Body,
+		EndpointUUID:    endpoint.UUID,
+		DeliveryStatus:  status,
+		ResponseCode:    response_code,
+		BodyHash:        hashNotificationBody(notification.Body),
+		PersistenceMode: mode,
+		TenantID:        endpoint.TenantID,
+	}
+	if mode == PersistMetadata {
+		db_notifiaction.Body = ""
+	}
+
+	err := s.saveNotificationRow(s.db, &db_notifiaction)
+	if err != nil {
+		s.log.Error("couldnt save a notification to the database", zap.Error(err))
+	}
+	return err
+}
+
+// Saves the notification, with the body encrypted if encryption is enabled.
+// Encrypted bodies are bound to the notification's ID, so the row is saved
+// first and the body right after, in one transaction.
+func (s *WebhookEndpointServiceImpl) saveNotificationRow(db *gorm.DB, db_notification *WebhookNotificationDB) error {
+
+	body := db_notification.Body
+	if !s.cipher.enabled() || body == "" {
+		db_notification.EncryptionKeyID = ""
+		return db.Save(db_notification).Error
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		db_notification.Body, db_notification.EncryptionKeyID = "", ""
+		err := tx.Save(db_notification).Error
+		if err != nil {
+			return err
+		}
+		return s.encryptNotificationBody(tx, db_notification, body)
+	})
+}
+
+// encrypts the body of a saved notification and saves it
+func (s *WebhookEndpointServiceImpl) encryptNotificationBody(db *gorm.DB, db_notification *WebhookNotificationDB, body string) error {
+
+	encrypted_body, key_id, err := s.cipher.encrypt(body, notificationBinding(db_notification))
+	if err != nil {
+		s.log.Error("couldnt encrypt a notification body", zap.Error(err))
+		return err
+	}
+
+	tx := db.Unscoped().
+		Model(db_notification).
+		UpdateColumns(map[string]interface{}{
+			"body":              encrypted_body,
+			"encryption_key_id": key_id,
+		})
+	if tx.Error != nil {
+		s.log.Error("couldnt save an encrypted notification body", zap.Error(tx.Error))
+		return tx.Error
+	}
+	db_notification.Body, db_notification.EncryptionKeyID = encrypted_body, key_id
+	return nil
+}
+
+// decrypts the body in place, if it's encrypted
+func (s *WebhookEndpointServiceImpl) decryptNotification(db_notification *WebhookNotificationDB) error {
+
+	body, err := s.cipher.decrypt(db_notification.Body, db_notification.EncryptionKeyID, notificationBinding(db_notification))
+	if err != nil {
+		s.log.Error(
+			"couldnt decrypt a notification body",
+			zap.Uint("ID", db_notification.ID),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	db_notification.Body = body
+	db_notification.EncryptionKeyID = ""
+	return nil
+}
+
+// checks if any endpoint, including soft-deleted ones, uses the UUID
+func (s *WebhookEndpointServiceImpl) endpointUUIDTaken(endpoint_uuid uuid.UUID) (bool, error) {
+
+	var count int64
+	tx := s.db.Unscoped().Model(&WebhookEndpointDB{}).Where("uuid = ?", endpoint_uuid).Count(&count)
+	if tx.Error != nil {
+		s.log.Error("couldnt look up the endpoint UUID in the database", zap.Error(tx.Error))
+		return false, tx.Error
+	}
+
+	return count > 0, nil
+}
+
 var ErrFailedEndpointVerification error = errors.New(
 	"failed to verify an endpoint",
 )
@@ -139,6 +373,13 @@ var ErrEmptyEndpointURLScheme error = errors.New(
 var ErrUnsupportedEndpointURLScheme error = errors.New(
 	"cant accept a URL without http/s for verification",
 )
+var ErrInvalidNotificationPath error = errors.New(
+	`
+	cant accept this notification path.
+	Recover by retrying with a path like /notification or /events/{topic},
+	or "/" for the endpoint URL as it is. The same goes for HOOK_NOTIFICATION_PATH
+	`,
+)
 var ErrIncorrectVerificationResponse error = errors.New(
 	"expected a different endpoint verification response",
 )
@@ -149,9 +390,44 @@ var ErrRecordNotFound = errors.New(
 	or, where applicable, by enabling persistence.
 	`,
 )
+var ErrDuplicateEndpoint error = errors.New(
+	`
+	an endpoint with this UUID already exists.
+	Recover by retrying with a different UUID or without one
+	`,
+)
 var ErrEmptyEndpointUUID error = errors.New(
 	`
 	cant accept an empty UUID in an Endpoint. 
 	Recover by retrying with a non-empty UUID in your Endpoint
 	`,
 )
+
+// how many times retryTx runs a transaction
+const txAttempts = 5
+
+// Runs the transaction again when it lost to a concurrent one,
+// SQLite gives up on busy databases rather than waiting for long
+func retryTx(transaction func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := transaction()
+		if attempt == txAttempts || !retryableTxError(err) {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * 20 * time.Millisecond)
+	}
+}
+
+// busy SQLite databases, serialization failures and deadlocks
+func retryableTxError(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	for _, sign := range []string{"database is locked", "SQLITE_BUSY", "SQLSTATE 40001", "SQLSTATE 40P01", "Deadlock found", "deadlocked"} {
+		if strings.Contains(message, sign) {
+			return true
+		}
+	}
+	return false
+}
@@ -22,6 +22,10 @@ func webhooksHandler(w http.ResponseWriter, r *http.Request) {
 	if strings.Contains(r.URL.Path, "/verification") {
 		VerificationHandler(w, r)
 
+	} else if strings.Contains(r.URL.Path, "/failing/notification") {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Not today")
+
 	} else if strings.Contains(r.URL.Path, "/notification") {
 		mockNotificationHandler(w, r)
 
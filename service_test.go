@@ -2,8 +2,14 @@ package ironhook
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gofrs/uuid"
 )
@@ -86,7 +92,7 @@ func Test_prepareEndpointForVerification(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := prepareEndpointForVerification(tt.args.endpoint, tt.args.uuid)
+			got, err := prepareEndpointForVerification(tt.args.endpoint, "verification", url.Values{"id": {tt.args.uuid}})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("prepareEndpointForVerification() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -98,6 +104,39 @@ func Test_prepareEndpointForVerification(t *testing.T) {
 	}
 }
 
+func Test_prepareEndpointForNotification(t *testing.T) {
+
+	cases := []struct {
+		endpoint string
+		path     string
+		topic    string
+		want     string
+	}{
+		{"https://example.com", "/notification", "", "https://example.com/notification"},
+		{"https://example.com/hooks/", "/notification", "", "https://example.com/hooks/notification"},
+		{"https://example.com/hooks/ironhook?key=abc", "/", "order.paid", "https://example.com/hooks/ironhook?key=abc"},
+		{"https://example.com/hooks?key=abc", "/events/{topic}", "order.paid", "https://example.com/hooks/events/order.paid?key=abc"},
+		{"https://example.com", "/events/{topic}", "orders/paid now", "https://example.com/events/orders%2Fpaid%20now"},
+		{"https://example.com/hooks", "/events/{topic}", "..", "https://example.com/hooks/events/%2E%2E"},
+		{"https://example.com", "/events/{topic}", "", "https://example.com/events"},
+	}
+	for _, c := range cases {
+		got, err := prepareEndpointForNotification(c.endpoint, c.path, c.topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Fatalf("%s %s %q: have %s want %s", c.endpoint, c.path, c.topic, got, c.want)
+		}
+	}
+
+	for _, invalid := range []string{"/events/{event}", "/events?topic={topic}", "https://elsewhere.example.com/", "/../admin"} {
+		if err := validateNotificationPath(invalid); err != ErrInvalidNotificationPath {
+			t.Fatal("Expected ErrInvalidNotificationPath for ", invalid, " got ", err)
+		}
+	}
+}
+
 func Test_verifyResponseBodyForVerification(t *testing.T) {
 
 	// test datasets
@@ -441,3 +480,441 @@ func Test_CreateUpdateFailFlow(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// Flow 8
+// Create -> Create with the same UUID (error) -> Delete -> Create (error)
+func Test_CreateDuplicateFlow(t *testing.T) {
+
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint, err := svc.Create(
+		WebhookEndpoint{
+			URL: "http://localhost:8080",
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = svc.Create(
+		WebhookEndpoint{
+			UUID: endpoint.UUID,
+			URL:  "http://localhost:8081",
+		},
+	)
+	if err != ErrDuplicateEndpoint {
+		t.Fatal("Expected ErrDuplicateEndpoint, got ", err)
+	}
+
+	err = svc.Delete(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a soft-deleted endpoint still holds on to its UUID
+	_, err = svc.Create(
+		WebhookEndpoint{
+			UUID: endpoint.UUID,
+			URL:  "http://localhost:8081",
+		},
+	)
+	if err != ErrDuplicateEndpoint {
+		t.Fatal("Expected ErrDuplicateEndpoint, got ", err)
+	}
+}
+
+// Flow 9
+// Create many -> Verify some -> List pages with filters
+func Test_ListEndpointsWithQueryFlow(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	mock_http_client := server.Client()
+	defer server.Close()
+
+	svc, err := NewWebhookService(mock_http_client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err = svc.Create(
+			WebhookEndpoint{
+				URL: "http://example.com:" + fmt.Sprint(8080+i) + "/hooks",
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		endpoint, err := svc.Create(
+			WebhookEndpoint{
+				URL: server.URL,
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = svc.Verify(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// walk all the pages
+	seen := map[uuid.UUID]bool{}
+	query := EndpointQuery{PageSize: 3, OrderBy: OrderByCreatedAt, Descending: true}
+	pages := 0
+	for {
+		page, err := svc.ListEndpointsWithQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.TotalCount != 7 {
+			t.Fatal("Expected a total count of 7, found ", page.TotalCount)
+		}
+		for _, e := range page.Endpoints {
+			if seen[e.UUID] {
+				t.Fatal("Endpoint listed twice: ", e.UUID)
+			}
+			seen[e.UUID] = true
+		}
+		pages++
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if len(seen) != 7 || pages != 3 {
+		t.Fatal("Expected 7 endpoints on 3 pages, found ", len(seen), " on ", pages)
+	}
+
+	// filter by status
+	page, err := svc.ListEndpointsWithQuery(EndpointQuery{
+		Statuses: []WebhookEndpointStatus{Verified},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.TotalCount != 2 || len(page.Endpoints) != 2 {
+		t.Fatal("Expected 2 verified endpoints, found ", len(page.Endpoints))
+	}
+
+	// filter by host, the port doesnt matter
+	page, err = svc.ListEndpointsWithQuery(EndpointQuery{
+		URLHost: "EXAMPLE.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.TotalCount != 5 {
+		t.Fatal("Expected 5 endpoints on example.com, found ", page.TotalCount)
+	}
+
+	page, err = svc.ListEndpointsWithQuery(EndpointQuery{
+		URLHost: "example.co",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.TotalCount != 0 {
+		t.Fatal("Expected no endpoints on example.co, found ", page.TotalCount)
+	}
+
+	// filter by creation time
+	page, err = svc.ListEndpointsWithQuery(EndpointQuery{
+		CreatedAfter: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.TotalCount != 0 {
+		t.Fatal("Expected no endpoints created in the future, found ", page.TotalCount)
+	}
+
+	_, err = svc.ListEndpointsWithQuery(EndpointQuery{
+		Cursor: "not a cursor",
+	})
+	if err != ErrInvalidCursor {
+		t.Fatal("Expected ErrInvalidCursor, got ", err)
+	}
+
+	// the cursor row erased between pages
+	query = EndpointQuery{PageSize: 3, OrderBy: OrderByURL}
+	page, err = svc.ListEndpointsWithQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Erase(page.Endpoints[len(page.Endpoints)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	query.Cursor = page.NextCursor
+	_, err = svc.ListEndpointsWithQuery(query)
+	if err != ErrInvalidCursor {
+		t.Fatal("Expected ErrInvalidCursor after erasing the cursor row, got ", err)
+	}
+}
+
+// Flow 10
+// Create two -> Verify -> Notify both -> ListNotifications -> GetNotification
+func Test_NotificationHistoryFlow(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	mock_http_client := server.Client()
+	defer server.Close()
+
+	svc, err := NewWebhookService(mock_http_client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var endpoints []WebhookEndpoint
+	for _, url := range []string{server.URL, server.URL + "/failing"} {
+		endpoint, err := svc.Create(
+			WebhookEndpoint{
+				URL: url,
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verified_endpoint, err := svc.Verify(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoints = append(endpoints, verified_endpoint)
+	}
+	healthy, failing := endpoints[0], endpoints[1]
+
+	customer_registered_event := uuid.Must(uuid.NewV4())
+	for i := 0; i < 3; i++ {
+		err = svc.Notify(
+			healthy,
+			WebhookNotification{
+				EventUUID: uuid.Must(uuid.NewV4()),
+				Topic:     "batch.completed",
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = svc.Notify(
+		failing,
+		WebhookNotification{
+			EventUUID: customer_registered_event,
+			Topic:     "customer.registered",
+		},
+	)
+	if err != ErrFailedNotifyingTheEndpoint {
+		t.Fatal("Expected ErrFailedNotifyingTheEndpoint, got ", err)
+	}
+
+	// did the failing endpoint get the event?
+	page, err := svc.ListNotifications(NotificationQuery{
+		EndpointUUID: failing.UUID,
+		EventUUID:    customer_registered_event,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Notifications) != 1 {
+		t.Fatal("Expected one notification, found ", len(page.Notifications))
+	}
+	if page.Notifications[0].DeliveryStatus != DeliveryFailed || page.Notifications[0].ResponseCode != 500 {
+		t.Fatal("Expected a failed delivery, found ", page.Notifications[0])
+	}
+
+	// walk the delivered ones, newest first
+	query := NotificationQuery{
+		DeliveryStatuses: []DeliveryStatus{Delivered},
+		Descending:       true,
+		PageSize:         2,
+	}
+	var delivered []WebhookNotificationRecord
+	for {
+		page, err = svc.ListNotifications(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delivered = append(delivered, page.Notifications...)
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if len(delivered) != 3 || page.TotalCount != 3 {
+		t.Fatal("Expected 3 delivered notifications, found ", len(delivered))
+	}
+	if delivered[0].ID < delivered[1].ID {
+		t.Fatal("Expected the newest notification first")
+	}
+
+	record, err := svc.GetNotification(delivered[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.EventUUID != delivered[0].EventUUID || record.EndpointUUID != healthy.UUID {
+		t.Fatal("Expected ", delivered[0], " found ", record)
+	}
+
+	_, err = svc.GetNotification(delivered[0].ID + 100)
+	if err != ErrRecordNotFound {
+		t.Fatal("Expected ErrRecordNotFound, got ", err)
+	}
+}
+
+// Flow 11
+// Create -> Notify -> Delete -> ListDeleted -> Restore -> Erase
+func Test_DeleteRestoreEraseFlow(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	mock_http_client := server.Client()
+	defer server.Close()
+
+	svc, err := NewWebhookService(mock_http_client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	endpoint := newVerifiedEndpointForTests(t, svc, server.URL)
+	err = svc.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = svc.Restore(endpoint)
+	if err != ErrEndpointNotDeleted {
+		t.Fatal("Expected ErrEndpointNotDeleted, got ", err)
+	}
+
+	err = svc.Delete(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := svc.ListDeletedEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*deleted) != 1 || (*deleted)[0].UUID != endpoint.UUID {
+		t.Fatal("Expected the deleted endpoint to be listed, found ", *deleted)
+	}
+
+	restored, err := svc.Restore(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Status != Verified {
+		t.Fatal("Expected the endpoint to keep its status, found ", restored.Status)
+	}
+	err = svc.Notify(restored, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err = svc.ListDeletedEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*deleted) != 0 {
+		t.Fatal("Expected no deleted endpoints after restoring, found ", len(*deleted))
+	}
+
+	err = svc.Delete(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Erase(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = svc.Restore(endpoint)
+	if err != ErrRecordNotFound {
+		t.Fatal("Expected ErrRecordNotFound after erasing, got ", err)
+	}
+	page, err := svc.ListNotifications(NotificationQuery{EndpointUUID: endpoint.UUID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.TotalCount != 0 {
+		t.Fatal("Expected the notifications to be erased, found ", page.TotalCount)
+	}
+
+	// the UUID is free again
+	_, err = svc.Create(WebhookEndpoint{UUID: endpoint.UUID, URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Create -> Verify -> Notify to /events/{topic}
+func Test_NotificationPathFlow(t *testing.T) {
+
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/verification") {
+			VerificationHandler(w, r)
+			return
+		}
+		received = r.URL.RequestURI()
+	}))
+	defer server.Close()
+
+	svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	endpoint, err := svc.Create(WebhookEndpoint{URL: server.URL + "/hooks?key=abc", NotificationPath: "/events/{topic}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err = svc.Verify(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4()), Topic: "order.paid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != "/hooks/events/order.paid?key=abc" {
+		t.Fatal("Expected the topic in the path and the query kept, got ", received)
+	}
+
+	_, err = svc.Create(WebhookEndpoint{URL: server.URL, NotificationPath: "/events/{id}"})
+	if err != ErrInvalidNotificationPath {
+		t.Fatal("Expected ErrInvalidNotificationPath, got ", err)
+	}
+
+	t.Setenv("HOOK_NOTIFICATION_PATH", "/events?topic={topic}")
+	_, err = NewWebhookService(nil)
+	if err != ErrInvalidNotificationPath {
+		t.Fatal("Expected ErrInvalidNotificationPath, got ", err)
+	}
+}
+
+func Test_CloseTwice(t *testing.T) {
+
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Close()
+	if err != ErrServiceClosed {
+		t.Fatal("Expected ErrServiceClosed closing the service again, got ", err)
+	}
+}
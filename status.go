@@ -0,0 +1,337 @@
+package ironhook
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Actor of the status changes made in the background,
+// by health checks and background verification
+const SystemActor = "ironhook"
+
+// Where endpoints can go from each status. Staying put is always allowed,
+// and isn't recorded in the history.
+var statusTransitions = map[WebhookEndpointStatus][]WebhookEndpointStatus{
+	Unverified:          {Verified, PendingVerification, Disabled},
+	PendingVerification: {Verified, Unverified, Disabled},
+	Verified:            {Healthy, Suspended, Unverified, Disabled},
+	Healthy:             {Verified, Suspended, Unverified, Disabled},
+	Suspended:           {Verified, PendingVerification, Unverified, Disabled},
+	// back to the start, see service.Resume()
+	Disabled: {Unverified},
+}
+
+func (s WebhookEndpointStatus) canMoveTo(next WebhookEndpointStatus) bool {
+	if s == next {
+		return true
+	}
+	for _, allowed := range statusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// One entry of service.StatusHistory()
+type StatusChange struct {
+	From WebhookEndpointStatus `json:"from"`
+	To   WebhookEndpointStatus `json:"to"`
+	// see service.WithActor(), SystemActor for background changes
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+type WebhookEndpointStatusChangeDB struct {
+	ID           uint                  `gorm:"primarykey"`
+	EndpointUUID uuid.UUID             `gorm:"type:uuid;not null"`
+	FromStatus   WebhookEndpointStatus `gorm:"not null"`
+	ToStatus     WebhookEndpointStatus `gorm:"not null"`
+	Actor        string                `gorm:"not null"`
+	Reason       string                `gorm:"not null"`
+	CreatedAt    time.Time
+}
+
+// Returns a view of the service whose status changes are recorded
+// under the actor, like a user or an API key of your app.
+//
+// Changes made without an actor are recorded with an empty one.
+func (s *WebhookEndpointServiceImpl) WithActor(actor string) (WebhookEndpointService, error) {
+
+	if actor == "" || len(actor) > maxLabelLength {
+		return nil, ErrInvalidActor
+	}
+
+	scoped := *s
+	scoped.actor = actor
+	return &scoped, nil
+}
+
+// Moves the endpoint to the status, along with the other columns,
+// and records the change in the status history.
+//
+// Returns ErrStatusChanged if the endpoint isn't in the status
+// it was loaded with anymore.
+func (s *WebhookEndpointServiceImpl) changeStatus(model_endpoint *WebhookEndpointDB, to WebhookEndpointStatus, actor, reason string, columns map[string]interface{}) error {
+	return s.guardedStatusChange(model_endpoint, anyEndpoint, to, actor, reason, columns)
+}
+
+func anyEndpoint(db *gorm.DB) *gorm.DB {
+	return db
+}
+
+// changeStatus, for endpoints also matching the guard
+func (s *WebhookEndpointServiceImpl) guardedStatusChange(model_endpoint *WebhookEndpointDB, guard func(*gorm.DB) *gorm.DB, to WebhookEndpointStatus, actor, reason string, columns map[string]interface{}) error {
+
+	from := model_endpoint.Status
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		return statusChangeIn(tx, model_endpoint, guard, to, actor, reason, columns)
+	})
+	if err != nil {
+		s.logStatusChangeError(model_endpoint, from, to, err)
+		return err
+	}
+	model_endpoint.Status = to
+	return nil
+}
+
+// guardedStatusChange within the transaction, leaves the model as it is
+func statusChangeIn(tx *gorm.DB, model_endpoint *WebhookEndpointDB, guard func(*gorm.DB) *gorm.DB, to WebhookEndpointStatus, actor, reason string, columns map[string]interface{}) error {
+
+	from := model_endpoint.Status
+	if !from.canMoveTo(to) {
+		return ErrIllegalStatusTransition
+	}
+
+	updates := map[string]interface{}{"status": to}
+	for column, value := range columns {
+		updates[column] = value
+	}
+
+	// only if nobody changed the status since the endpoint was loaded,
+	// background workers hold on to theirs for a while
+	update := tx.Model(model_endpoint).Scopes(guard).Where("status = ?", from).UpdateColumns(updates)
+	if update.Error != nil {
+		return update.Error
+	}
+	if update.RowsAffected == 0 {
+		return ErrStatusChanged
+	}
+	return recordStatusChange(tx, model_endpoint.UUID, from, to, actor, reason)
+}
+
+func (s *WebhookEndpointServiceImpl) logStatusChangeError(model_endpoint *WebhookEndpointDB, from, to WebhookEndpointStatus, err error) {
+	switch err {
+	case ErrIllegalStatusTransition:
+		s.log.Warn(
+			"refused an illegal status change",
+			zap.String("UUID", model_endpoint.UUID.String()),
+			zap.Stringer("From", from),
+			zap.Stringer("To", to),
+		)
+	case ErrStatusChanged:
+		s.log.Warn(
+			"refused a status change, the endpoint status changed in the meantime",
+			zap.String("UUID", model_endpoint.UUID.String()),
+			zap.Stringer("From", from),
+			zap.Stringer("To", to),
+		)
+	default:
+		s.log.Error("couldnt change the endpoint status", zap.Error(err))
+	}
+}
+
+// adds to the status history, unless nothing changed
+func recordStatusChange(tx *gorm.DB, endpoint_uuid uuid.UUID, from, to WebhookEndpointStatus, actor, reason string) error {
+	if from == to {
+		return nil
+	}
+	return tx.Create(&WebhookEndpointStatusChangeDB{
+		EndpointUUID: endpoint_uuid,
+		FromStatus:   from,
+		ToStatus:     to,
+		Actor:        actor,
+		Reason:       reason,
+	}).Error
+}
+
+func validateStatusReason(reason string) error {
+	if len(reason) > maxLabelLength {
+		return ErrStatusReasonTooLong
+	}
+	return nil
+}
+
+// Stops notifications to a Verified or Healthy endpoint until service.Resume().
+// Health checks leave endpoints suspended this way alone, including the ones
+// they suspended themselves before.
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) Suspend(endpoint WebhookEndpoint, reason string) (WebhookEndpoint, error) {
+	return s.manualStatusChange(endpoint, Suspended, reason, "suspending an endpoint")
+}
+
+// Takes the endpoint out of service for good, or until service.Resume().
+// Disabled endpoints can't be verified or notified.
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) Disable(endpoint WebhookEndpoint, reason string) (WebhookEndpoint, error) {
+	return s.manualStatusChange(endpoint, Disabled, reason, "disabling an endpoint")
+}
+
+// Brings back a Suspended endpoint as Verified, or a Disabled one
+// as Unverified, to be verified again. Anything else that isn't paused
+// returns ErrEndpointNotPaused.
+//
+// Paused endpoints get their pending notifications, in order, and the pause
+// is lifted once they're all sent, see service.Pause(). Those which aren't
+// verified keep them until they're verified and resumed again.
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) Resume(endpoint WebhookEndpoint, reason string) (WebhookEndpoint, error) {
+
+	if err := validateStatusReason(reason); err != nil {
+		return endpoint, err
+	}
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+
+	resumed := endpoint
+	changed := true
+	switch model_endpoint.Status {
+	case Suspended:
+		resumed, err = s.manualStatusChange(endpoint, Verified, reason, "resuming a suspended endpoint")
+	case Disabled:
+		resumed, err = s.manualStatusChange(endpoint, Unverified, reason, "resuming a disabled endpoint")
+	default:
+		changed = false
+	}
+	if err != nil {
+		return endpoint, err
+	}
+
+	if model_endpoint.PausedAt == nil {
+		if !changed {
+			return endpoint, ErrEndpointNotPaused
+		}
+		return resumed, nil
+	}
+
+	unpaused, err := s.resumeDeliveries(endpoint, reason)
+	if err == ErrEndpointNotYetActivated && changed {
+		return resumed, nil
+	}
+	return unpaused, err
+}
+
+func (s *WebhookEndpointServiceImpl) manualStatusChange(endpoint WebhookEndpoint, to WebhookEndpointStatus, reason, message string) (WebhookEndpoint, error) {
+
+	if err := validateStatusReason(reason); err != nil {
+		return endpoint, err
+	}
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+	if model_endpoint.Status == to && model_endpoint.LastCheck == "" {
+		return *endpointDbToWeb(model_endpoint), nil
+	}
+
+	s.log.Info(
+		message,
+		zap.String("UUID", endpoint.UUID.String()),
+		zap.String("Actor", s.actor),
+		zap.String("Reason", reason),
+	)
+
+	// out of the health checks' hands, see checkEndpointHealth
+	columns := map[string]interface{}{"last_check": ""}
+	err = s.changeStatus(model_endpoint, to, s.actor, reason, columns)
+	if err != nil {
+		return endpoint, err
+	}
+	model_endpoint.LastCheck = ""
+	return *endpointDbToWeb(model_endpoint), nil
+}
+
+// Lists the status changes of the endpoint, oldest first
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) StatusHistory(endpoint WebhookEndpoint) ([]StatusChange, error) {
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.statusHistoryOf(s.db, model_endpoint.UUID)
+}
+
+func (s *WebhookEndpointServiceImpl) statusHistoryOf(db *gorm.DB, endpoint_uuid uuid.UUID) ([]StatusChange, error) {
+
+	var db_changes []WebhookEndpointStatusChangeDB
+	tx := db.Where("endpoint_uuid = ?", endpoint_uuid).Order("id").Find(&db_changes)
+	if tx.Error != nil {
+		s.log.Error("couldnt fetch the status history", zap.Error(tx.Error))
+		return nil, tx.Error
+	}
+
+	changes := make([]StatusChange, len(db_changes))
+	for i, c := range db_changes {
+		changes[i] = StatusChange{
+			From:      c.FromStatus,
+			To:        c.ToStatus,
+			Actor:     c.Actor,
+			Reason:    c.Reason,
+			ChangedAt: c.CreatedAt,
+		}
+	}
+	return changes, nil
+}
+
+var ErrIllegalStatusTransition error = errors.New(
+	`
+	the endpoint cant move to this status from the one its in.
+	Recover by checking the endpoint status first,
+	Disabled endpoints need service.Resume() before anything else
+	`,
+)
+var ErrStatusChanged error = errors.New(
+	`
+	the endpoint status changed while this change was being made, nothing was saved.
+	Recover by fetching the endpoint again and retrying if it still applies
+	`,
+)
+var ErrStatusReasonTooLong error = errors.New(
+	`
+	the reason for the status change is too long.
+	Recover by keeping it under 255 bytes
+	`,
+)
+var ErrInvalidActor error = errors.New(
+	`
+	cant record status changes under this actor.
+	Recover by retrying with a non-empty actor under 255 bytes
+	`,
+)
+var ErrEndpointNotPaused error = errors.New(
+	`
+	the endpoint isnt paused, suspended or disabled, theres nothing to resume.
+	Recover by checking the endpoint status and PausedAt first
+	`,
+)
+var ErrEndpointDisabled error = errors.New(
+	`
+	the endpoint is disabled and doesnt receive notifications.
+	Recover by running service.Resume(endpoint, reason) and verifying it again
+	`,
+)
@@ -0,0 +1,282 @@
+package ironhook
+
+import (
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func Test_StatusTransitions(t *testing.T) {
+
+	cases := []struct {
+		from, to WebhookEndpointStatus
+		ok       bool
+	}{
+		{Unverified, Verified, true},
+		{Unverified, Healthy, false},
+		{Unverified, Suspended, false},
+		{PendingVerification, Verified, true},
+		{Verified, Healthy, true},
+		{Healthy, Suspended, true},
+		{Suspended, Healthy, false},
+		{Suspended, Verified, true},
+		{Disabled, Verified, false},
+		{Disabled, Unverified, true},
+		{Disabled, Disabled, true},
+	}
+	for _, c := range cases {
+		if c.from.canMoveTo(c.to) != c.ok {
+			t.Fatal("Expected ", c.from, " -> ", c.to, " to be ", c.ok)
+		}
+	}
+}
+
+func Test_SuspendResumeDisable(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	alice, err := svc.WithActor("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := newVerifiedEndpointForTests(t, alice, server.URL)
+
+	endpoint, err = alice.Suspend(endpoint, "consumer asked for it")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Status != Suspended {
+		t.Fatal("Expected the endpoint to be suspended, found ", endpoint.Status)
+	}
+	err = svc.Notify(endpoint, WebhookNotification{})
+	if err != ErrEndpointNotYetActivated {
+		t.Fatal("Expected ErrEndpointNotYetActivated, got ", err)
+	}
+
+	endpoint, err = svc.Resume(endpoint, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Status != Verified {
+		t.Fatal("Expected the endpoint to be verified again, found ", endpoint.Status)
+	}
+	_, err = svc.Resume(endpoint, "")
+	if err != ErrEndpointNotPaused {
+		t.Fatal("Expected ErrEndpointNotPaused, got ", err)
+	}
+
+	endpoint, err = alice.Disable(endpoint, "abuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Notify(endpoint, WebhookNotification{})
+	if err != ErrEndpointDisabled {
+		t.Fatal("Expected ErrEndpointDisabled, got ", err)
+	}
+	_, err = svc.Suspend(endpoint, "")
+	if err != ErrIllegalStatusTransition {
+		t.Fatal("Expected disabled endpoints not to be suspended, got ", err)
+	}
+	_, err = svc.Verify(endpoint)
+	if err != ErrIllegalStatusTransition {
+		t.Fatal("Expected disabled endpoints not to be verified, got ", err)
+	}
+	_, err = svc.VerifyAsync(endpoint)
+	if err != ErrIllegalStatusTransition {
+		t.Fatal("Expected disabled endpoints not to be verified, got ", err)
+	}
+
+	// a new URL doesn't bring it back
+	endpoint.URL = server.URL + "/elsewhere"
+	_, err = svc.UpdateURL(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err = svc.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Status != Disabled {
+		t.Fatal("Expected the endpoint to stay disabled, found ", endpoint.Status)
+	}
+
+	endpoint, err = alice.Resume(endpoint, "sorted out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Status != Unverified {
+		t.Fatal("Expected the endpoint to be verified again first, found ", endpoint.Status)
+	}
+
+	history, err := svc.StatusHistory(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []StatusChange{
+		{From: Unverified, To: Verified, Actor: "alice", Reason: "passed verification"},
+		{From: Verified, To: Suspended, Actor: "alice", Reason: "consumer asked for it"},
+		{From: Suspended, To: Verified, Actor: "", Reason: ""},
+		{From: Verified, To: Disabled, Actor: "alice", Reason: "abuse"},
+		{From: Disabled, To: Unverified, Actor: "alice", Reason: "sorted out"},
+	}
+	if len(history) != len(expected) {
+		t.Fatal("Expected ", len(expected), " status changes, found ", history)
+	}
+	for i, change := range history {
+		if change.From != expected[i].From || change.To != expected[i].To ||
+			change.Actor != expected[i].Actor || change.Reason != expected[i].Reason || change.ChangedAt.IsZero() {
+			t.Fatal("Expected ", expected[i], " found ", change)
+		}
+	}
+
+	_, err = svc.WithActor("")
+	if err != ErrInvalidActor {
+		t.Fatal("Expected ErrInvalidActor, got ", err)
+	}
+	_, err = svc.Disable(endpoint, strings.Repeat("x", 256))
+	if err != ErrStatusReasonTooLong {
+		t.Fatal("Expected ErrStatusReasonTooLong, got ", err)
+	}
+	_, err = svc.Resume(endpoint, strings.Repeat("x", 256))
+	if err != ErrStatusReasonTooLong {
+		t.Fatal("Expected ErrStatusReasonTooLong, got ", err)
+	}
+}
+
+func Test_StaleStatusChange(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint := newVerifiedEndpointForTests(t, svc, server.URL)
+
+	// loaded by a worker, then disabled while it was busy
+	stale, err := svc.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.Disable(endpoint, "abuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.changeStatus(stale, Healthy, SystemActor, "passed a health check", nil)
+	if err != ErrStatusChanged {
+		t.Fatal("Expected ErrStatusChanged, got ", err)
+	}
+
+	endpoint, err = svc.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Status != Disabled {
+		t.Fatal("Expected the endpoint to stay disabled, found ", endpoint.Status)
+	}
+	history, err := svc.StatusHistory(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[1].To != Disabled {
+		t.Fatal("Expected only the verification and the disabling in the history, found ", history)
+	}
+}
+
+// arm(action) runs action once, right after the next query for an endpoint,
+// as if it landed between fetching the endpoint and saving it
+func afterEndpointFetchForTests(t *testing.T, svc *WebhookEndpointServiceImpl) (arm func(action func())) {
+	var next func()
+	err := svc.db.Callback().Query().After("gorm:query").Register("test:after_fetch", func(db *gorm.DB) {
+		if next != nil && db.Statement.Table == "webhook_endpoint_dbs" {
+			action := next
+			next = nil
+			action()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(action func()) { next = action }
+}
+
+func Test_UpdateRacingSuspend(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint := newVerifiedEndpointForTests(t, svc, server.URL)
+	arm := afterEndpointFetchForTests(t, svc)
+	suspend := func() {
+		_, err := svc.Suspend(endpoint, "maintenance")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a new URL would reset the status, which changed in the meantime
+	arm(suspend)
+	moved := endpoint
+	moved.URL = server.URL + "/moved"
+	_, err = svc.Update(moved)
+	if err != ErrStatusChanged {
+		t.Fatal("Expected ErrStatusChanged, got ", err)
+	}
+	stored, err := svc.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != Suspended || stored.URL != endpoint.URL {
+		t.Fatal("Expected the endpoint to stay suspended at its URL, found ", stored.Status, stored.URL)
+	}
+
+	// same with UpdateURL
+	_, err = svc.Resume(endpoint, "done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm(suspend)
+	_, err = svc.UpdateURL(moved)
+	if err != ErrStatusChanged {
+		t.Fatal("Expected ErrStatusChanged from UpdateURL, got ", err)
+	}
+
+	// without a new URL, the suspension is kept alongside the update
+	_, err = svc.Resume(endpoint, "done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm(suspend)
+	described := endpoint
+	described.Description = "billing events"
+	_, err = svc.Update(described)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err = svc.Get(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != Suspended || stored.Description != "billing events" {
+		t.Fatal("Expected the suspension and the description, found ", stored.Status, stored.Description)
+	}
+}
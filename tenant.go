@@ -0,0 +1,200 @@
+package ironhook
+
+import (
+	"errors"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Overrides HOOK_TENANT_MAX_ENDPOINTS for a single tenant
+type WebhookTenantQuotaDB struct {
+	gorm.Model
+	TenantID string `gorm:"not null"`
+	// 0 for no limit
+	MaxEndpoints int `gorm:"not null"`
+}
+
+// One row per tenant, locked while its quota is checked and added to,
+// so services sharing the database take turns
+type WebhookTenantLockDB struct {
+	ID       uint   `gorm:"primarykey"`
+	TenantID string `gorm:"not null"`
+	LockedAt time.Time
+}
+
+// Returns a view of the service limited to a single tenant.
+//
+// Endpoints created through it belong to the tenant, and endpoints or
+// notifications of other tenants can't be read, updated or notified,
+// they're reported as missing instead.
+//
+// Operations spanning all tenants, like migrations, Purge or Export,
+// are only available on the service returned by NewWebhookService.
+func (s *WebhookEndpointServiceImpl) ForTenant(tenant_id string) (WebhookEndpointService, error) {
+
+	// a tenant can't switch to another one
+	if err := s.allTenantsOnly(); err != nil {
+		return nil, err
+	}
+	if tenant_id == "" {
+		return nil, ErrEmptyTenantID
+	}
+
+	scoped := *s
+	scoped.tenant = tenant_id
+	return &scoped, nil
+}
+
+// Limits the number of endpoints a tenant can have, 0 for no limit.
+// Tenants without a quota of their own get HOOK_TENANT_MAX_ENDPOINTS
+func (s *WebhookEndpointServiceImpl) SetTenantQuota(tenant_id string, max_endpoints int) error {
+
+	if err := s.allTenantsOnly(); err != nil {
+		return err
+	}
+	if tenant_id == "" {
+		return ErrEmptyTenantID
+	}
+	if max_endpoints < 0 {
+		return ErrInvalidTenantQuota
+	}
+
+	var quota WebhookTenantQuotaDB
+	tx := s.db.Where(WebhookTenantQuotaDB{TenantID: tenant_id}).FirstOrInit(&quota)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	s.log.Info(
+		"setting a tenant quota",
+		zap.String("TenantID", tenant_id),
+		zap.Int("MaxEndpoints", max_endpoints),
+	)
+
+	quota.MaxEndpoints = max_endpoints
+	return s.db.Save(&quota).Error
+}
+
+// Limits queries to the tenant of a tenant view, a no-op otherwise
+func (s *WebhookEndpointServiceImpl) tenantScope(tx *gorm.DB) *gorm.DB {
+	if s.tenant == "" {
+		return tx
+	}
+	return tx.Where("tenant_id = ?", s.tenant)
+}
+
+func (s *WebhookEndpointServiceImpl) allTenantsOnly() error {
+	if s.tenant != "" {
+		return ErrNotAllowedForTenant
+	}
+	return nil
+}
+
+// Adds an endpoint to the tenant, unless it reached its quota.
+//
+// The check and the insert run in one transaction, which first locks
+// the tenant's row in the database, so concurrent calls don't get past
+// the quota together, whichever service instance they're made on.
+func (s *WebhookEndpointServiceImpl) withinTenantQuota(tenant_id string, insert func(tx *gorm.DB) error) error {
+
+	if tenant_id == "" {
+		return s.db.Transaction(insert)
+	}
+
+	err := s.db.
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&WebhookTenantLockDB{TenantID: tenant_id, LockedAt: time.Now()}).
+		Error
+	if err != nil && !retryableTxError(err) {
+		s.log.Error("couldnt create the tenant lock", zap.Error(err))
+		return err
+	}
+
+	return retryTx(func() error {
+		return s.db.Transaction(func(tx *gorm.DB) error {
+			// the first write of the transaction, the row stays locked until it ends
+			err := tx.Model(&WebhookTenantLockDB{}).
+				Where("tenant_id = ?", tenant_id).
+				UpdateColumn("locked_at", time.Now()).
+				Error
+			if err != nil {
+				return err
+			}
+			err = s.checkTenantQuota(tx, tenant_id)
+			if err != nil {
+				return err
+			}
+			return insert(tx)
+		})
+	})
+}
+
+// Checks if the tenant can have another endpoint
+func (s *WebhookEndpointServiceImpl) checkTenantQuota(db *gorm.DB, tenant_id string) error {
+
+	if tenant_id == "" {
+		return nil
+	}
+
+	max_endpoints := viper.GetInt("tenant_max_endpoints")
+
+	var quotas []WebhookTenantQuotaDB
+	tx := db.Where("tenant_id = ?", tenant_id).Limit(1).Find(&quotas)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if len(quotas) > 0 {
+		max_endpoints = quotas[0].MaxEndpoints
+	}
+	if max_endpoints <= 0 {
+		return nil
+	}
+
+	var count int64
+	tx = db.Model(&WebhookEndpointDB{}).Where("tenant_id = ?", tenant_id).Count(&count)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if count >= int64(max_endpoints) {
+		s.log.Warn(
+			"tenant reached its endpoints quota",
+			zap.String("TenantID", tenant_id),
+			zap.Int("MaxEndpoints", max_endpoints),
+		)
+		return ErrTenantQuotaExceeded
+	}
+	return nil
+}
+
+var ErrEmptyTenantID error = errors.New(
+	`
+	cant scope the service to an empty tenant.
+	Recover by retrying with a non-empty tenant ID
+	`,
+)
+var ErrNotAllowedForTenant error = errors.New(
+	`
+	this operation spans all tenants and isnt available on a tenant view.
+	Recover by calling it on the service returned by NewWebhookService
+	`,
+)
+var ErrTenantMismatch error = errors.New(
+	`
+	the endpoint belongs to a different tenant than the service view.
+	Recover by retrying without a TenantID or with the tenant of the view
+	`,
+)
+var ErrTenantQuotaExceeded error = errors.New(
+	`
+	the tenant has reached the maximum number of endpoints.
+	Recover by deleting one of its endpoints or raising its quota
+	`,
+)
+var ErrInvalidTenantQuota error = errors.New(
+	"cant accept a negative quota, use 0 for no limit",
+)
@@ -0,0 +1,291 @@
+package ironhook
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gofrs/uuid"
+)
+
+func Test_TenantIsolation(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	mock_http_client := server.Client()
+	defer server.Close()
+
+	svc, err := NewWebhookService(mock_http_client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	acme, err := svc.ForTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	globex, err := svc.ForTenant("globex")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := newVerifiedEndpointForTests(t, acme, server.URL)
+	if endpoint.TenantID != "acme" {
+		t.Fatal("Expected the endpoint to belong to the tenant, found ", endpoint.TenantID)
+	}
+	err = acme.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = globex.Get(endpoint)
+	if err != ErrRecordNotFound {
+		t.Fatal("Expected ErrRecordNotFound for an endpoint of another tenant, got ", err)
+	}
+	err = globex.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4())})
+	if err != ErrRecordNotFound {
+		t.Fatal("Expected ErrRecordNotFound notifying an endpoint of another tenant, got ", err)
+	}
+	if countNotifications(t, globex, NotificationQuery{EndpointUUID: endpoint.UUID}) != 0 {
+		t.Fatal("Expected no notifications of another tenant to be listed")
+	}
+	if countNotifications(t, acme, NotificationQuery{EndpointUUID: endpoint.UUID}) != 1 {
+		t.Fatal("Expected the tenant to see its own notification")
+	}
+
+	endpoints, err := globex.ListEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*endpoints) != 0 {
+		t.Fatal("Expected no endpoints of another tenant to be listed, found ", len(*endpoints))
+	}
+
+	// the service itself sees every tenant
+	page, err := svc.ListEndpointsWithQuery(EndpointQuery{TenantID: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.TotalCount != 1 {
+		t.Fatal("Expected the tenant filter to find the endpoint, found ", page.TotalCount)
+	}
+
+	_, err = globex.Create(WebhookEndpoint{URL: server.URL, TenantID: "acme"})
+	if err != ErrTenantMismatch {
+		t.Fatal("Expected ErrTenantMismatch, got ", err)
+	}
+}
+
+func Test_TenantAdminOperations(t *testing.T) {
+
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	_, err = svc.ForTenant("")
+	if err != ErrEmptyTenantID {
+		t.Fatal("Expected ErrEmptyTenantID, got ", err)
+	}
+
+	acme, err := svc.ForTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = acme.ForTenant("globex"); err != ErrNotAllowedForTenant {
+		t.Fatal("Expected ErrNotAllowedForTenant switching tenants, got ", err)
+	}
+	if err = acme.Migrate(); err != ErrNotAllowedForTenant {
+		t.Fatal("Expected ErrNotAllowedForTenant migrating, got ", err)
+	}
+	if _, err = acme.ReEncrypt(); err != ErrNotAllowedForTenant {
+		t.Fatal("Expected ErrNotAllowedForTenant re-encrypting, got ", err)
+	}
+	if err = acme.SetTenantQuota("acme", 100); err != ErrNotAllowedForTenant {
+		t.Fatal("Expected ErrNotAllowedForTenant setting a quota, got ", err)
+	}
+	if err = acme.Close(); err != ErrNotAllowedForTenant {
+		t.Fatal("Expected ErrNotAllowedForTenant closing, got ", err)
+	}
+}
+
+func Test_TenantQuota(t *testing.T) {
+
+	t.Setenv("HOOK_TENANT_MAX_ENDPOINTS", "1")
+
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	acme, err := svc.ForTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = acme.Create(WebhookEndpoint{URL: "https://example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = acme.Create(WebhookEndpoint{URL: "https://example.com"})
+	if err != ErrTenantQuotaExceeded {
+		t.Fatal("Expected ErrTenantQuotaExceeded, got ", err)
+	}
+
+	err = svc.SetTenantQuota("acme", -1)
+	if err != ErrInvalidTenantQuota {
+		t.Fatal("Expected ErrInvalidTenantQuota, got ", err)
+	}
+	err = svc.SetTenantQuota("acme", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = acme.Create(WebhookEndpoint{URL: "https://example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = acme.Create(WebhookEndpoint{URL: "https://example.com"})
+	if err != ErrTenantQuotaExceeded {
+		t.Fatal("Expected ErrTenantQuotaExceeded after raising the quota, got ", err)
+	}
+
+	// endpoints without a tenant aren't limited
+	for i := 0; i < 3; i++ {
+		_, err = svc.Create(WebhookEndpoint{URL: "https://example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_TenantQuotaRestore(t *testing.T) {
+
+	t.Setenv("HOOK_TENANT_MAX_ENDPOINTS", "1")
+
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	acme, err := svc.ForTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := acme.Create(WebhookEndpoint{URL: "https://example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = acme.Delete(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = acme.Create(WebhookEndpoint{URL: "https://example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the deleted one would make two
+	_, err = acme.Restore(deleted)
+	if err != ErrTenantQuotaExceeded {
+		t.Fatal("Expected ErrTenantQuotaExceeded, got ", err)
+	}
+	listed, err := acme.ListDeletedEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*listed) != 1 {
+		t.Fatal("Expected the endpoint to stay deleted")
+	}
+}
+
+func Test_TenantQuotaConcurrentCreate(t *testing.T) {
+
+	t.Setenv("HOOK_TENANT_MAX_ENDPOINTS", "3")
+
+	svc, err := NewWebhookService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	acme, err := svc.ForTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := acme.Create(WebhookEndpoint{URL: "https://example.com"})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+		} else if err != ErrTenantQuotaExceeded {
+			t.Fatal(err)
+		}
+	}
+	if created != 3 {
+		t.Fatal("Expected exactly 3 endpoints created, found ", created)
+	}
+}
+
+// two services on one database, like two instances of an app
+func Test_TenantQuotaAcrossServices(t *testing.T) {
+
+	t.Setenv("HOOK_TENANT_MAX_ENDPOINTS", "3")
+	t.Setenv("HOOK_DB_DSN", filepath.Join(t.TempDir(), "hooks.db"))
+
+	var tenants []WebhookEndpointService
+	for i := 0; i < 2; i++ {
+		svc, err := NewWebhookService(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer svc.Close()
+		acme, err := svc.ForTenant("acme")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tenants = append(tenants, acme)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(acme WebhookEndpointService) {
+			defer wg.Done()
+			_, err := acme.Create(WebhookEndpoint{URL: "https://example.com"})
+			errs <- err
+		}(tenants[i%2])
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+		} else if err != ErrTenantQuotaExceeded {
+			t.Fatal(err)
+		}
+	}
+	if created != 3 {
+		t.Fatal("Expected exactly 3 endpoints created across both services, found ", created)
+	}
+}
@@ -0,0 +1,426 @@
+package ironhook
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// TLS settings of an endpoint, all PEM encoded, see service.SetTLS()
+type EndpointTLS struct {
+	// Client certificate and its private key, for mutual TLS
+	ClientCertificate string `json:"client_certificate,omitempty"`
+	ClientKey         string `json:"client_key,omitempty"`
+	// Replaces the system roots when verifying the endpoint's certificate
+	CABundle string `json:"ca_bundle,omitempty"`
+}
+
+// associated data of the encrypted TLS settings
+const endpointTLSColumn = "webhook_endpoint_dbs.tls_config"
+
+func (c EndpointTLS) empty() bool {
+	return c.ClientCertificate == "" && c.ClientKey == "" && c.CABundle == ""
+}
+
+func (c EndpointTLS) validate() error {
+
+	if (c.ClientCertificate == "") != (c.ClientKey == "") {
+		return ErrInvalidEndpointTLS
+	}
+	if c.ClientCertificate != "" {
+		if _, err := tls.X509KeyPair([]byte(c.ClientCertificate), []byte(c.ClientKey)); err != nil {
+			return ErrInvalidEndpointTLS
+		}
+	}
+	if c.CABundle != "" {
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(c.CABundle)) {
+			return ErrInvalidEndpointTLS
+		}
+	}
+	return nil
+}
+
+// tls.Config on top of the base one, so the rest of the settings carry over
+func (c EndpointTLS) tlsConfig(base *tls.Config) (*tls.Config, error) {
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if base != nil {
+		config = base.Clone()
+	}
+
+	if c.ClientCertificate != "" {
+		certificate, err := tls.X509KeyPair([]byte(c.ClientCertificate), []byte(c.ClientKey))
+		if err != nil {
+			return nil, ErrInvalidEndpointTLS
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if c.CABundle != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(c.CABundle)) {
+			return nil, ErrInvalidEndpointTLS
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// the earliest expiring certificate, client or CA
+func (c EndpointTLS) firstExpiry() (string, time.Time) {
+
+	var subject string
+	var not_after time.Time
+	for _, bundle := range []string{c.ClientCertificate, c.CABundle} {
+		rest := []byte(bundle)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				continue
+			}
+			if not_after.IsZero() || certificate.NotAfter.Before(not_after) {
+				subject = certificate.Subject.String()
+				not_after = certificate.NotAfter
+			}
+		}
+	}
+	return subject, not_after
+}
+
+func (c EndpointTLS) fingerprint() string {
+	encoded, _ := json.Marshal(c)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// Replaces the TLS settings of the endpoint, EndpointTLS{} goes back to
+// the service-wide ones. They're encrypted at rest when a key provider
+// is configured and never handed back, endpoints only tell TLSConfigured.
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) SetTLS(endpoint WebhookEndpoint, tls_settings EndpointTLS) (WebhookEndpoint, error) {
+
+	if err := tls_settings.validate(); err != nil {
+		return endpoint, err
+	}
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+
+	err = s.encryptTLS(model_endpoint, tls_settings)
+	if err != nil {
+		return endpoint, err
+	}
+
+	s.log.Info(
+		"updating the endpoint TLS settings",
+		zap.String("UUID", endpoint.UUID.String()),
+		zap.Bool("ClientCertificate", tls_settings.ClientCertificate != ""),
+		zap.Bool("CABundle", tls_settings.CABundle != ""),
+	)
+
+	tx := s.db.Model(model_endpoint).UpdateColumns(map[string]interface{}{
+		"tls_config":            model_endpoint.TLSConfig,
+		"tls_encryption_key_id": model_endpoint.TLSEncryptionKeyID,
+	})
+	if tx.Error != nil {
+		s.log.Error("couldnt save the endpoint TLS settings", zap.Error(tx.Error))
+		return endpoint, tx.Error
+	}
+
+	s.transports.forget(model_endpoint.UUID)
+	s.warnAboutCertificateExpiry(model_endpoint.UUID, tls_settings)
+
+	return *endpointDbToWeb(model_endpoint), nil
+}
+
+// sets the TLS columns of the endpoint
+func (s *WebhookEndpointServiceImpl) encryptTLS(model_endpoint *WebhookEndpointDB, tls_settings EndpointTLS) error {
+
+	model_endpoint.TLSConfig = ""
+	model_endpoint.TLSEncryptionKeyID = ""
+	if tls_settings.empty() {
+		return nil
+	}
+
+	config, err := json.Marshal(tls_settings)
+	if err != nil {
+		return err
+	}
+	encrypted, key_id, err := s.cipher.encrypt(string(config), binding{endpointTLSColumn, model_endpoint.UUID.String()})
+	if err != nil {
+		s.log.Error("couldnt encrypt the endpoint TLS settings", zap.Error(err))
+		return err
+	}
+	model_endpoint.TLSConfig = encrypted
+	model_endpoint.TLSEncryptionKeyID = key_id
+	return nil
+}
+
+func (s *WebhookEndpointServiceImpl) decryptTLS(model_endpoint *WebhookEndpointDB) (EndpointTLS, error) {
+
+	if model_endpoint.TLSConfig == "" {
+		return EndpointTLS{}, nil
+	}
+
+	config, err := s.cipher.decrypt(model_endpoint.TLSConfig, model_endpoint.TLSEncryptionKeyID, binding{endpointTLSColumn, model_endpoint.UUID.String()})
+	if err != nil {
+		s.log.Error(
+			"couldnt decrypt the endpoint TLS settings",
+			zap.String("UUID", model_endpoint.UUID.String()),
+			zap.Error(err),
+		)
+		return EndpointTLS{}, err
+	}
+
+	var tls_settings EndpointTLS
+	err = json.Unmarshal([]byte(config), &tls_settings)
+	return tls_settings, err
+}
+
+// The base client, or a copy of it with the endpoint's own transport
+// if the endpoint has TLS settings
+func (s *WebhookEndpointServiceImpl) clientForEndpoint(base *http.Client, model_endpoint *WebhookEndpointDB) (*http.Client, error) {
+
+	tls_settings, err := s.decryptTLS(model_endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if tls_settings.empty() {
+		return base, nil
+	}
+
+	transport, err := s.transports.get(model_endpoint.UUID, tls_settings, s.http.Transport)
+	if err != nil {
+		return nil, err
+	}
+
+	client := *base
+	client.Transport = transport
+	return &client, nil
+}
+
+// Per endpoint transports, kept around for their connection pools
+// and shared by the tenant views
+type transportCache struct {
+	mu         sync.Mutex
+	transports map[uuid.UUID]cachedTransport
+	// for services whose own transport isn't an *http.Transport
+	fallback *http.Transport
+}
+
+type cachedTransport struct {
+	fingerprint string
+	transport   *http.Transport
+}
+
+func newTransportCache(fallback *http.Transport) *transportCache {
+	return &transportCache{transports: map[uuid.UUID]cachedTransport{}, fallback: fallback}
+}
+
+// built from the service-wide transport, if it's an *http.Transport,
+// or from the guarded fallback
+func (c *transportCache) get(endpoint_uuid uuid.UUID, tls_settings EndpointTLS, base http.RoundTripper) (*http.Transport, error) {
+
+	fingerprint := tls_settings.fingerprint()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.transports[endpoint_uuid]
+	if ok && cached.fingerprint == fingerprint {
+		return cached.transport, nil
+	}
+	if ok {
+		cached.transport.CloseIdleConnections()
+	}
+
+	template, ok := base.(*http.Transport)
+	if !ok {
+		template = c.fallback
+	}
+	transport := template.Clone()
+
+	config, err := tls_settings.tlsConfig(template.TLSClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = config
+
+	c.transports[endpoint_uuid] = cachedTransport{fingerprint: fingerprint, transport: transport}
+	return transport, nil
+}
+
+func (c *transportCache) forget(endpoint_uuid uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.transports[endpoint_uuid]; ok {
+		cached.transport.CloseIdleConnections()
+		delete(c.transports, endpoint_uuid)
+	}
+}
+
+func (c *transportCache) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for endpoint_uuid, cached := range c.transports {
+		cached.transport.CloseIdleConnections()
+		delete(c.transports, endpoint_uuid)
+	}
+}
+
+// logs certificates expiring within HOOK_TLS_EXPIRY_WARNING
+func (s *WebhookEndpointServiceImpl) warnAboutCertificateExpiry(endpoint_uuid uuid.UUID, tls_settings EndpointTLS) {
+
+	subject, not_after := tls_settings.firstExpiry()
+	if not_after.IsZero() {
+		return
+	}
+
+	left := time.Until(not_after)
+	switch {
+	case left <= 0:
+		s.log.Error(
+			"endpoint certificate has expired",
+			zap.String("UUID", endpoint_uuid.String()),
+			zap.String("Subject", subject),
+			zap.Time("NotAfter", not_after),
+		)
+	case left <= viper.GetDuration("tls_expiry_warning"):
+		s.log.Warn(
+			"endpoint certificate expires soon",
+			zap.String("UUID", endpoint_uuid.String()),
+			zap.String("Subject", subject),
+			zap.Time("NotAfter", not_after),
+		)
+	}
+}
+
+// goes through every endpoint with TLS settings
+func (s *WebhookEndpointServiceImpl) checkCertificateExpiry() error {
+
+	var after uint
+	for {
+		var batch []WebhookEndpointDB
+		tx := s.db.
+			Where("id > ? AND tls_config <> ''", after).
+			Order("id").
+			Limit(rowBatchSize).
+			Find(&batch)
+		if tx.Error != nil {
+			return tx.Error
+		}
+
+		for i := range batch {
+			tls_settings, err := s.decryptTLS(&batch[i])
+			if err != nil {
+				// the other endpoints still get checked
+				s.log.Error(
+					"couldnt check the endpoint certificates",
+					zap.String("UUID", batch[i].UUID.String()),
+					zap.Error(err),
+				)
+				continue
+			}
+			s.warnAboutCertificateExpiry(batch[i].UUID, tls_settings)
+		}
+
+		if len(batch) < rowBatchSize {
+			return nil
+		}
+		after = batch[len(batch)-1].ID
+	}
+}
+
+func (s *WebhookEndpointServiceImpl) startCertificateWatch(interval time.Duration) {
+
+	s.log.Info(
+		"Starting the certificate expiry watch",
+		zap.Duration("Interval", interval),
+		zap.Duration("Warning", viper.GetDuration("tls_expiry_warning")),
+	)
+
+	s.runPeriodically(interval, func() {
+		err := s.checkCertificateExpiry()
+		if err != nil {
+			s.log.Error("Failed checking certificate expiry", zap.Error(err))
+		}
+	})
+}
+
+// part of service.ReEncrypt()
+func (s *WebhookEndpointServiceImpl) reEncryptEndpointTLS(current string) (int64, error) {
+
+	var total int64
+	var after uint
+	for {
+		var batch []WebhookEndpointDB
+		tx := s.db.Unscoped().
+			Where("id > ? AND tls_encryption_key_id <> ? AND tls_config <> ''", after, current).
+			Order("id").
+			Limit(rowBatchSize).
+			Find(&batch)
+		if tx.Error != nil {
+			s.log.Error("couldnt fetch endpoints for re-encryption", zap.Error(tx.Error))
+			return total, tx.Error
+		}
+
+		for i := range batch {
+			tls_settings, err := s.decryptTLS(&batch[i])
+			if err != nil {
+				return total, err
+			}
+			err = s.encryptTLS(&batch[i], tls_settings)
+			if err != nil {
+				return total, err
+			}
+			tx = s.db.Unscoped().
+				Model(&batch[i]).
+				UpdateColumns(map[string]interface{}{
+					"tls_config":            batch[i].TLSConfig,
+					"tls_encryption_key_id": batch[i].TLSEncryptionKeyID,
+				})
+			if tx.Error != nil {
+				s.log.Error("couldnt save a re-encrypted endpoint", zap.Error(tx.Error))
+				return total, tx.Error
+			}
+			total++
+		}
+
+		if len(batch) < rowBatchSize {
+			break
+		}
+		after = batch[len(batch)-1].ID
+	}
+	return total, nil
+}
+
+var ErrInvalidEndpointTLS error = errors.New(
+	`
+	cant use these TLS settings.
+	Recover by retrying with a PEM encoded client certificate along with
+	its private key, and/or a PEM encoded CA bundle
+	`,
+)
@@ -0,0 +1,252 @@
+package ironhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	cert_pem    string
+	key_pem     string
+}
+
+// signed by parent, self-signed without one
+func newTestCertificate(t *testing.T, name string, is_ca bool, not_after time.Time, parent *testCertificate) *testCertificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              not_after,
+		IsCA:                  is_ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signer_key := template, key
+	if parent != nil {
+		signer, signer_key = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signer_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{
+		certificate: certificate,
+		key:         key,
+		cert_pem:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		key_pem:     string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der})),
+	}
+}
+
+// a receiver behind a private CA, requiring client certificates signed by it
+func newMutualTLSServerForTests(t *testing.T, ca *testCertificate) *httptest.Server {
+
+	server_certificate := newTestCertificate(t, "receiver", false, time.Now().AddDate(1, 0, 0), ca)
+	key_pair, err := tls.X509KeyPair([]byte(server_certificate.cert_pem), []byte(server_certificate.key_pem))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client_cas := x509.NewCertPool()
+	client_cas.AddCert(ca.certificate)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/verification") {
+			fmt.Fprint(w, r.URL.Query().Get("id"))
+		}
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{key_pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    client_cas,
+	}
+	server.StartTLS()
+	return server
+}
+
+func Test_EndpointTLSValidation(t *testing.T) {
+
+	ca := newTestCertificate(t, "private CA", true, time.Now().AddDate(1, 0, 0), nil)
+	client := newTestCertificate(t, "ironhook", false, time.Now().AddDate(1, 0, 0), ca)
+
+	cases := []struct {
+		settings EndpointTLS
+		want     error
+	}{
+		{EndpointTLS{}, nil},
+		{EndpointTLS{CABundle: ca.cert_pem}, nil},
+		{EndpointTLS{ClientCertificate: client.cert_pem, ClientKey: client.key_pem}, nil},
+		{EndpointTLS{ClientCertificate: client.cert_pem}, ErrInvalidEndpointTLS},
+		{EndpointTLS{ClientCertificate: client.cert_pem, ClientKey: ca.key_pem}, ErrInvalidEndpointTLS},
+		{EndpointTLS{CABundle: "not a certificate"}, ErrInvalidEndpointTLS},
+	}
+	for _, c := range cases {
+		if err := c.settings.validate(); err != c.want {
+			t.Fatalf("have %v want %v", err, c.want)
+		}
+	}
+
+	expiring := newTestCertificate(t, "expiring", false, time.Now().Add(24*time.Hour), ca)
+	subject, not_after := EndpointTLS{
+		ClientCertificate: expiring.cert_pem,
+		ClientKey:         expiring.key_pem,
+		CABundle:          ca.cert_pem,
+	}.firstExpiry()
+	if subject != "CN=expiring" || !not_after.Equal(expiring.certificate.NotAfter) {
+		t.Fatal("Expected the expiring certificate to come first, found ", subject, not_after)
+	}
+}
+
+func Test_MutualTLSFlow(t *testing.T) {
+
+	ca := newTestCertificate(t, "private CA", true, time.Now().AddDate(1, 0, 0), nil)
+	client := newTestCertificate(t, "ironhook", false, time.Now().AddDate(1, 0, 0), ca)
+
+	server := newMutualTLSServerForTests(t, ca)
+	defer server.Close()
+
+	generic_svc, err := NewWebhookService(nil, WithKeyProvider(NewLocalKMS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	endpoint, err := svc.Create(WebhookEndpoint{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// private CA, unknown to the system roots
+	_, err = svc.Verify(endpoint)
+	if err == nil {
+		t.Fatal("Expected verification to fail without the CA bundle")
+	}
+
+	endpoint, err = svc.SetTLS(endpoint, EndpointTLS{CABundle: ca.cert_pem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no client certificate
+	_, err = svc.Verify(endpoint)
+	if err == nil {
+		t.Fatal("Expected verification to fail without a client certificate")
+	}
+
+	endpoint, err = svc.SetTLS(endpoint, EndpointTLS{
+		ClientCertificate: client.cert_pem,
+		ClientKey:         client.key_pem,
+		CABundle:          ca.cert_pem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !endpoint.TLSConfigured {
+		t.Fatal("Expected the endpoint to report its TLS settings")
+	}
+
+	var db_endpoint WebhookEndpointDB
+	svc.db.First(&db_endpoint, "uuid = ?", endpoint.UUID)
+	if db_endpoint.TLSEncryptionKeyID == "" || strings.Contains(db_endpoint.TLSConfig, "PRIVATE KEY") {
+		t.Fatal("Expected the TLS settings to be encrypted")
+	}
+
+	endpoint, err = svc.Verify(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = svc.Notify(endpoint, WebhookNotification{EventUUID: uuid.Must(uuid.NewV4())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.checkCertificateExpiry()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// one endpoint failing to decrypt doesn't stop the others from being checked
+func Test_CertificateExpirySkipsUndecryptable(t *testing.T) {
+
+	ca := newTestCertificate(t, "expiring CA", true, time.Now().Add(24*time.Hour), nil)
+
+	generic_svc, err := NewWebhookService(nil, WithKeyProvider(NewLocalKMS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generic_svc.Close()
+	svc := generic_svc.(*WebhookEndpointServiceImpl)
+
+	var endpoints []WebhookEndpoint
+	for i := 0; i < 2; i++ {
+		endpoint, err := svc.Create(WebhookEndpoint{URL: "http://localhost:8080"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoint, err = svc.SetTLS(endpoint, EndpointTLS{CABundle: ca.cert_pem})
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	// the first one can't be decrypted anymore
+	err = svc.db.Model(&WebhookEndpointDB{}).
+		Where("uuid = ?", endpoints[0].UUID).
+		Update("tls_config", "not encrypted").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zap.WarnLevel)
+	svc.log = zap.New(core)
+
+	err = svc.checkCertificateExpiry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs.FilterMessage("couldnt check the endpoint certificates").Len() != 1 {
+		t.Fatal("Expected the first endpoint to fail decrypting, logs: ", logs.All())
+	}
+	warned := logs.FilterMessage("endpoint certificate expires soon").FilterField(zap.String("UUID", endpoints[1].UUID.String()))
+	if warned.Len() != 1 {
+		t.Fatal("Expected the second endpoint to be checked, logs: ", logs.All())
+	}
+}
@@ -0,0 +1,198 @@
+package ironhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+)
+
+// Decides which notification topics an endpoint receives through
+// service.NotifyOwner(). Patterns are globs as in path.Match,
+// like "orders.*" or "invoice.paid".
+//
+// An endpoint without include patterns receives every topic
+// which isn't excluded.
+type TopicFilter struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+func (f TopicFilter) valid() bool {
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if pattern == "" {
+			return false
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Excludes win over includes
+func (f TopicFilter) matches(topic string) bool {
+
+	for _, pattern := range f.Exclude {
+		if ok, _ := path.Match(pattern, topic); ok {
+			return false
+		}
+	}
+
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		if ok, _ := path.Match(pattern, topic); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// stored as a JSON array, empty string for no patterns
+func encodeTopics(patterns []string) string {
+	if len(patterns) == 0 {
+		return ""
+	}
+	encoded, _ := json.Marshal(patterns)
+	return string(encoded)
+}
+
+func decodeTopics(encoded string) []string {
+	if encoded == "" {
+		return nil
+	}
+	var patterns []string
+	if err := json.Unmarshal([]byte(encoded), &patterns); err != nil {
+		return nil
+	}
+	return patterns
+}
+
+// Replaces the endpoint's topic filter, an empty filter receives every topic.
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) SetTopicFilter(endpoint WebhookEndpoint, filter TopicFilter) (WebhookEndpoint, error) {
+
+	if !filter.valid() {
+		return endpoint, ErrInvalidTopicPattern
+	}
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+
+	s.log.Info(
+		"updating the topic filter",
+		zap.String("UUID", endpoint.UUID.String()),
+		zap.Strings("Include", filter.Include),
+		zap.Strings("Exclude", filter.Exclude),
+	)
+
+	model_endpoint.IncludeTopics = encodeTopics(filter.Include)
+	model_endpoint.ExcludeTopics = encodeTopics(filter.Exclude)
+	tx := s.db.Model(model_endpoint).UpdateColumns(map[string]interface{}{
+		"include_topics": model_endpoint.IncludeTopics,
+		"exclude_topics": model_endpoint.ExcludeTopics,
+	})
+	if tx.Error != nil {
+		s.log.Error("couldnt save the topic filter", zap.Error(tx.Error))
+		return endpoint, tx.Error
+	}
+
+	return *endpointDbToWeb(model_endpoint), nil
+}
+
+// Sends the notification to every verified endpoint of the owner,
+// see service.ForTenant(), whose topic filter matches the notification's topic.
+//
+// Returns the UUIDs of the endpoints notified successfully. When some of
+// them fail the error is a *NotifyOwnerError, the rest are still notified.
+func (s *WebhookEndpointServiceImpl) NotifyOwner(owner_id string, notification WebhookNotification) ([]uuid.UUID, error) {
+
+	if owner_id == "" {
+		return nil, ErrEmptyTenantID
+	}
+	if s.tenant != "" && s.tenant != owner_id {
+		return nil, ErrTenantMismatch
+	}
+
+	var db_endpoints []WebhookEndpointDB
+	tx := s.db.
+		Where("tenant_id = ? AND status IN ?", owner_id, []WebhookEndpointStatus{Verified, Healthy}).
+		Order("id").
+		Find(&db_endpoints)
+	if tx.Error != nil {
+		s.log.Error("couldnt fetch the owner's endpoints", zap.Error(tx.Error))
+		return nil, tx.Error
+	}
+
+	notified := []uuid.UUID{}
+	failed := map[uuid.UUID]error{}
+	for i := range db_endpoints {
+		endpoint := endpointDbToWeb(&db_endpoints[i])
+		if !endpoint.TopicFilter.matches(notification.Topic) {
+			continue
+		}
+
+		err := s.Notify(*endpoint, notification)
+		if err != nil {
+			failed[endpoint.UUID] = err
+			continue
+		}
+		notified = append(notified, endpoint.UUID)
+	}
+
+	s.log.Info(
+		"Notified the owner's endpoints",
+		zap.String("TenantID", owner_id),
+		zap.String("Topic", notification.Topic),
+		zap.Int("Notified", len(notified)),
+		zap.Int("Failed", len(failed)),
+	)
+
+	if len(failed) > 0 {
+		return notified, &NotifyOwnerError{Failed: failed}
+	}
+	return notified, nil
+}
+
+// Endpoints NotifyOwner couldn't notify, along with the reason
+type NotifyOwnerError struct {
+	Failed map[uuid.UUID]error
+}
+
+func (e *NotifyOwnerError) Error() string {
+
+	reasons := make([]string, 0, len(e.Failed))
+	for endpoint_uuid, err := range e.Failed {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", endpoint_uuid, strings.TrimSpace(err.Error())))
+	}
+	sort.Strings(reasons)
+
+	return fmt.Sprintf("failed notifying %d endpoint(s): %s", len(e.Failed), strings.Join(reasons, "; "))
+}
+
+// errors.Is(err, ErrFailedNotifyingTheEndpoint) holds if any endpoint failed with it
+func (e *NotifyOwnerError) Is(target error) bool {
+	for _, err := range e.Failed {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+var ErrInvalidTopicPattern error = errors.New(
+	`
+	cant accept this topic pattern.
+	Recover by retrying with non-empty patterns in path.Match syntax, like "orders.*"
+	`,
+)
@@ -0,0 +1,117 @@
+package ironhook
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gofrs/uuid"
+)
+
+func Test_TopicFilterMatches(t *testing.T) {
+
+	cases := []struct {
+		filter TopicFilter
+		topic  string
+		want   bool
+	}{
+		{TopicFilter{}, "orders.created", true},
+		{TopicFilter{Include: []string{"orders.*"}}, "orders.created", true},
+		{TopicFilter{Include: []string{"orders.*"}}, "invoices.paid", false},
+		{TopicFilter{Include: []string{"orders.*", "invoices.paid"}}, "invoices.paid", true},
+		{TopicFilter{Exclude: []string{"orders.deleted"}}, "orders.deleted", false},
+		{TopicFilter{Exclude: []string{"orders.deleted"}}, "orders.created", true},
+		{TopicFilter{Include: []string{"orders.*"}, Exclude: []string{"orders.deleted"}}, "orders.deleted", false},
+		{TopicFilter{Include: []string{"orders.*"}}, "", false},
+	}
+
+	for _, c := range cases {
+		if got := c.filter.matches(c.topic); got != c.want {
+			t.Fatalf("%+v matching %q: have %v want %v", c.filter, c.topic, got, c.want)
+		}
+	}
+
+	if (TopicFilter{Include: []string{"orders.["}}).valid() {
+		t.Fatal("Expected a malformed pattern to be invalid")
+	}
+	if (TopicFilter{Exclude: []string{""}}).valid() {
+		t.Fatal("Expected an empty pattern to be invalid")
+	}
+}
+
+func Test_NotifyOwner(t *testing.T) {
+
+	server := mockHttpWebhooksServerForTests()
+	mock_http_client := server.Client()
+	defer server.Close()
+
+	svc, err := NewWebhookService(mock_http_client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	acme, err := svc.ForTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = acme.Create(WebhookEndpoint{URL: server.URL, TopicFilter: TopicFilter{Include: []string{"["}}})
+	if err != ErrInvalidTopicPattern {
+		t.Fatal("Expected ErrInvalidTopicPattern, got ", err)
+	}
+
+	everything := newVerifiedEndpointForTests(t, acme, server.URL)
+	orders := newVerifiedEndpointForTests(t, acme, server.URL+"/orders")
+	orders, err = acme.SetTopicFilter(orders, TopicFilter{Include: []string{"orders.*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders.TopicFilter.Include) != 1 {
+		t.Fatal("Expected the topic filter to be saved, found ", orders.TopicFilter)
+	}
+	// not verified, never notified
+	_, err = acme.Create(WebhookEndpoint{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another owner
+	newVerifiedEndpointForTests(t, svc, server.URL)
+
+	notified, err := svc.NotifyOwner("acme", WebhookNotification{EventUUID: uuid.Must(uuid.NewV4()), Topic: "orders.created"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notified) != 2 {
+		t.Fatal("Expected both endpoints to be notified, found ", notified)
+	}
+
+	notified, err = acme.NotifyOwner("acme", WebhookNotification{EventUUID: uuid.Must(uuid.NewV4()), Topic: "invoices.paid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notified) != 1 || notified[0] != everything.UUID {
+		t.Fatal("Expected only the unfiltered endpoint to be notified, found ", notified)
+	}
+
+	_, err = acme.NotifyOwner("globex", WebhookNotification{Topic: "orders.created"})
+	if err != ErrTenantMismatch {
+		t.Fatal("Expected ErrTenantMismatch, got ", err)
+	}
+
+	// a failing endpoint doesn't stop the others
+	failing := newVerifiedEndpointForTests(t, acme, server.URL+"/failing")
+	notified, err = acme.NotifyOwner("acme", WebhookNotification{EventUUID: uuid.Must(uuid.NewV4()), Topic: "orders.created"})
+	var owner_err *NotifyOwnerError
+	if !errors.As(err, &owner_err) {
+		t.Fatal("Expected a NotifyOwnerError, got ", err)
+	}
+	if len(owner_err.Failed) != 1 || owner_err.Failed[failing.UUID] == nil {
+		t.Fatal("Expected the failing endpoint to be reported, found ", owner_err.Failed)
+	}
+	if !errors.Is(err, ErrFailedNotifyingTheEndpoint) {
+		t.Fatal("Expected the error to wrap ErrFailedNotifyingTheEndpoint")
+	}
+	if len(notified) != 2 {
+		t.Fatal("Expected the other endpoints to be notified, found ", notified)
+	}
+}
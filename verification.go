@@ -0,0 +1,379 @@
+package ironhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// How Verify checks the endpoint is under the receiver's control
+type VerificationMode string
+
+const (
+	// ?id=<uuid>, the endpoint answers with the UUID
+	VerificationEcho VerificationMode = "echo"
+	// ?id=<uuid>&nonce=<nonce>, signed with the endpoint secret.
+	// The endpoint answers with ChallengeResponse(secret, nonce)
+	VerificationChallenge VerificationMode = "challenge"
+	// ?id=<uuid>&challenge=<random>, the endpoint answers with the challenge,
+	// like Slack and Dropbox handshakes
+	VerificationChallengeEcho VerificationMode = "challenge-echo"
+)
+
+func (m VerificationMode) valid() bool {
+	switch m {
+	case VerificationEcho, VerificationChallenge, VerificationChallengeEcho:
+		return true
+	}
+	return false
+}
+
+// name of the query parameter, or JSON field, holding the random value
+func (m VerificationMode) challengeField() string {
+	switch m {
+	case VerificationChallenge:
+		return "nonce"
+	case VerificationChallengeEcho:
+		return "challenge"
+	}
+	return ""
+}
+
+// What Verify does when the endpoint answers with a redirect
+type RedirectPolicy string
+
+const (
+	// Follow redirects like the service's HTTP client does
+	RedirectFollow RedirectPolicy = "follow"
+	// Follow redirects within the endpoint's host only
+	RedirectSameHost RedirectPolicy = "same-host"
+	// Don't follow redirects, verification fails
+	RedirectNone RedirectPolicy = "none"
+)
+
+// net/http gives up after as many
+const maxRedirects = 10
+
+func (p RedirectPolicy) valid() bool {
+	switch p {
+	case RedirectFollow, RedirectSameHost, RedirectNone:
+		return true
+	}
+	return false
+}
+
+type verificationSettings struct {
+	// for endpoints without a protocol of their own
+	protocol VerificationProtocol
+	// see verificationClient
+	timeout   time.Duration
+	redirects RedirectPolicy
+	// how long an unanswered challenge nonce is kept
+	nonceTTL time.Duration
+	// see VerifyAsync
+	retryInterval   time.Duration
+	pendingWindow   time.Duration
+	confirmationURL string
+}
+
+// HOOK_VERIFICATION_* settings
+func verificationSettingsFromConfig() (verificationSettings, error) {
+
+	settings := verificationSettings{
+		protocol: VerificationProtocol{
+			Mode:          VerificationMode(strings.ToLower(viper.GetString("verification_mode"))),
+			Path:          viper.GetString("verification_path"),
+			Method:        viper.GetString("verification_method"),
+			ResponseField: viper.GetString("verification_response_field"),
+		}.withDefaults(),
+		timeout:   viper.GetDuration("verification_timeout"),
+		redirects: RedirectPolicy(strings.ToLower(viper.GetString("verification_redirects"))),
+		nonceTTL:  viper.GetDuration("verification_nonce_ttl"),
+
+		retryInterval:   viper.GetDuration("verification_retry_interval"),
+		pendingWindow:   viper.GetDuration("verification_pending_window"),
+		confirmationURL: viper.GetString("verification_confirmation_url"),
+	}
+
+	if err := settings.protocol.validate(); err != nil {
+		return settings, err
+	}
+	if settings.timeout <= 0 {
+		return settings, ErrInvalidVerificationTimeout
+	}
+	if !settings.redirects.valid() {
+		return settings, ErrUnsupportedRedirectPolicy
+	}
+	// the answer has to make it back before the nonce expires
+	if settings.nonceTTL < settings.timeout {
+		return settings, ErrInvalidNonceTTL
+	}
+	if settings.retryInterval <= 0 || settings.pendingWindow <= 0 {
+		return settings, ErrInvalidPendingVerification
+	}
+	if settings.confirmationURL != "" {
+		if _, err := prepareEndpointForOperations(settings.confirmationURL); err != nil {
+			return settings, ErrInvalidPendingVerification
+		}
+	}
+
+	return settings, nil
+}
+
+// The service's HTTP client, transport and all,
+// with the verification timeout and redirect policy
+func (s *WebhookEndpointServiceImpl) verificationClient() *http.Client {
+
+	client := *s.http
+	client.Timeout = s.verification.timeout
+
+	switch s.verification.redirects {
+	case RedirectSameHost:
+		client.CheckRedirect = func(request *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects || !strings.EqualFold(request.URL.Host, via[0].URL.Host) {
+				return ErrVerificationRedirect
+			}
+			return nil
+		}
+	case RedirectNone:
+		client.CheckRedirect = func(_ *http.Request, _ []*http.Request) error {
+			return ErrVerificationRedirect
+		}
+	}
+
+	return &client
+}
+
+// Why Verify failed, see VerificationError
+type VerificationFailure string
+
+const (
+	// the request didnt go through, Err tells why
+	VerificationUnreachable VerificationFailure = "unreachable"
+	// redirected somewhere HOOK_VERIFICATION_REDIRECTS doesnt allow
+	VerificationRedirected VerificationFailure = "redirected"
+	// answered with a status other than 2xx
+	VerificationUnexpectedStatus VerificationFailure = "unexpected_status"
+	// answered, but not with what was expected
+	VerificationWrongResponse VerificationFailure = "wrong_response"
+	// the challenge nonce expired or was already used
+	VerificationNonceExpired VerificationFailure = "nonce_expired"
+	// the endpoint has no secret to answer a challenge with, see service.RotateSecret()
+	VerificationMissingSecret VerificationFailure = "missing_secret"
+)
+
+// Returned by Verify when the endpoint fails verification.
+// errors.Is(err, ErrFailedEndpointVerification) holds for all of them.
+type VerificationError struct {
+	Reason VerificationFailure
+	// status of the endpoint's answer, 0 without one
+	StatusCode int
+	Err        error
+}
+
+func (e *VerificationError) Error() string {
+	message := "failed to verify an endpoint: " + string(e.Reason)
+	if e.StatusCode != 0 {
+		message += fmt.Sprintf(", status %d", e.StatusCode)
+	}
+	if e.Err != nil {
+		message += ": " + strings.TrimSpace(e.Err.Error())
+	}
+	return message
+}
+
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+func (e *VerificationError) Is(target error) bool {
+	return target == ErrFailedEndpointVerification
+}
+
+// answers longer than this are cut, they're wrong anyway
+const maxVerificationResponse = 64 << 10
+
+// Sends a verification request and checks the status of the answer
+func (s *WebhookEndpointServiceImpl) sendVerification(model_endpoint *WebhookEndpointDB, build func() (*http.Request, error)) (*http.Response, error) {
+
+	response, err := s.sendToEndpoint(s.verificationClient(), model_endpoint, build)
+
+	var url_err *url.Error
+	switch {
+	case errors.Is(err, ErrVerificationRedirect):
+		return nil, &VerificationError{Reason: VerificationRedirected, Err: err}
+	case errors.As(err, &url_err):
+		return nil, &VerificationError{Reason: VerificationUnreachable, Err: err}
+	case err != nil:
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, maxVerificationResponse))
+		response.Body.Close()
+		return nil, &VerificationError{Reason: VerificationUnexpectedStatus, StatusCode: response.StatusCode}
+	}
+	return response, nil
+}
+
+// Runs the endpoint's verification protocol, or the service-wide one
+func (s *WebhookEndpointServiceImpl) verifyEndpoint(model_endpoint *WebhookEndpointDB) (err error) {
+
+	started := time.Now()
+	defer func() {
+		s.metrics.observeVerification(err, time.Since(started))
+	}()
+
+	protocol, err := s.verificationProtocol(model_endpoint)
+	if err != nil {
+		return err
+	}
+
+	// requests are signed whenever there's a secret to sign them with
+	secret, err := s.decryptSecret(model_endpoint)
+	if err != nil {
+		return err
+	}
+	if secret == "" && protocol.Mode == VerificationChallenge {
+		return &VerificationError{Reason: VerificationMissingSecret}
+	}
+
+	endpoint_uuid := model_endpoint.UUID.String()
+	fields := map[string]string{"id": endpoint_uuid}
+	var challenge string
+	if field := protocol.Mode.challengeField(); field != "" {
+		challenge, err = s.issueNonce(model_endpoint.UUID)
+		if err != nil {
+			return err
+		}
+		fields[field] = challenge
+	}
+	// the receiver may call back instead of answering, see VerifyAsync
+	if model_endpoint.Status == PendingVerification && model_endpoint.ConfirmationNonce != "" && secret != "" {
+		token := confirmationToken(secret, model_endpoint.ConfirmationNonce)
+		fields["confirmation_token"] = token
+		if s.verification.confirmationURL != "" {
+			fields["confirmation_url"] = confirmationURL(s.verification.confirmationURL, token)
+		}
+	}
+
+	params := url.Values{}
+	var body []byte
+	if protocol.Method == http.MethodPost {
+		body, err = json.Marshal(verificationRequestBody(fields))
+		if err != nil {
+			return err
+		}
+	} else {
+		for name, value := range fields {
+			params.Set(name, value)
+		}
+	}
+
+	target, err := prepareEndpointForVerification(model_endpoint.URL, protocol.Path, params)
+	if err != nil {
+		return err
+	}
+
+	response, err := s.sendVerification(model_endpoint, func() (*http.Request, error) {
+		request, err := http.NewRequest(protocol.Method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			request.Header.Set("Content-Type", "application/json")
+		}
+		if secret != "" {
+			// the body, or the challenge of GET requests
+			payload := body
+			if payload == nil {
+				payload = []byte(challenge)
+			}
+			signRequest(request, secret, payload, time.Now())
+		}
+		return request, nil
+	})
+	if err != nil {
+		// never answered, the nonce expires on its own
+		return err
+	}
+	defer response.Body.Close()
+
+	if challenge != "" {
+		err = s.consumeNonce(model_endpoint.UUID, challenge)
+		if err != nil {
+			return err
+		}
+	}
+
+	var expected string
+	switch protocol.Mode {
+	case VerificationChallenge:
+		expected = ChallengeResponse(secret, challenge)
+	case VerificationChallengeEcho:
+		expected = challenge
+	default:
+		expected = endpoint_uuid
+	}
+
+	answer := io.LimitReader(response.Body, maxVerificationResponse)
+	if protocol.ResponseField != "" {
+		err = verifyJSONResponseForVerification(answer, protocol.ResponseField, expected)
+	} else {
+		err = verifyResponseBodyForVerification(answer, expected)
+	}
+	if err != nil {
+		return &VerificationError{Reason: VerificationWrongResponse, StatusCode: response.StatusCode, Err: err}
+	}
+	return nil
+}
+
+// {"type": "url_verification", "id": "<uuid>", "challenge": "<random>"}
+func verificationRequestBody(fields map[string]string) map[string]string {
+	body := map[string]string{"type": "url_verification"}
+	for name, value := range fields {
+		body[name] = value
+	}
+	return body
+}
+
+var ErrUnsupportedVerificationMode error = errors.New(
+	`
+	cant accept this verification mode.
+	Recover by setting HOOK_VERIFICATION_MODE to one of: echo, challenge, challenge-echo
+	`,
+)
+var ErrInvalidVerificationTimeout error = errors.New(
+	`
+	cant accept this verification timeout.
+	Recover by setting HOOK_VERIFICATION_TIMEOUT to a positive duration, like 3s
+	`,
+)
+var ErrInvalidNonceTTL error = errors.New(
+	`
+	cant accept this verification nonce lifetime.
+	Recover by setting HOOK_VERIFICATION_NONCE_TTL to a duration
+	at least as long as HOOK_VERIFICATION_TIMEOUT
+	`,
+)
+var ErrUnsupportedRedirectPolicy error = errors.New(
+	`
+	cant accept this verification redirect policy.
+	Recover by setting HOOK_VERIFICATION_REDIRECTS to one of: follow, same-host, none
+	`,
+)
+var ErrVerificationRedirect error = errors.New(
+	`
+	the endpoint redirected the verification request somewhere the redirect policy doesnt allow.
+	Recover by registering the URL the endpoint redirects to,
+	or by relaxing HOOK_VERIFICATION_REDIRECTS
+	`,
+)
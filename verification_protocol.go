@@ -0,0 +1,155 @@
+package ironhook
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// How an endpoint is verified. An endpoint with a protocol of its own
+// ignores the service-wide HOOK_VERIFICATION_* one, the fields it leaves
+// empty take the defaults: echo, GET /verification, the whole body.
+//
+// Slack-style handshakes, for instance:
+//
+//	VerificationProtocol{
+//		Mode:          VerificationChallengeEcho,
+//		Path:          "/",
+//		Method:        "POST",
+//		ResponseField: "challenge",
+//	}
+type VerificationProtocol struct {
+	Mode VerificationMode `json:"mode,omitempty"`
+	// appended to the endpoint URL, "/" for the URL as it is
+	Path string `json:"path,omitempty"`
+	// GET sends the id and the challenge as query parameters,
+	// POST as a JSON body: {"type": "url_verification", "id": ..., "challenge": ...}
+	Method string `json:"method,omitempty"`
+	// JSON field of the answer, like "challenge" or "data.challenge".
+	// The whole body is the answer when empty
+	ResponseField string `json:"response_field,omitempty"`
+}
+
+func (p VerificationProtocol) empty() bool {
+	return p == VerificationProtocol{}
+}
+
+func (p VerificationProtocol) withDefaults() VerificationProtocol {
+	if p.Mode == "" {
+		p.Mode = VerificationEcho
+	}
+	if p.Path == "" {
+		p.Path = "/verification"
+	}
+	p.Method = strings.ToUpper(p.Method)
+	if p.Method == "" {
+		p.Method = http.MethodGet
+	}
+	return p
+}
+
+func (p VerificationProtocol) validate() error {
+
+	if p.Mode != "" && !p.Mode.valid() {
+		return ErrUnsupportedVerificationMode
+	}
+
+	switch strings.ToUpper(p.Method) {
+	case "", http.MethodGet, http.MethodPost:
+	default:
+		return ErrInvalidVerificationProtocol
+	}
+
+	// a path, nothing more
+	if p.Path != "" {
+		u, err := url.Parse(p.Path)
+		if err != nil || u.Scheme != "" || u.Host != "" || u.RawQuery != "" || u.Fragment != "" ||
+			strings.Contains(p.Path, "..") {
+			return ErrInvalidVerificationProtocol
+		}
+	}
+
+	if p.ResponseField != "" {
+		for _, key := range strings.Split(p.ResponseField, ".") {
+			if key == "" {
+				return ErrInvalidVerificationProtocol
+			}
+		}
+	}
+	return nil
+}
+
+// "" for VerificationProtocol{}
+func encodeVerificationProtocol(protocol VerificationProtocol) string {
+	if protocol.empty() {
+		return ""
+	}
+	encoded, _ := json.Marshal(protocol)
+	return string(encoded)
+}
+
+func decodeVerificationProtocol(encoded string) VerificationProtocol {
+	var protocol VerificationProtocol
+	if encoded != "" {
+		_ = json.Unmarshal([]byte(encoded), &protocol)
+	}
+	return protocol
+}
+
+// the endpoint's protocol or the service-wide one, defaults filled in
+func (s *WebhookEndpointServiceImpl) verificationProtocol(model_endpoint *WebhookEndpointDB) (VerificationProtocol, error) {
+
+	protocol := decodeVerificationProtocol(model_endpoint.VerificationConfig)
+	if protocol.empty() {
+		return s.verification.protocol, nil
+	}
+	// saved before the rules changed
+	if err := protocol.validate(); err != nil {
+		return protocol, err
+	}
+	return protocol.withDefaults(), nil
+}
+
+// Replaces the verification protocol of the endpoint,
+// VerificationProtocol{} goes back to the service-wide one.
+//
+// endpoint.UUID is used to find the webhook in the database.
+func (s *WebhookEndpointServiceImpl) SetVerificationProtocol(endpoint WebhookEndpoint, protocol VerificationProtocol) (WebhookEndpoint, error) {
+
+	if err := protocol.validate(); err != nil {
+		return endpoint, err
+	}
+
+	model_endpoint, err := s.fetchWebhookEndpointFromDB(endpoint)
+	if err != nil {
+		return endpoint, err
+	}
+
+	s.log.Info(
+		"updating the endpoint verification protocol",
+		zap.String("UUID", endpoint.UUID.String()),
+		zap.String("Mode", string(protocol.Mode)),
+	)
+
+	model_endpoint.VerificationConfig = encodeVerificationProtocol(protocol)
+	tx := s.db.Model(model_endpoint).UpdateColumn("verification_config", model_endpoint.VerificationConfig)
+	if tx.Error != nil {
+		s.log.Error("couldnt save the endpoint verification protocol", zap.Error(tx.Error))
+		return endpoint, tx.Error
+	}
+
+	return *endpointDbToWeb(model_endpoint), nil
+}
+
+var ErrInvalidVerificationProtocol error = errors.New(
+	`
+	cant accept this verification protocol.
+	Recover by retrying with GET or POST, a path without a query,
+	and a response field like "challenge" or "data.challenge",
+	the same goes for HOOK_VERIFICATION_METHOD, _PATH and _RESPONSE_FIELD
+	`,
+)
@@ -0,0 +1,172 @@
+package ironhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_VerificationProtocolValidation(t *testing.T) {
+
+	cases := []struct {
+		protocol VerificationProtocol
+		want     error
+	}{
+		{VerificationProtocol{}, nil},
+		{VerificationProtocol{Mode: VerificationChallengeEcho, Path: "/", Method: "post", ResponseField: "challenge"}, nil},
+		{VerificationProtocol{Path: "/hooks/verify", ResponseField: "data.challenge"}, nil},
+		{VerificationProtocol{Mode: "guess"}, ErrUnsupportedVerificationMode},
+		{VerificationProtocol{Method: "PUT"}, ErrInvalidVerificationProtocol},
+		{VerificationProtocol{Path: "/verify?x=1"}, ErrInvalidVerificationProtocol},
+		{VerificationProtocol{Path: "https://elsewhere.example.com/verify"}, ErrInvalidVerificationProtocol},
+		{VerificationProtocol{Path: "/../admin"}, ErrInvalidVerificationProtocol},
+		{VerificationProtocol{ResponseField: "data..challenge"}, ErrInvalidVerificationProtocol},
+	}
+	for _, c := range cases {
+		if err := c.protocol.validate(); err != c.want {
+			t.Fatalf("%+v: have %v want %v", c.protocol, err, c.want)
+		}
+	}
+
+	target, err := prepareEndpointForVerification("https://example.com/hooks/slack/?team=acme", "/", url.Values{"id": {"abcd"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "https://example.com/hooks/slack/?id=abcd&team=acme" {
+		t.Fatal("Expected the URL as it is, query included, got ", target)
+	}
+}
+
+func Test_verifyJSONResponseForVerification(t *testing.T) {
+
+	cases := []struct {
+		body  string
+		field string
+		ok    bool
+	}{
+		{`{"challenge": "abcd"}`, "challenge", true},
+		{`{"data": {"challenge": "abcd"}}`, "data.challenge", true},
+		{`{"challenge": "abce"}`, "challenge", false},
+		{`{"challenge": 1234}`, "challenge", false},
+		{`{"data": "abcd"}`, "data.challenge", false},
+		{`abcd`, "challenge", false},
+	}
+	for _, c := range cases {
+		err := verifyJSONResponseForVerification(strings.NewReader(c.body), c.field, "abcd")
+		if (err == nil) != c.ok {
+			t.Fatalf("%s %s: %v", c.body, c.field, err)
+		}
+	}
+}
+
+// Slack-style: POST to the URL as it is, the challenge echoed in JSON
+func Test_ChallengeEchoOverPost(t *testing.T) {
+
+	var secret string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var request map[string]string
+		if r.Method != http.MethodPost || r.URL.Path != "/hooks/slack" || r.URL.Query().Get("team") != "acme" ||
+			json.Unmarshal(body, &request) != nil || request["type"] != "url_verification" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if VerifySignature(secret, r.Header, body, time.Minute) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"challenge": %q}`, request["challenge"])
+	}))
+	defer server.Close()
+
+	svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	endpoint, err := svc.Create(WebhookEndpoint{
+		URL: server.URL + "/hooks/slack?team=acme",
+		Verification: VerificationProtocol{
+			Mode:          VerificationChallengeEcho,
+			Path:          "/",
+			Method:        "POST",
+			ResponseField: "challenge",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret = endpoint.Secret
+
+	endpoint, err = svc.Verify(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Status != Verified {
+		t.Fatal("Expected the endpoint to be verified")
+	}
+}
+
+func Test_ServiceWideVerificationProtocol(t *testing.T) {
+
+	t.Setenv("HOOK_VERIFICATION_PATH", "/hooks/verify")
+	t.Setenv("HOOK_VERIFICATION_RESPONSE_FIELD", "data.id")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hooks/verify":
+			fmt.Fprintf(w, `{"data": {"id": %q}}`, r.URL.Query().Get("id"))
+		case "/verification":
+			fmt.Fprint(w, r.URL.Query().Get("id"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	endpoint, err := svc.Create(WebhookEndpoint{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.Verify(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an endpoint of its own ignores the service-wide protocol
+	endpoint, err = svc.Create(WebhookEndpoint{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err = svc.SetVerificationProtocol(endpoint, VerificationProtocol{Mode: VerificationEcho})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Verification.Mode != VerificationEcho {
+		t.Fatal("Expected the endpoint to report its protocol, found ", endpoint.Verification)
+	}
+	_, err = svc.Verify(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("HOOK_VERIFICATION_METHOD", "DELETE")
+	_, err = NewWebhookService(nil)
+	if err != ErrInvalidVerificationProtocol {
+		t.Fatal("Expected ErrInvalidVerificationProtocol, got ", err)
+	}
+}
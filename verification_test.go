@@ -0,0 +1,145 @@
+package ironhook
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+func Test_VerifyUsesServiceClient(t *testing.T) {
+
+	// no network at all, the transport answers itself
+	requests := 0
+	client := &http.Client{
+		Transport: roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+			requests++
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(request.URL.Query().Get("id"))),
+				Request:    request,
+			}, nil
+		}),
+	}
+
+	svc, err := NewWebhookService(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	endpoint, err := svc.Create(WebhookEndpoint{URL: "https://93.184.216.34/hooks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err = svc.Verify(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Status != Verified || requests != 1 {
+		t.Fatal("Expected the verification to go through the custom transport, requests: ", requests)
+	}
+}
+
+func Test_VerificationTimeout(t *testing.T) {
+
+	t.Setenv("HOOK_VERIFICATION_TIMEOUT", "50ms")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, r.URL.Query().Get("id"))
+	}))
+	defer server.Close()
+
+	svc, err := NewWebhookService(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	endpoint, err := svc.Create(WebhookEndpoint{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.Verify(endpoint)
+	if err == nil {
+		t.Fatal("Expected the verification to time out")
+	}
+
+	t.Setenv("HOOK_VERIFICATION_TIMEOUT", "0")
+	_, err = NewWebhookService(nil)
+	if err != ErrInvalidVerificationTimeout {
+		t.Fatal("Expected ErrInvalidVerificationTimeout, got ", err)
+	}
+}
+
+func Test_VerificationRedirectPolicy(t *testing.T) {
+
+	target := mockHttpWebhooksServerForTests()
+	defer target.Close()
+
+	// redirects within itself first, then to the target
+	var redirector *httptest.Server
+	redirector = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/moved") {
+			http.Redirect(w, r, target.URL+"/verification?"+r.URL.RawQuery, http.StatusFound)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/local") {
+			http.Redirect(w, r, redirector.URL+"/verification?"+r.URL.RawQuery, http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, r.URL.Query().Get("id"))
+	}))
+	defer redirector.Close()
+
+	cases := []struct {
+		policy   RedirectPolicy
+		path     string
+		redirect bool
+	}{
+		{RedirectFollow, "/moved", false},
+		{RedirectSameHost, "/moved", true},
+		{RedirectSameHost, "/local", false},
+		{RedirectNone, "/local", true},
+		{RedirectNone, "", false},
+	}
+
+	for _, c := range cases {
+		t.Setenv("HOOK_VERIFICATION_REDIRECTS", string(c.policy))
+
+		svc, err := NewWebhookService(redirector.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		endpoint, err := svc.Create(WebhookEndpoint{URL: redirector.URL + c.path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = svc.Verify(endpoint)
+		if c.redirect && !errors.Is(err, ErrVerificationRedirect) {
+			t.Fatalf("%s %s: expected ErrVerificationRedirect, got %v", c.policy, c.path, err)
+		}
+		if !c.redirect && err != nil {
+			t.Fatalf("%s %s: %v", c.policy, c.path, err)
+		}
+		svc.Close()
+	}
+
+	t.Setenv("HOOK_VERIFICATION_REDIRECTS", "sometimes")
+	_, err := NewWebhookService(nil)
+	if err != ErrUnsupportedRedirectPolicy {
+		t.Fatal("Expected ErrUnsupportedRedirectPolicy, got ", err)
+	}
+}